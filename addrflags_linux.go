@@ -0,0 +1,54 @@
+package zeroconf
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// transientAddrs returns the temporary (RFC 4941 privacy) and deprecated IPv6
+// addresses of the interface with the given index, as reported by netlink. It
+// returns nil if they cannot be determined.
+func transientAddrs(ifIndex int) map[string]bool {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_INET6)
+	if err != nil {
+		return nil
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil
+	}
+	transient := make(map[string]bool)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		// struct ifaddrmsg: family, prefix length, flags, scope, index
+		if int(binary.NativeEndian.Uint32(m.Data[4:8])) != ifIndex {
+			continue
+		}
+		flags := uint32(m.Data[2])
+		var addr net.IP
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			continue
+		}
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFA_ADDRESS:
+				addr = net.IP(a.Value)
+			case unix.IFA_FLAGS:
+				// Newer kernels report the flags beyond the first eight here.
+				if len(a.Value) >= 4 {
+					flags = binary.NativeEndian.Uint32(a.Value)
+				}
+			}
+		}
+		if addr != nil && flags&(unix.IFA_F_TEMPORARY|unix.IFA_F_DEPRECATED) != 0 {
+			transient[addr.String()] = true
+		}
+	}
+	return transient
+}
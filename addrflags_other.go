@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package zeroconf
+
+// transientAddrs returns nil: the temporary and deprecated IPv6 addresses are
+// not determined on this platform, all addresses are published.
+func transientAddrs(ifIndex int) map[string]bool {
+	return nil
+}
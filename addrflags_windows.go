@@ -0,0 +1,44 @@
+//go:build windows
+
+package zeroconf
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// transientAddrs returns the temporary (RFC 4941 privacy) and deprecated IPv6
+// addresses of the interface with the given index, as reported by
+// GetAdaptersAddresses. It returns nil if they cannot be determined.
+func transientAddrs(ifIndex int) map[string]bool {
+	size := uint32(15000)
+	var buf []byte
+	for {
+		buf = make([]byte, size)
+		err := windows.GetAdaptersAddresses(syscall.AF_INET6, windows.GAA_FLAG_SKIP_ANYCAST|windows.GAA_FLAG_SKIP_MULTICAST|windows.GAA_FLAG_SKIP_DNS_SERVER|windows.GAA_FLAG_SKIP_FRIENDLY_NAME, 0, (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])), &size)
+		if err == nil {
+			break
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW || size <= uint32(len(buf)) {
+			return nil
+		}
+	}
+	transient := make(map[string]bool)
+	for aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])); aa != nil; aa = aa.Next {
+		if int(aa.Ipv6IfIndex) != ifIndex {
+			continue
+		}
+		for ua := aa.FirstUnicastAddress; ua != nil; ua = ua.Next {
+			ip := ua.Address.IP()
+			if ip == nil {
+				continue
+			}
+			if ua.SuffixOrigin == windows.IpSuffixOriginRandom || ua.DadState == windows.IpDadStateDeprecated {
+				transient[ip.String()] = true
+			}
+		}
+	}
+	return transient
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -31,11 +32,31 @@ const (
 type clientOpts struct {
 	listenOn          IPType
 	ifaces            []net.Interface
+	sendIfaces        []net.Interface
+	ifaceNames        []string
+	ifaceCIDRs        []string
+	ifaceFilter       func(net.Interface) bool
+	trafficClass      int
+	hopLimit          int
+	onSendError       func(iface net.Interface, err error)
+	tap               func(CapturedPacket)
 	enableUnicast     bool
 	customIPv4Conn    *ipv4.PacketConn
 	customIPv6Conn    *ipv6.PacketConn
 	customIPv4Unicast []*net.UDPConn
 	customIPv6Unicast []*net.UDPConn
+	rawRecords        bool
+	checkHopLimit     bool
+	readinessTimeout  time.Duration
+	transport         *Transport
+	rejoinInterval    time.Duration
+	querySocket       bool
+	dualStack         bool
+	noPortFallback    bool
+	vrf               string
+	loopbackMode      bool
+	connEvents        connEvents
+	validation        ValidationPolicy
 }
 
 // ClientOption fills the option struct to configure intefaces, etc.
@@ -46,6 +67,8 @@ type ClientOption func(*clientOpts)
 // This does not guarantee that only mDNS entries of this sepcific
 // type passes. E.g. typical mDNS packets distributed via IPv4, may contain
 // both DNS A and AAAA entries.
+// Selecting IPv6 alone gives an IPv6-only mode for hosts without IPv4: no IPv4
+// socket is opened, and NewResolver fails unless an IPv6 interface is joined.
 func SelectIPTraffic(t IPType) ClientOption {
 	return func(o *clientOpts) {
 		o.listenOn = t
@@ -59,6 +82,34 @@ func SelectIfaces(ifaces []net.Interface) ClientOption {
 	}
 }
 
+// SelectSendIfaces selects the interfaces queries are sent on, independently
+// of the interfaces the multicast groups are joined on, which SelectIfaces
+// selects. E.g. a monitor may listen on all interfaces but only ever transmit
+// on one. Defaults to the interfaces listened on.
+func SelectSendIfaces(ifaces []net.Interface) ClientOption {
+	return func(o *clientOpts) {
+		o.sendIfaces = ifaces
+	}
+}
+
+// SelectIfaceNames selects the interfaces to query for mDNS records by name,
+// e.g. "eth0". NewResolver fails if one of them does not exist.
+func SelectIfaceNames(names ...string) ClientOption {
+	return func(o *clientOpts) {
+		o.ifaceNames = append(o.ifaceNames, names...)
+	}
+}
+
+// SelectIfacesByCIDR selects the interfaces to query for mDNS records by the
+// networks their addresses belong to, e.g. "192.168.1.0/24". NewResolver fails
+// if a network is malformed or no multicast interface has an address in any
+// of them.
+func SelectIfacesByCIDR(cidrs ...string) ClientOption {
+	return func(o *clientOpts) {
+		o.ifaceCIDRs = append(o.ifaceCIDRs, cidrs...)
+	}
+}
+
 // EnableUnicast enables unicast listening on network interface IPs
 func EnableUnicast(enable bool) ClientOption {
 	return func(o *clientOpts) {
@@ -66,6 +117,166 @@ func EnableUnicast(enable bool) ClientOption {
 	}
 }
 
+// WithInterfaceFilter restricts the interfaces used when none are selected
+// explicitly to those for which fn returns true, e.g. to skip point-to-point
+// links or interfaces with a small MTU.
+func WithInterfaceFilter(fn func(net.Interface) bool) ClientOption {
+	return func(o *clientOpts) {
+		o.ifaceFilter = fn
+	}
+}
+
+// WithTrafficClass sets the IPv4 TOS and IPv6 traffic class of the queries
+// sent, e.g. 0xc0 for DSCP CS6 on networks prioritizing control traffic. The
+// DSCP value takes the upper six bits. Sockets passed with WithCustomConn or
+// WithTransport are left alone.
+func WithTrafficClass(tc int) ClientOption {
+	return func(o *clientOpts) {
+		o.trafficClass = tc
+	}
+}
+
+// WithMulticastTTL sets the IPv4 TTL and IPv6 hop limit of the queries sent,
+// e.g. for lab networks where reflectors forward mDNS between segments. RFC6762
+// requires 255, the default; responders checking the TTL drop other values, as
+// WithHopLimitCheck does. Sockets shared through WithTransport or WithCustomConn
+// are left alone.
+func WithMulticastTTL(ttl int) ClientOption {
+	return func(o *clientOpts) {
+		o.hopLimit = ttl
+	}
+}
+
+// WithSendErrorHandler sets a function called whenever a query could not be
+// written on an interface, e.g. because the NIC is broken or the write timed
+// out. It is called from the sending goroutine and should not block. The
+// errors are also counted in ResolverStats.
+func WithSendErrorHandler(fn func(iface net.Interface, err error)) ClientOption {
+	return func(o *clientOpts) {
+		o.onSendError = fn
+	}
+}
+
+// WithPacketTap sets a function receiving a copy of every datagram the
+// resolver sends or receives, e.g. to write it to a PcapWriter or a channel. It
+// is called from the sending and receiving goroutines and should not block.
+func WithPacketTap(fn func(CapturedPacket)) ClientOption {
+	return func(o *clientOpts) {
+		o.tap = fn
+	}
+}
+
+// WithRawRecords attaches the DNS resource records each ServiceEntry was built
+// from to its Records field. This gives access to records the ServiceEntry model
+// does not cover, such as NSEC or vendor specific records in the additional section.
+func WithRawRecords(enable bool) ClientOption {
+	return func(o *clientOpts) {
+		o.rawRecords = enable
+	}
+}
+
+// WithHopLimitCheck drops multicast packets whose IP TTL or hop limit is not
+// 255, i.e. which did not originate on the local link (RFC6762 section 11).
+// Packets are accepted if the system does not report the TTL.
+func WithHopLimitCheck(enable bool) ClientOption {
+	return func(o *clientOpts) {
+		o.checkHopLimit = enable
+	}
+}
+
+// WithReadinessTimeout sets the time after which an interface that did not
+// receive any mDNS packet since it was joined is flagged as silent in
+// ResolverStats and a warning is logged. Defaults to 10 seconds.
+func WithReadinessTimeout(d time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.readinessTimeout = d
+	}
+}
+
+// WithGroupRejoin enables a health task which sends the multicast group joins
+// again at the given interval and warns about interfaces on which no packet of
+// another host arrived meanwhile. It repairs memberships some Wi-Fi drivers and
+// access points silently drop, without restarting the query. Sockets shared
+// through WithTransport or WithCustomConn are left alone. Disabled by default.
+func WithGroupRejoin(interval time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.rejoinInterval = interval
+	}
+}
+
+// WithQuerySocket makes the resolver send its queries from dedicated sockets on
+// ephemeral ports instead of the port 5353 sockets, and read the replies sent
+// back to them. Responders answer such queries by unicast, like legacy queries,
+// so replies arrive even where a firewall or another mDNS stack owns port 5353.
+// Multicast announcements are still received on the port 5353 sockets.
+func WithQuerySocket(enable bool) ClientOption {
+	return func(o *clientOpts) {
+		o.querySocket = enable
+	}
+}
+
+// WithDualStackSocket makes the resolver receive both IPv4 and IPv6 traffic on
+// a single AF_INET6 socket with IPV6_V6ONLY disabled, halving the number of
+// file descriptors, e.g. for processes running many Resolvers. It applies only
+// when both families are selected and the resolver opens its own sockets.
+// NewResolver fails on platforms without dual-stack sockets.
+func WithDualStackSocket(enable bool) ClientOption {
+	return func(o *clientOpts) {
+		o.dualStack = enable
+	}
+}
+
+// WithPortFallback sets whether the resolver falls back to querying from
+// ephemeral ports, like WithQuerySocket, when port 5353 cannot be bound because
+// another daemon owns it exclusively. Responders then answer by unicast, as to
+// legacy resolvers, but announcements of other hosts are missed. Enabled by
+// default; when disabled NewResolver fails instead.
+func WithPortFallback(enable bool) ClientOption {
+	return func(o *clientOpts) {
+		o.noPortFallback = !enable
+	}
+}
+
+// WithVRF binds the resolver's sockets to the VRF master device with the given
+// name, e.g. on routers and appliances separating networks with VRFs. Unless
+// interfaces are selected, the resolver uses the interfaces enslaved to the
+// VRF. Linux only.
+func WithVRF(name string) ClientOption {
+	return func(o *clientOpts) {
+		o.vrf = name
+	}
+}
+
+// WithLoopbackMode makes the resolver join the multicast groups on the loopback
+// interface only, so it discovers services of other processes on the same host
+// without any external network, e.g. in CI and tests. Pair it with
+// WithServerLoopbackMode. Interfaces selected explicitly take precedence.
+func WithLoopbackMode(enable bool) ClientOption {
+	return func(o *clientOpts) {
+		o.loopbackMode = enable
+	}
+}
+
+// WithConnEvents makes the resolver deliver the changes of its sockets and
+// multicast memberships to ch, e.g. groups joined or left, read and send errors
+// and sockets rebound, so daemons can log and alert on network problems. Events
+// are dropped while ch is full. Groups joined on sockets managed externally are
+// not reported.
+func WithConnEvents(ch chan<- ConnEvent) ClientOption {
+	return func(o *clientOpts) {
+		o.connEvents = ch
+	}
+}
+
+// WithValidation sets the checks applied to received packets and records
+// before they are used, see ValidationPolicy. StrictValidation enables all of
+// them. Dropped packets and records are counted in ResolverStats.
+func WithValidation(policy ValidationPolicy) ClientOption {
+	return func(o *clientOpts) {
+		o.validation = policy
+	}
+}
+
 // WithCustomConn allows providing custom network connections for mDNS operations.
 // The provided connections will be used instead of creating new ones, and they
 // will not be closed when the resolver shuts down, allowing external management
@@ -84,6 +295,36 @@ func WithCustomConn(ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn, ipv4Un
 	}
 }
 
+// WithTransport makes the resolver send and receive through the sockets of a
+// shared Transport, e.g. the one of a Server in the same process, instead of
+// opening its own. The interfaces default to the ones of the transport.
+func WithTransport(t *Transport) ClientOption {
+	return func(o *clientOpts) {
+		o.transport = t
+	}
+}
+
+// QueryOption configures a single Browse or Lookup.
+type QueryOption func(*lookupParams)
+
+// WithAnswerWindow sets for how long after a question was sent answers are
+// still attributed to it. This only affects ResolverStats: later answers are
+// counted as late, but processed like any other. Defaults to one second.
+func WithAnswerWindow(d time.Duration) QueryOption {
+	return func(p *lookupParams) {
+		p.answerWindow = d
+	}
+}
+
+// WithUpdates sets whether the query delivers an entry again, with Updated set,
+// whenever later answers change its host name, port, TXT records or addresses.
+// Enabled by default; disable it to receive every instance only once.
+func WithUpdates(enable bool) QueryOption {
+	return func(p *lookupParams) {
+		p.updates = enable
+	}
+}
+
 // Resolver acts as entry point for service lookups and to browse the DNS-SD.
 type Resolver struct {
 	c *client
@@ -92,27 +333,68 @@ type Resolver struct {
 // NewResolver creates a new resolver and joins the UDP multicast groups to
 // listen for mDNS messages.
 func NewResolver(options ...ClientOption) (*Resolver, error) {
-	// Apply default configuration and load supplied options.
+	c, err := newClient(applyClientOpts(options))
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{
+		c: c,
+	}, nil
+}
+
+// applyClientOpts applies the default configuration and loads the supplied
+// options.
+func applyClientOpts(options []ClientOption) clientOpts {
 	var conf = clientOpts{
-		listenOn: IPv4AndIPv6,
+		listenOn:         IPv4AndIPv6,
+		readinessTimeout: defaultReadinessTimeout,
 	}
 	for _, o := range options {
 		if o != nil {
 			o(&conf)
 		}
 	}
+	if conf.vrf != "" {
+		conf.ifaceFilter = vrfFilter(conf.vrf, conf.ifaceFilter)
+	}
+	return conf
+}
 
-	c, err := newClient(conf)
-	if err != nil {
-		return nil, err
+// Stats returns a snapshot of the resolver's traffic and processing counters.
+func (r *Resolver) Stats() ResolverStats {
+	return r.c.stats.snapshot()
+}
+
+// AddInterface starts using iface while the resolver is running: the multicast
+// groups are joined on it and, if EnableUnicast is set, unicast listeners are
+// opened on its addresses. Queries are sent on it too unless SelectSendIfaces
+// was used. Sockets shared through WithTransport or WithCustomConn are left
+// alone. Adding an interface in use already does nothing.
+func (r *Resolver) AddInterface(iface net.Interface) error {
+	return r.c.addInterface(iface)
+}
+
+// RemoveInterface stops using iface: the multicast groups are left on it and
+// the unicast listeners bound to its addresses are closed.
+func (r *Resolver) RemoveInterface(iface net.Interface) error {
+	return r.c.removeInterface(iface)
+}
+
+// Membership returns the interfaces the mDNS multicast groups were joined on,
+// and those on which joining failed, e.g. to warn that a VPN interface never
+// joined. With WithTransport it is the membership of the transport; it is
+// empty for sockets passed with WithCustomConn.
+func (r *Resolver) Membership() Membership {
+	if r.c.transport != nil {
+		return r.c.transport.Membership()
 	}
-	return &Resolver{
-		c: c,
-	}, nil
+	r.c.connMu.Lock()
+	defer r.c.connMu.Unlock()
+	return r.c.membership
 }
 
 // Browse for all services of a given type in a given domain.
-func (r *Resolver) Browse(ctx context.Context, service, domain string, subtypes []string, entries chan<- *ServiceEntry) error {
+func (r *Resolver) Browse(ctx context.Context, service, domain string, subtypes []string, entries chan<- *ServiceEntry, opts ...QueryOption) error {
 	params := defaultParams(service)
 	if domain != "" {
 		params.Domain = domain
@@ -120,6 +402,7 @@ func (r *Resolver) Browse(ctx context.Context, service, domain string, subtypes
 	params.Entries = entries
 	params.Subtypes = subtypes
 	params.isBrowsing = true
+	params.apply(opts)
 	ctx, cancel := context.WithCancel(ctx)
 	go r.c.mainloop(ctx, params)
 
@@ -140,13 +423,14 @@ func (r *Resolver) Browse(ctx context.Context, service, domain string, subtypes
 }
 
 // Lookup a specific service by its name and type in a given domain.
-func (r *Resolver) Lookup(ctx context.Context, instance, service, domain string, entries chan<- *ServiceEntry) error {
+func (r *Resolver) Lookup(ctx context.Context, instance, service, domain string, entries chan<- *ServiceEntry, opts ...QueryOption) error {
 	params := defaultParams(service)
 	params.Instance = instance
 	if domain != "" {
 		params.Domain = domain
 	}
 	params.Entries = entries
+	params.apply(opts)
 	ctx, cancel := context.WithCancel(ctx)
 	go r.c.mainloop(ctx, params)
 	err := r.c.query(params)
@@ -171,56 +455,193 @@ func defaultParams(service string) *lookupParams {
 	return newLookupParams("", service, "local", false, make(chan *ServiceEntry))
 }
 
+const (
+	// Number of read errors in a row after which a multicast socket is
+	// considered broken
+	readErrorLimit = 3
+	// Bounds of the backoff between attempts to rebind a broken socket
+	rebindInitialInterval = 1 * time.Second
+	rebindMaxInterval     = 60 * time.Second
+	// Number of entries held back while browsing until a PTR record points
+	// to them, beyond which further ones are dropped
+	maxHeldEntries = 256
+)
+
 // Client structure encapsulates both IPv4/IPv6 UDP connections.
 type client struct {
+	// Guards the connections and interfaces, which change when rebinding and
+	// when interfaces are added or removed at runtime
+	connMu          sync.Mutex
+	closed          bool
 	ipv4conn        *ipv4.PacketConn
 	ipv6conn        *ipv6.PacketConn
 	ipv4unicastConn []*net.UDPConn
 	ipv6unicastConn []*net.UDPConn
 	ifaces          []net.Interface
+	// Interfaces queries are sent on, and whether they were selected
+	// explicitly instead of following ifaces
+	sendIfaces         []net.Interface
+	sendIfacesSelected bool
+	// Settings applied to interfaces added at runtime
+	listenOn      IPType
+	enableUnicast bool
+	// IPv4 TOS and IPv6 traffic class, and TTL and hop limit, of the sockets
+	// opened by the client, zero for the defaults
+	trafficClass int
+	hopLimit     int
+	// Called when a query could not be sent on an interface, if set
+	onSendError func(iface net.Interface, err error)
+	// Receives a copy of the datagrams sent and received, if set
+	tap func(CapturedPacket)
+	// Interfaces the groups were joined on by the client's own sockets
+	membership Membership
+	// Starts receiving on a unicast listener opened at runtime, set once the
+	// receivers run
+	startUnicast func(conn *net.UDPConn)
+	// Settings of the sockets the client opens, also when rebinding
+	connOpts connOpts
+	// Whether ipv4conn and ipv6conn wrap the same dual-stack socket, which
+	// is read through ipv6conn only
+	dualStack bool
 	// Flags to indicate if connections are managed externally
 	ipv4connManaged        bool
 	ipv6connManaged        bool
 	ipv4unicastConnManaged bool
 	ipv6unicastConnManaged bool
+	rawRecords             bool
+	checkHopLimit          bool
+	// Checks applied to received packets and records, and the subnets of the
+	// interfaces for the source check
+	validation ValidationPolicy
+	localNets  localNets
+	// Shared sockets to receive from instead of the connections, if any
+	transport *Transport
+	// Sends the group joins again periodically, if set
+	health *groupHealth
+	// Ephemeral port sockets queries are sent from, if enabled, and the same
+	// sockets to read the unicast replies from
+	queryConn4 *ipv4.PacketConn
+	queryConn6 *ipv6.PacketConn
+	queryConns []*net.UDPConn
+
+	stats clientStats
 }
 
 // Client structure constructor
 func newClient(opts clientOpts) (*client, error) {
 	ifaces := opts.ifaces
+	if len(opts.ifaceNames) > 0 || len(opts.ifaceCIDRs) > 0 {
+		resolved, err := resolveIfaces(opts.ifaceNames, opts.ifaceCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(append([]net.Interface(nil), ifaces...), resolved...)
+	}
+	if len(ifaces) == 0 && opts.transport != nil {
+		ifaces = opts.transport.interfaces()
+	}
+	if len(ifaces) == 0 && opts.loopbackMode {
+		if ifaces = loopbackInterfaces(); len(ifaces) == 0 {
+			return nil, fmt.Errorf("no loopback interface is up")
+		}
+		if opts.listenOn == IPv4AndIPv6 && !loopbackMulticast6(ifaces) {
+			opts.listenOn = IPv4
+		}
+	}
 	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+		ifaces = listMulticastInterfaces(opts.ifaceFilter)
+	}
+	if opts.vrf != "" {
+		if err := checkVRF(opts.vrf); err != nil {
+			return nil, err
+		}
+		if len(ifaces) == 0 {
+			return nil, fmt.Errorf("no multicast interface enslaved to VRF %s", opts.vrf)
+		}
+	}
+	co := applyConnOpts(nil)
+	co.vrf = opts.vrf
+	co.events = opts.connEvents
+	sendIfaces := opts.sendIfaces
+	if len(sendIfaces) == 0 {
+		sendIfaces = ifaces
 	}
 
 	// Use custom connections if provided, otherwise create new ones
+	var membership Membership
 	var ipv4conn *ipv4.PacketConn
+	var ipv6conn *ipv6.PacketConn
+	dualStack := opts.dualStack && opts.transport == nil && opts.customIPv4Conn == nil &&
+		opts.customIPv6Conn == nil && opts.listenOn == IPv4AndIPv6
+	// Families whose port 5353 socket could not be bound, queried from
+	// ephemeral ports instead
+	var fallback4, fallback6 bool
+	portInUse := func(err error) bool {
+		if opts.noPortFallback || !isBindError(err) {
+			return false
+		}
+		log.Printf("[WARN] mdns: port 5353 is not available, querying from an ephemeral port: %v", err)
+		return true
+	}
+	if dualStack {
+		var err error
+		if ipv4conn, ipv6conn, err = joinDualStackMulticast(ifaces, &membership, co); err != nil {
+			if !portInUse(err) {
+				return nil, err
+			}
+			fallback4, fallback6, dualStack = true, true, false
+		}
+	}
 	var ipv4connManaged bool
-	if opts.customIPv4Conn != nil {
+	if opts.transport != nil {
+		if (opts.listenOn & IPv4) > 0 {
+			ipv4conn = opts.transport.ipv4conn
+		}
+		ipv4connManaged = true
+	} else if opts.customIPv4Conn != nil {
 		ipv4conn = opts.customIPv4Conn
 		ipv4connManaged = true
-	} else if (opts.listenOn & IPv4) > 0 {
+	} else if (opts.listenOn&IPv4) > 0 && !dualStack && !fallback4 {
 		var err error
-		ipv4conn, err = joinUdp4Multicast(ifaces)
+		ipv4conn, err = newUdp4Multicast(ifaces, &membership, co)
 		if err != nil {
-			return nil, err
+			if !portInUse(err) {
+				return nil, err
+			}
+			fallback4 = true
 		}
 		ipv4connManaged = false
 	}
 
-	var ipv6conn *ipv6.PacketConn
 	var ipv6connManaged bool
-	if opts.customIPv6Conn != nil {
+	if opts.transport != nil {
+		if (opts.listenOn & IPv6) > 0 {
+			ipv6conn = opts.transport.ipv6conn
+		}
+		ipv6connManaged = true
+	} else if opts.customIPv6Conn != nil {
 		ipv6conn = opts.customIPv6Conn
 		ipv6connManaged = true
-	} else if (opts.listenOn & IPv6) > 0 {
+	} else if (opts.listenOn&IPv6) > 0 && !dualStack && !fallback6 {
 		var err error
-		ipv6conn, err = joinUdp6Multicast(ifaces)
+		ipv6conn, err = newUdp6Multicast(ifaces, &membership, co)
 		if err != nil {
-			return nil, err
+			if !portInUse(err) {
+				return nil, err
+			}
+			fallback6 = true
 		}
 		ipv6connManaged = false
 	}
 
+	// A single selected family must be usable, e.g. on IPv6-only hosts.
+	if opts.listenOn == IPv4 && ipv4conn == nil && !fallback4 {
+		return nil, fmt.Errorf("no IPv4 interface joined")
+	}
+	if opts.listenOn == IPv6 && ipv6conn == nil && !fallback6 {
+		return nil, fmt.Errorf("no IPv6 interface joined")
+	}
+
 	// 创建单播监听连接或使用自定义连接
 	var ipv4unicastConn []*net.UDPConn
 	var ipv6unicastConn []*net.UDPConn
@@ -236,7 +657,7 @@ func newClient(opts clientOpts) (*client, error) {
 		listenIPv4 := (opts.listenOn & IPv4) > 0
 		listenIPv6 := (opts.listenOn & IPv6) > 0
 		var err error
-		ipv4unicastConn, ipv6unicastConn, err = createUnicastListeners(ifaces, listenIPv4, listenIPv6)
+		ipv4unicastConn, ipv6unicastConn, err = createUnicastListeners(ifaces, listenIPv4, listenIPv6, co)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create unicast listeners: %v", err)
 		}
@@ -244,43 +665,83 @@ func newClient(opts clientOpts) (*client, error) {
 		ipv6unicastConnManaged = false
 	}
 
-	return &client{
+	c := &client{
 		ipv4conn:               ipv4conn,
 		ipv6conn:               ipv6conn,
 		ipv4unicastConn:        ipv4unicastConn,
 		ipv6unicastConn:        ipv6unicastConn,
 		ifaces:                 ifaces,
+		sendIfaces:             sendIfaces,
+		sendIfacesSelected:     len(opts.sendIfaces) > 0,
+		listenOn:               opts.listenOn,
+		enableUnicast:          opts.enableUnicast,
+		trafficClass:           opts.trafficClass,
+		hopLimit:               opts.hopLimit,
+		onSendError:            opts.onSendError,
+		tap:                    opts.tap,
+		membership:             membership,
+		dualStack:              dualStack,
 		ipv4connManaged:        ipv4connManaged,
 		ipv6connManaged:        ipv6connManaged,
 		ipv4unicastConnManaged: ipv4unicastConnManaged,
 		ipv6unicastConnManaged: ipv6unicastConnManaged,
-	}, nil
+		rawRecords:             opts.rawRecords,
+		checkHopLimit:          opts.checkHopLimit || opts.validation.HopLimit,
+		validation:             opts.validation,
+		transport:              opts.transport,
+		connOpts:               co,
+	}
+	var v4 *ipv4.PacketConn
+	var v6 *ipv6.PacketConn
+	if !ipv4connManaged {
+		v4 = ipv4conn
+	}
+	if !ipv6connManaged {
+		v6 = ipv6conn
+	}
+	c.tuneConns(v4, v6)
+	query4, query6 := fallback4, fallback6
+	if opts.querySocket && !opts.transport.virtual() {
+		query4, query6 = query4 || ipv4conn != nil, query6 || ipv6conn != nil
+	}
+	if query4 || query6 {
+		if err := c.openQuerySockets(query4, query6); err != nil {
+			c.shutdown()
+			return nil, fmt.Errorf("failed to open query sockets: %v", err)
+		}
+	}
+	if opts.rejoinInterval > 0 && (!ipv4connManaged || !ipv6connManaged) {
+		c.health = newGroupHealth(opts.rejoinInterval)
+	}
+	c.stats.initInterfaces(ifaces, opts.readinessTimeout)
+	return c, nil
 }
 
 // Start listeners and waits for the shutdown signal from exit channel
 func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 	// start listening for responses
 	msgCh := make(chan *dnsMsg, 265)
-	if c.ipv4conn != nil {
-		go c.recv(ctx, c.ipv4conn, msgCh)
-	}
-	if c.ipv6conn != nil {
-		go c.recv(ctx, c.ipv6conn, msgCh)
+	c.startReceivers(ctx, msgCh)
+	if c.health != nil {
+		go c.health.run(ctx.Done(), c.interfaces, c.rejoinGroups)
 	}
 
-	// 启动单播监听
-	for _, conn := range c.ipv4unicastConn {
-		go c.recvUnicast(ctx, conn, msgCh)
-	}
-	for _, conn := range c.ipv6unicastConn {
-		go c.recvUnicast(ctx, conn, msgCh)
-	}
+	readiness := time.NewTimer(c.stats.readinessTimeout)
+	defer readiness.Stop()
 
 	// Iterate through channels from listeners goroutines
 	var entries, sentEntries map[string]*ServiceEntry
 	sentEntries = make(map[string]*ServiceEntry)
+	// While browsing, instances a PTR record of the service type pointed to,
+	// and entries held back until one does, by key
+	pointed := make(map[string]bool)
+	held := make(map[string]*ServiceEntry)
+	enumerating := params.ServiceTypeName() == params.ServiceName()
 	for {
 		select {
+		case <-readiness.C:
+			c.warnSilentInterfaces()
+			continue
 		case <-ctx.Done():
 			// Context expired. Notify subscriber that we are done here.
 			params.done()
@@ -291,58 +752,71 @@ func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 			entries = make(map[string]*ServiceEntry)
 			//fmt.Println("msg", msg)
 			sections := append(msg.Answer, msg.Ns...)
-			sections = append(sections, msg.Extra...)
+			sections = c.validRecords(append(sections, msg.Extra...), params)
 
 			for _, answer := range sections {
 				switch rr := answer.(type) {
 				case *dns.PTR:
-					if params.ServiceName() != rr.Hdr.Name {
+					// Names compare case-insensitively, some responders
+					// answer e.g. for _IPP._tcp.
+					if !strings.EqualFold(params.ServiceName(), rr.Hdr.Name) && !isSubtypeName(params, rr.Hdr.Name) {
 						//fmt.Println("service name mismatch", rr.Hdr.Name)
 						continue
 					}
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Ptr {
+					if !enumerating && !isInstanceOf(rr.Ptr, params.ServiceName()) {
+						continue
+					}
+					if params.ServiceInstanceName() != "" && !strings.EqualFold(params.ServiceInstanceName(), rr.Ptr) {
 						//fmt.Println("service instance name mismatch", rr.Ptr)
 						continue
 					}
-					if _, ok := entries[rr.Ptr]; !ok {
-						entries[rr.Ptr] = NewServiceEntry(
-							trimDot(strings.Replace(rr.Ptr, rr.Hdr.Name, "", -1)),
+					c.countAnswer(params)
+					key := strings.ToLower(rr.Ptr)
+					pointed[key] = rr.Hdr.Ttl > 0
+					if _, ok := entries[key]; !ok {
+						entries[key] = NewServiceEntry(
+							instanceLabel(rr.Ptr, rr.Hdr.Name),
 							params.Service,
 							params.Domain)
 					}
-					entries[rr.Ptr].TTL = rr.Hdr.Ttl
+					entries[key].TTL = rr.Hdr.Ttl
 				case *dns.SRV:
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Hdr.Name {
+					if params.ServiceInstanceName() != "" && !strings.EqualFold(params.ServiceInstanceName(), rr.Hdr.Name) {
 						continue
-					} else if !strings.HasSuffix(rr.Hdr.Name, params.ServiceName()) {
+					} else if !isInstanceOf(rr.Hdr.Name, params.ServiceName()) {
 						continue
 					}
-					if _, ok := entries[rr.Hdr.Name]; !ok {
-						entries[rr.Hdr.Name] = NewServiceEntry(
-							trimDot(strings.Replace(rr.Hdr.Name, params.ServiceName(), "", 1)),
+					c.countAnswer(params)
+					key := strings.ToLower(rr.Hdr.Name)
+					if _, ok := entries[key]; !ok {
+						entries[key] = NewServiceEntry(
+							instanceLabel(rr.Hdr.Name, params.ServiceName()),
 							params.Service,
 							params.Domain)
 					}
 					if udpAddr, ok := dnsMsgData.src.(*net.UDPAddr); ok {
-						entries[rr.Hdr.Name].SrcAddr = udpAddr.IP
+						entries[key].SrcAddr = udpAddr.IP
+						entries[key].Unicast = dnsMsgData.unicast
 					}
-					entries[rr.Hdr.Name].HostName = rr.Target
-					entries[rr.Hdr.Name].Port = int(rr.Port)
-					entries[rr.Hdr.Name].TTL = rr.Hdr.Ttl
+					entries[key].HostName = rr.Target
+					entries[key].Port = int(rr.Port)
+					entries[key].TTL = rr.Hdr.Ttl
 				case *dns.TXT:
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Hdr.Name {
+					if params.ServiceInstanceName() != "" && !strings.EqualFold(params.ServiceInstanceName(), rr.Hdr.Name) {
 						continue
-					} else if !strings.HasSuffix(rr.Hdr.Name, params.ServiceName()) {
+					} else if !isInstanceOf(rr.Hdr.Name, params.ServiceName()) {
 						continue
 					}
-					if _, ok := entries[rr.Hdr.Name]; !ok {
-						entries[rr.Hdr.Name] = NewServiceEntry(
-							trimDot(strings.Replace(rr.Hdr.Name, params.ServiceName(), "", 1)),
+					c.countAnswer(params)
+					key := strings.ToLower(rr.Hdr.Name)
+					if _, ok := entries[key]; !ok {
+						entries[key] = NewServiceEntry(
+							instanceLabel(rr.Hdr.Name, params.ServiceName()),
 							params.Service,
 							params.Domain)
 					}
-					entries[rr.Hdr.Name].Text = rr.Txt
-					entries[rr.Hdr.Name].TTL = rr.Hdr.Ttl
+					entries[key].Text = rr.Txt
+					entries[key].TTL = rr.Hdr.Ttl
 				}
 			}
 			// Associate IPs in a second round as other fields should be filled by now.
@@ -350,18 +824,23 @@ func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 				switch rr := answer.(type) {
 				case *dns.A:
 					for k, e := range entries {
-						if e.HostName == rr.Hdr.Name {
+						if strings.EqualFold(e.HostName, rr.Hdr.Name) {
 							entries[k].AddrIPv4 = append(entries[k].AddrIPv4, rr.A)
+							entries[k].noteAddr(rr.A, rr.Hdr.Class&qClassCacheFlush != 0)
 						}
 					}
 				case *dns.AAAA:
 					for k, e := range entries {
-						if e.HostName == rr.Hdr.Name {
+						if strings.EqualFold(e.HostName, rr.Hdr.Name) {
 							entries[k].AddrIPv6 = append(entries[k].AddrIPv6, rr.AAAA)
+							entries[k].noteAddr(rr.AAAA, rr.Hdr.Class&qClassCacheFlush != 0)
 						}
 					}
 				}
 			}
+			if c.rawRecords {
+				attachRecords(entries, sections)
+			}
 		}
 
 		if len(entries) > 0 {
@@ -369,9 +848,38 @@ func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 				if e.TTL == 0 {
 					delete(entries, k)
 					delete(sentEntries, k)
+					delete(held, k)
+					continue
+				}
+				if params.isBrowsing && !enumerating && !pointed[k] {
+					// Only instances a PTR record of the service type
+					// points to are delivered, so that records of other
+					// types cannot slip in. Their data is kept until the
+					// PTR record arrives.
+					if h, ok := held[k]; ok {
+						h.merge(e)
+					} else if len(held) < maxHeldEntries {
+						held[k] = e
+					}
 					continue
 				}
-				if _, ok := sentEntries[k]; ok {
+				if h, ok := held[k]; ok {
+					delete(held, k)
+					h.merge(e)
+					e = h
+				}
+				if sent, ok := sentEntries[k]; ok {
+					// Late or repeated answers update the cached entry.
+					updated := sent.clone()
+					if !updated.merge(e) {
+						continue
+					}
+					sentEntries[k] = updated
+					if params.updates {
+						updated.Updated = true
+						params.Entries <- updated
+						c.stats.entriesEmitted.Add(1)
+					}
 					continue
 				}
 
@@ -392,6 +900,7 @@ func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 				// This is also a point to possibly stop probing actively for a
 				// service entry.
 				params.Entries <- e
+				c.stats.entriesEmitted.Add(1)
 				sentEntries[k] = e
 				if !params.isBrowsing {
 					params.disableProbing()
@@ -401,9 +910,126 @@ func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 	}
 }
 
+// isSubtypeName reports whether name is one of the subtypes browsed for.
+func isSubtypeName(params *lookupParams, name string) bool {
+	for _, subtype := range params.Subtypes {
+		if strings.EqualFold(subtype, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnSilentInterfaces logs the interfaces which did not receive anything
+// within the readiness timeout, once per interface.
+func (c *client) warnSilentInterfaces() {
+	for _, i := range c.stats.ifaces {
+		if i.silent(c.stats.readinessTimeout) && !i.warned.Swap(true) {
+			log.Printf("[WARN] mdns: no packet received on interface %s within %s, is incoming UDP port 5353 blocked?", i.iface.Name, c.stats.readinessTimeout)
+		}
+	}
+}
+
+// countAnswer attributes a matching answer to the last question sent for params
+// if it arrived within the answer window.
+func (c *client) countAnswer(params *lookupParams) {
+	c.stats.answersMatched.Add(1)
+	if time.Since(params.lastQueryTime()) > params.answerWindow {
+		c.stats.lateAnswers.Add(1)
+	}
+}
+
+// attachRecords appends to each entry every record owned by its instance name or
+// host name, as well as the PTR records pointing at the instance. Entries are
+// keyed by their lower case instance name.
+func attachRecords(entries map[string]*ServiceEntry, sections []dns.RR) {
+	for k, e := range entries {
+		for _, rr := range sections {
+			hdr := rr.Header()
+			switch {
+			case strings.EqualFold(hdr.Name, k):
+			case e.HostName != "" && strings.EqualFold(hdr.Name, e.HostName):
+			default:
+				if ptr, ok := rr.(*dns.PTR); !ok || !strings.EqualFold(ptr.Ptr, k) {
+					continue
+				}
+			}
+			e.Records = append(e.Records, rr)
+		}
+	}
+}
+
+// startReceivers starts a receiving goroutine for each connection, all of them
+// delivering to msgCh until ctx is done.
+func (c *client) startReceivers(ctx context.Context, msgCh chan *dnsMsg) {
+	if c.transport != nil {
+		go runRecovering("transport receiver", func() { c.recvTransport(ctx, msgCh) })
+	} else {
+		if c.ipv4conn != nil && !c.dualStack {
+			go runRecovering("IPv4 receiver", func() { c.recv(ctx, c.ipv4conn, msgCh) })
+		}
+		if c.ipv6conn != nil {
+			go runRecovering("IPv6 receiver", func() { c.recv(ctx, c.ipv6conn, msgCh) })
+		}
+	}
+
+	// 启动单播监听
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.startUnicast = func(conn *net.UDPConn) {
+		go runRecovering("unicast receiver", func() { c.recvUnicast(ctx, conn, msgCh) })
+	}
+	for _, conn := range c.ipv4unicastConn {
+		c.startUnicast(conn)
+	}
+	for _, conn := range c.ipv6unicastConn {
+		c.startUnicast(conn)
+	}
+	for _, conn := range c.queryConns {
+		c.startUnicast(conn)
+	}
+}
+
+// openQuerySockets opens the ephemeral port sockets queries are sent from for
+// the given address families.
+func (c *client) openQuerySockets(ipv4, ipv6 bool) error {
+	if ipv4 {
+		conn, pkConn, err := newQueryConn4(c.connOpts)
+		if err != nil {
+			return err
+		}
+		c.queryConns = append(c.queryConns, conn)
+		c.queryConn4 = pkConn
+	}
+	if ipv6 {
+		conn, pkConn, err := newQueryConn6(c.connOpts)
+		if err != nil {
+			return err
+		}
+		c.queryConns = append(c.queryConns, conn)
+		c.queryConn6 = pkConn
+	}
+	c.tuneConns(c.queryConn4, c.queryConn6)
+	return nil
+}
+
+// tuneConns applies the traffic class and TTL settings to connections the
+// client opened, either of which may be nil.
+func (c *client) tuneConns(ipv4conn *ipv4.PacketConn, ipv6conn *ipv6.PacketConn) {
+	if c.trafficClass != 0 {
+		setTrafficClass(ipv4conn, ipv6conn, c.trafficClass)
+	}
+	if c.hopLimit != 0 {
+		setHopLimit(ipv4conn, ipv6conn, c.hopLimit)
+	}
+}
+
 // Shutdown client will close currently open connections and channel implicitly.
 // Connections managed externally (via WithCustomConn) will not be closed.
 func (c *client) shutdown() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.closed = true
 	if c.ipv4conn != nil && !c.ipv4connManaged {
 		c.ipv4conn.Close()
 	}
@@ -426,68 +1052,540 @@ func (c *client) shutdown() {
 			}
 		}
 	}
+	for _, conn := range c.queryConns {
+		conn.Close()
+	}
 }
 
 type dnsMsg struct {
 	msg *dns.Msg
 	src net.Addr
+	// Whether the message was addressed to us rather than to the multicast
+	// group
+	unicast bool
 }
 
 // Data receiving routine reads from connection, unpacks packets into dns.Msg
 // structures and sends them to a given msgCh channel
+// Persistent read errors, e.g. EBADF or ENETDOWN after a network change, make
+// it rebind the socket and join the multicast groups again, with exponential
+// backoff between attempts. Sockets managed externally are not rebound, reads
+// are retried instead.
 func (c *client) recv(ctx context.Context, l interface{}, msgCh chan *dnsMsg) {
-	var readFrom func([]byte) (n int, src net.Addr, err error)
-
-	switch pConn := l.(type) {
-	case *ipv6.PacketConn:
-		readFrom = func(b []byte) (n int, src net.Addr, err error) {
-			n, _, src, err = pConn.ReadFrom(b)
-			return
-		}
-	case *ipv4.PacketConn:
-		readFrom = func(b []byte) (n int, src net.Addr, err error) {
-			n, _, src, err = pConn.ReadFrom(b)
-			return
-		}
-
-	default:
+	readFrom := packetReader(l)
+	if readFrom == nil {
 		return
 	}
 
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = rebindInitialInterval
+	bo.MaxInterval = rebindMaxInterval
+	bo.MaxElapsedTime = 0
+	bo.Reset()
+
 	buf := make([]byte, 65536)
-	var fatalErr error
+	failures := 0
 	for {
 		// Handles the following cases:
 		// - ReadFrom aborts with error due to closed UDP connection -> causes ctx cancel
-		// - ReadFrom aborts otherwise.
-		// TODO: the context check can be removed. Verify!
-		if ctx.Err() != nil || fatalErr != nil {
+		// - ReadFrom aborts otherwise -> retried, the socket is rebound if
+		//   the errors persist.
+		if ctx.Err() != nil {
 			return
 		}
 
-		n, src, err := readFrom(buf)
+		n, info, src, err := readFrom(buf)
 		if err != nil {
-			fatalErr = err
+			if ctx.Err() != nil {
+				return
+			}
+			_, ipv6 := l.(*ipv6.PacketConn)
+			c.connOpts.events.failed(ipv6, nil, err)
+			if failures++; failures < readErrorLimit {
+				continue
+			}
+			wait := bo.NextBackOff()
+			log.Printf("[WARN] mdns: %d read errors in a row, rebinding in %v: %v", failures, wait, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			if l = c.rebind(l); l == nil {
+				return
+			}
+			readFrom = packetReader(l)
+			failures = 0
 			continue
 		}
-		msg := new(dns.Msg)
-		if err := msg.Unpack(buf[:n]); err != nil {
-			log.Printf("[WARN] mdns: [%s] Failed to unpack packet: %v", src, err)
+		failures = 0
+		bo.Reset()
+		if !c.handlePacket(ctx, buf[:n], info, src, msgCh) {
+			return
+		}
+	}
+}
+
+// packetReader returns a function reading a packet from the given multicast
+// connection, or nil if it is of an unknown type. On Linux packets are read in
+// batches with recvmmsg, and handed out one by one.
+func packetReader(l interface{}) func([]byte) (n int, info packetInfo, src net.Addr, err error) {
+	if readFrom := platformPacketReader(l); readFrom != nil {
+		return readFrom
+	}
+	switch pConn := l.(type) {
+	case *ipv6.PacketConn:
+		if runtime.GOOS == "linux" {
+			return batchReader6(pConn)
+		}
+		return func(b []byte) (n int, info packetInfo, src net.Addr, err error) {
+			var cm *ipv6.ControlMessage
+			n, cm, src, err = pConn.ReadFrom(b)
+			return n, ipv6PacketInfo(cm), src, err
+		}
+	case *ipv4.PacketConn:
+		if runtime.GOOS == "linux" {
+			return batchReader4(pConn)
+		}
+		return func(b []byte) (n int, info packetInfo, src net.Addr, err error) {
+			var cm *ipv4.ControlMessage
+			n, cm, src, err = pConn.ReadFrom(b)
+			return n, ipv4PacketInfo(cm), src, err
+		}
+	}
+	return nil
+}
+
+// ipv4PacketInfo returns what the control message tells about a packet, which
+// is nothing if cm is nil.
+func ipv4PacketInfo(cm *ipv4.ControlMessage) packetInfo {
+	if cm == nil {
+		return packetInfo{ttl: -1}
+	}
+	return packetInfo{ifIndex: cm.IfIndex, ttl: cm.TTL, dst: cm.Dst}
+}
+
+// ipv6PacketInfo returns what the control message tells about a packet, which
+// is nothing if cm is nil.
+func ipv6PacketInfo(cm *ipv6.ControlMessage) packetInfo {
+	if cm == nil {
+		return packetInfo{ttl: -1}
+	}
+	info := packetInfo{ifIndex: cm.IfIndex, ttl: cm.HopLimit, dst: cm.Dst}
+	if cm.HopLimit == 0 {
+		// IPv4 packets read from a dual-stack socket carry no hop limit.
+		info.ttl = -1
+	}
+	return info
+}
+
+// readBatchSize is the number of packets read at once on Linux.
+const readBatchSize = 16
+
+// batchReader4 returns a function reading a packet from conn, which reads up to
+// readBatchSize packets per system call and returns the ones left over on the
+// next calls.
+func batchReader4(conn *ipv4.PacketConn) func([]byte) (int, packetInfo, net.Addr, error) {
+	msgs := make([]ipv4.Message, readBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, maxPacketSize)}
+		msgs[i].OOB = ipv4.NewControlMessage(ipv4.FlagInterface | ipv4.FlagDst | ipv4.FlagTTL)
+	}
+	var next, count int
+	return func(b []byte) (int, packetInfo, net.Addr, error) {
+		if next == count {
+			n, err := conn.ReadBatch(msgs, 0)
+			if err != nil {
+				next, count = 0, 0
+				return 0, packetInfo{ttl: -1}, nil, err
+			}
+			next, count = 0, n
+		}
+		m := &msgs[next]
+		next++
+		var cm *ipv4.ControlMessage
+		if m.NN > 0 {
+			cm = new(ipv4.ControlMessage)
+			if cm.Parse(m.OOB[:m.NN]) != nil {
+				cm = nil
+			}
+		}
+		return copy(b, m.Buffers[0][:m.N]), ipv4PacketInfo(cm), m.Addr, nil
+	}
+}
+
+// batchReader6 returns a function reading a packet from conn, see batchReader4.
+func batchReader6(conn *ipv6.PacketConn) func([]byte) (int, packetInfo, net.Addr, error) {
+	msgs := make([]ipv6.Message, readBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, maxPacketSize)}
+		msgs[i].OOB = ipv6.NewControlMessage(ipv6.FlagInterface | ipv6.FlagDst | ipv6.FlagHopLimit)
+	}
+	var next, count int
+	return func(b []byte) (int, packetInfo, net.Addr, error) {
+		if next == count {
+			n, err := conn.ReadBatch(msgs, 0)
+			if err != nil {
+				next, count = 0, 0
+				return 0, packetInfo{ttl: -1}, nil, err
+			}
+			next, count = 0, n
+		}
+		m := &msgs[next]
+		next++
+		var cm *ipv6.ControlMessage
+		if m.NN > 0 {
+			cm = new(ipv6.ControlMessage)
+			if cm.Parse(m.OOB[:m.NN]) != nil {
+				cm = nil
+			}
+		}
+		return copy(b, m.Buffers[0][:m.N]), ipv6PacketInfo(cm), m.Addr, nil
+	}
+}
+
+// rebind replaces the broken multicast connection l by a new one joined to the
+// multicast groups on the client's interfaces, and returns the connection to
+// read from next. Connections managed externally, and connections which could
+// not be rebound this time, are returned as is. It returns nil if the client
+// was shut down meanwhile.
+func (c *client) rebind(l interface{}) interface{} {
+	var (
+		next       interface{}
+		err        error
+		membership Membership
+	)
+	c.connMu.Lock()
+	ifaces := c.ifaces
+	c.connMu.Unlock()
+	if c.dualStack {
+		return c.rebindDualStack(ifaces)
+	}
+	switch l.(type) {
+	case *ipv4.PacketConn:
+		if c.ipv4connManaged {
+			return l
+		}
+		var conn *ipv4.PacketConn
+		if conn, err = newUdp4Multicast(ifaces, &membership, c.connOpts); err == nil {
+			c.tuneConns(conn, nil)
+			next = conn
+		}
+	case *ipv6.PacketConn:
+		if c.ipv6connManaged {
+			return l
+		}
+		var conn *ipv6.PacketConn
+		if conn, err = newUdp6Multicast(ifaces, &membership, c.connOpts); err == nil {
+			c.tuneConns(nil, conn)
+			next = conn
+		}
+	}
+	if err != nil {
+		log.Printf("[WARN] mdns: failed to rebind socket: %v", err)
+		return l
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	switch conn := next.(type) {
+	case *ipv4.PacketConn:
+		if c.closed {
+			conn.Close()
+			return nil
+		}
+		c.ipv4conn.Close()
+		c.ipv4conn = conn
+		c.membership.IPv4Joined, c.membership.IPv4Failed = membership.IPv4Joined, membership.IPv4Failed
+		c.connOpts.events.emit(ConnEvent{Type: ConnRebound})
+	case *ipv6.PacketConn:
+		if c.closed {
+			conn.Close()
+			return nil
+		}
+		c.ipv6conn.Close()
+		c.ipv6conn = conn
+		c.membership.IPv6Joined, c.membership.IPv6Failed = membership.IPv6Joined, membership.IPv6Failed
+		c.connOpts.events.emit(ConnEvent{Type: ConnRebound, IPv6: true})
+	}
+	c.stats.socketRebinds.Add(1)
+	return next
+}
+
+// rebindDualStack replaces the broken dual-stack socket by a new one joined to
+// the multicast groups on ifaces, and returns its IPv6 connection to read from
+// next.
+func (c *client) rebindDualStack(ifaces []net.Interface) interface{} {
+	var membership Membership
+	conn4, conn6, err := joinDualStackMulticast(ifaces, &membership, c.connOpts)
+	if err != nil {
+		log.Printf("[WARN] mdns: failed to rebind socket: %v", err)
+		c.connMu.Lock()
+		defer c.connMu.Unlock()
+		return c.ipv6conn
+	}
+	c.tuneConns(conn4, conn6)
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closed {
+		conn6.Close()
+		return nil
+	}
+	c.ipv6conn.Close()
+	c.ipv4conn, c.ipv6conn = conn4, conn6
+	c.membership = membership
+	c.stats.socketRebinds.Add(1)
+	c.connOpts.events.emit(ConnEvent{Type: ConnRebound, IPv6: true})
+	return conn6
+}
+
+// addInterface joins the multicast groups on iface and opens its unicast
+// listeners.
+func (c *client) addInterface(iface net.Interface) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closed {
+		return fmt.Errorf("resolver is shut down")
+	}
+	if hasInterface(c.ifaces, iface.Index) {
+		return nil
+	}
+
+	joined, owned := false, false
+	if c.ipv4conn != nil && !c.ipv4connManaged && interfaceSupportsIPv4(&iface) {
+		owned = true
+		err := c.ipv4conn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4})
+		if err == nil {
+			joined = true
+		}
+		c.membership.record(false, iface, err)
+		c.connOpts.events.joined(false, iface, err)
+	}
+	if c.ipv6conn != nil && !c.ipv6connManaged && interfaceSupportsIPv6(&iface) {
+		owned = true
+		err := c.ipv6conn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6})
+		if err == nil {
+			joined = true
+		}
+		c.membership.record(true, iface, err)
+		c.connOpts.events.joined(true, iface, err)
+	}
+	if owned && !joined {
+		return fmt.Errorf("failed to join multicast groups on %s", iface.Name)
+	}
+	c.connOpts.events.emit(ConnEvent{Type: ConnInterfaceAdded, Interface: iface})
+
+	ifaces := make([]net.Interface, 0, len(c.ifaces)+1)
+	c.ifaces = append(append(ifaces, c.ifaces...), iface)
+	if !c.sendIfacesSelected {
+		c.sendIfaces = c.ifaces
+	}
+
+	if c.enableUnicast && !c.ipv4unicastConnManaged {
+		v4, v6, err := createUnicastListeners([]net.Interface{iface}, c.listenOn&IPv4 > 0, c.listenOn&IPv6 > 0, c.connOpts)
+		if err != nil {
+			log.Printf("[WARN] mdns: failed to create unicast listeners on %s: %v", iface.Name, err)
+		}
+		c.ipv4unicastConn = append(c.ipv4unicastConn, v4...)
+		c.ipv6unicastConn = append(c.ipv6unicastConn, v6...)
+		if c.startUnicast != nil {
+			for _, conn := range append(v4, v6...) {
+				c.startUnicast(conn)
+			}
+		}
+	}
+	return nil
+}
+
+// interfaces returns the interfaces the multicast groups are joined on.
+func (c *client) interfaces() []net.Interface {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.ifaces
+}
+
+// rejoinGroups leaves and joins again the multicast groups on iface, so that a
+// fresh membership report is sent. Sockets managed externally are left alone.
+func (c *client) rejoinGroups(iface *net.Interface) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	var joinErr error
+	if c.ipv4conn != nil && !c.ipv4connManaged && interfaceSupportsIPv4(iface) {
+		_ = c.ipv4conn.LeaveGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4})
+		err := c.ipv4conn.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4})
+		c.membership.rejoined(false, *iface, err)
+		c.connOpts.events.joined(false, *iface, err)
+		if err != nil {
+			joinErr = err
+		}
+	}
+	if c.ipv6conn != nil && !c.ipv6connManaged && interfaceSupportsIPv6(iface) {
+		_ = c.ipv6conn.LeaveGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6})
+		err := c.ipv6conn.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6})
+		c.membership.rejoined(true, *iface, err)
+		c.connOpts.events.joined(true, *iface, err)
+		if err != nil {
+			joinErr = err
+		}
+	}
+	return joinErr
+}
+
+// removeInterface leaves the multicast groups on iface and closes the unicast
+// listeners bound to its addresses.
+func (c *client) removeInterface(iface net.Interface) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if !hasInterface(c.ifaces, iface.Index) {
+		return fmt.Errorf("interface %s is not in use", iface.Name)
+	}
+
+	if c.ipv4conn != nil && !c.ipv4connManaged {
+		if c.ipv4conn.LeaveGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4}) == nil {
+			c.connOpts.events.emit(ConnEvent{Type: ConnGroupLeft, Interface: iface})
+		}
+	}
+	if c.ipv6conn != nil && !c.ipv6connManaged {
+		if c.ipv6conn.LeaveGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6}) == nil {
+			c.connOpts.events.emit(ConnEvent{Type: ConnGroupLeft, Interface: iface, IPv6: true})
+		}
+	}
+	c.membership.remove(iface.Index)
+	c.ifaces = withoutInterface(c.ifaces, iface.Index)
+	if !c.sendIfacesSelected {
+		c.sendIfaces = c.ifaces
+	}
+
+	if !c.ipv4unicastConnManaged {
+		addrs, _ := iface.Addrs()
+		c.ipv4unicastConn = closeListenersOn(c.ipv4unicastConn, addrs)
+		c.ipv6unicastConn = closeListenersOn(c.ipv6unicastConn, addrs)
+	}
+	return nil
+}
+
+// hasInterface reports whether ifaces contains the interface with the given
+// index.
+func hasInterface(ifaces []net.Interface, index int) bool {
+	for _, iface := range ifaces {
+		if iface.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutInterface returns a copy of ifaces without the interface with the
+// given index.
+func withoutInterface(ifaces []net.Interface, index int) []net.Interface {
+	var kept []net.Interface
+	for _, iface := range ifaces {
+		if iface.Index != index {
+			kept = append(kept, iface)
+		}
+	}
+	return kept
+}
+
+// filterInterfaces returns the interfaces of ifaces for which keep returns
+// true.
+func filterInterfaces(ifaces []net.Interface, keep func(*net.Interface) bool) []net.Interface {
+	var kept []net.Interface
+	for i := range ifaces {
+		if keep(&ifaces[i]) {
+			kept = append(kept, ifaces[i])
+		}
+	}
+	return kept
+}
+
+// closeListenersOn closes the listeners bound to one of addrs and returns the
+// others.
+func closeListenersOn(conns []*net.UDPConn, addrs []net.Addr) []*net.UDPConn {
+	var kept []*net.UDPConn
+	for _, conn := range conns {
+		local, _ := conn.LocalAddr().(*net.UDPAddr)
+		bound := false
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && local != nil && ipnet.IP.Equal(local.IP) {
+				bound = true
+				break
+			}
+		}
+		if bound {
+			conn.Close()
 			continue
 		}
-		dMsg := &dnsMsg{msg: msg, src: src}
-		select {
-		case msgCh <- dMsg:
-			//fmt.Println(src, msg)
+		kept = append(kept, conn)
+	}
+	return kept
+}
 
-			// Submit decoded DNS message and continue.
+// recvTransport receives the packets of the shared transport.
+func (c *client) recvTransport(ctx context.Context, msgCh chan *dnsMsg) {
+	packets, unsubscribe := c.transport.subscribe()
+	defer unsubscribe()
+	for {
+		select {
 		case <-ctx.Done():
-			// Abort.
 			return
+		case p, ok := <-packets:
+			if !ok || !c.handlePacket(ctx, p.data, p.info, p.from, msgCh) {
+				return
+			}
 		}
 	}
 }
 
+// handlePacket decodes a multicast packet and submits it to msgCh. It returns
+// false if ctx was cancelled meanwhile.
+func (c *client) handlePacket(ctx context.Context, packet []byte, info packetInfo, src net.Addr, msgCh chan *dnsMsg) bool {
+	if c.tap != nil {
+		capturePacket(c.tap, false, info.ifIndex, src, info.dstAddr(), packet)
+	}
+	c.stats.countPacket(src)
+	c.stats.countIfacePacket(info.ifIndex)
+	if c.health != nil {
+		c.health.seen(info.ifIndex, src)
+	}
+	if c.checkHopLimit && !isOnLink(info.ttl) {
+		c.stats.offLinkDrops.Add(1)
+		return true
+	}
+	if !c.acceptSource(src) {
+		return true
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil {
+		c.stats.unpackFailures.Add(1)
+		log.Printf("[WARN] mdns: [%s] Failed to unpack packet: %v", src, err)
+		return true
+	}
+	return c.submit(ctx, msgCh, &dnsMsg{msg: msg, src: src, unicast: info.unicast()})
+}
+
+// submit hands a decoded message to the processing loop. Messages arriving
+// while its buffer is full are dropped, as the socket buffer would drop them,
+// so receiving never stalls behind a slow subscriber. Dropped messages and
+// those arriving after ctx was cancelled count as channel drops. It returns
+// false if ctx was cancelled.
+func (c *client) submit(ctx context.Context, msgCh chan *dnsMsg, m *dnsMsg) bool {
+	if ctx.Err() != nil {
+		c.stats.channelDrops.Add(1)
+		return false
+	}
+	select {
+	case msgCh <- m:
+	default:
+		c.stats.channelDrops.Add(1)
+	}
+	return true
+}
+
 // recvUnicast receives data from unicast UDP connections
 func (c *client) recvUnicast(ctx context.Context, conn *net.UDPConn, msgCh chan *dnsMsg) {
 	buf := make([]byte, 65536)
@@ -505,18 +1603,18 @@ func (c *client) recvUnicast(ctx context.Context, conn *net.UDPConn, msgCh chan
 			fatalErr = err
 			continue
 		}
+		capturePacket(c.tap, false, 0, src, conn.LocalAddr(), buf[:n])
+		c.stats.countPacket(src)
+		if !c.acceptSource(src) {
+			continue
+		}
 		msg := new(dns.Msg)
 		if err := msg.Unpack(buf[:n]); err != nil {
+			c.stats.unpackFailures.Add(1)
 			log.Printf("[WARN] mdns: [%s] Failed to unpack unicast packet: %v", src, err)
 			continue
 		}
-		dMsg := &dnsMsg{msg: msg, src: src}
-		select {
-		case msgCh <- dMsg:
-			//fmt.Println(msg)
-			// Submit decoded DNS message and continue.
-		case <-ctx.Done():
-			// Abort.
+		if !c.submit(ctx, msgCh, &dnsMsg{msg: msg, src: src, unicast: true}) {
 			return
 		}
 	}
@@ -587,6 +1685,7 @@ func (c *client) query(params *lookupParams) error {
 		m.SetQuestion(serviceName, dns.TypePTR)
 	}
 	m.RecursionDesired = false
+	params.lastQuery.Store(time.Now().UnixNano())
 	if err := c.sendQuery(m); err != nil {
 		return err
 	}
@@ -594,45 +1693,88 @@ func (c *client) query(params *lookupParams) error {
 	return nil
 }
 
-// Pack the dns.Msg and write to available connections (multicast)
+// Pack the dns.Msg and write to available connections (multicast). Each write
+// has a deadline of its own, so an interface which blocks does not hold up the
+// others; failures are counted per interface in the stats and reported to the
+// send error handler. Interfaces without an address of a family are skipped
+// for it, writing there could only fail.
 func (c *client) sendQuery(msg *dns.Msg) error {
 	buf, err := msg.Pack()
 	if err != nil {
 		return err
 	}
-	if c.ipv4conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv4#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv4.ControlMessage
-		for ifi := range c.ifaces {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = c.ifaces[ifi].Index
-			default:
-				if err := c.ipv4conn.SetMulticastInterface(&c.ifaces[ifi]); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface: %s error: %v", c.ifaces[ifi].Name, err)
-				}
+	if c.transport.virtual() {
+		capturePacket(c.tap, true, virtualIface.Index, c.transport.localAddr(), c.transport.groupAddr(), buf)
+		c.sent(virtualIface, c.transport.send(buf, c.transport.groupAddr()))
+		return nil
+	}
+	c.connMu.Lock()
+	ipv4conn, ipv6conn := c.ipv4conn, c.ipv6conn
+	sendIfaces := c.sendIfaces
+	c.connMu.Unlock()
+	if c.queryConn4 != nil {
+		ipv4conn = c.queryConn4
+	}
+	if c.queryConn6 != nil {
+		ipv6conn = c.queryConn6
+	}
+	if ipv4conn != nil {
+		ifaces := filterInterfaces(sendIfaces, interfaceSupportsIPv4)
+		errs := writeMulticastAll4(ipv4conn, ifaces, buf, time.Now().Add(sendTimeout))
+		for i, err := range errs {
+			if err == nil {
+				capturePacket(c.tap, true, ifaces[i].Index, nil, ipv4Addr, buf)
+			} else if isMsgTooBig(err) {
+				iface := ifaces[i]
+				err = c.resendQuery(msg, len(buf), iface, func(b []byte) error {
+					err := writeMulticast4(ipv4conn, &iface, b, time.Now().Add(sendTimeout))
+					if err == nil {
+						capturePacket(c.tap, true, iface.Index, nil, ipv4Addr, b)
+					}
+					return err
+				})
 			}
-			c.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
-		}
-	}
-	if c.ipv6conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv6#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv6.ControlMessage
-		for ifi := range c.ifaces {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = c.ifaces[ifi].Index
-			default:
-				if err := c.ipv6conn.SetMulticastInterface(&c.ifaces[ifi]); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface: %s error: %v", c.ifaces[ifi].Name, err)
-				}
+			c.sent(ifaces[i], err)
+		}
+	}
+	if ipv6conn != nil {
+		ifaces := filterInterfaces(sendIfaces, interfaceSupportsIPv6)
+		errs := writeMulticastAll6(ipv6conn, ifaces, buf, time.Now().Add(sendTimeout))
+		for i, err := range errs {
+			if err == nil {
+				capturePacket(c.tap, true, ifaces[i].Index, nil, ipv6Addr, buf)
+			} else if isMsgTooBig(err) {
+				iface := ifaces[i]
+				err = c.resendQuery(msg, len(buf), iface, func(b []byte) error {
+					err := writeMulticast6(ipv6conn, &iface, b, time.Now().Add(sendTimeout))
+					if err == nil {
+						capturePacket(c.tap, true, iface.Index, nil, ipv6Addr, b)
+					}
+					return err
+				})
 			}
-			c.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+			c.sent(ifaces[i], err)
 		}
 	}
 	return nil
 }
+
+// resendQuery sends a query, whose packet of size bytes was rejected as too
+// large for the MTU of iface, again split into smaller packets with send. Known
+// answers spread over several packets set the TC bit (RFC 6762 section 7.2).
+func (c *client) resendQuery(msg *dns.Msg, size int, iface net.Interface, send func([]byte) error) error {
+	return resplit(msg, size, func(size int) int {
+		return smallerPacketSize(iface.Index, size)
+	}, send)
+}
+
+// sent records the outcome of writing a query on iface.
+func (c *client) sent(iface net.Interface, err error) {
+	c.stats.countSend(iface.Index, err)
+	if err != nil {
+		c.connOpts.events.failed(false, &iface, err)
+	}
+	if err != nil && c.onSendError != nil {
+		c.onSendError(iface, fmt.Errorf("failed to send query on %s: %v", iface.Name, err))
+	}
+}
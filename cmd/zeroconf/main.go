@@ -0,0 +1,96 @@
+// Command zeroconf records inventories of the services advertised on the local
+// network and compares them, to track drift over time.
+//
+//	zeroconf snapshot -types _ipp._tcp,_http._tcp -wait 10 > today.json
+//	zeroconf diff yesterday.json today.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NullYing/zeroconf"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "snapshot":
+		snapshot(os.Args[2:])
+	case "diff":
+		diff(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: zeroconf snapshot [-types t1,t2] [-wait s] | zeroconf diff old.json new.json")
+	os.Exit(2)
+}
+
+func snapshot(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	types := fs.String("types", "_workstation._tcp", "Comma separated list of service types to inventory.")
+	waitTime := fs.Int("wait", 10, "Duration in [s] to run discovery.")
+	fs.Parse(args)
+
+	inv, err := zeroconf.Snapshot(context.Background(), strings.Split(*types, ","), time.Second*time.Duration(*waitTime))
+	if err != nil {
+		log.Fatalln("Failed to take snapshot:", err.Error())
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(inv); err != nil {
+		log.Fatalln("Failed to write snapshot:", err.Error())
+	}
+}
+
+func diff(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	a, b := readInventory(args[0]), readInventory(args[1])
+	d := zeroconf.CompareSnapshots(a, b)
+	for _, svc := range d.Added {
+		fmt.Printf("+ %s %s:%d\n", svc.Name, svc.HostName, svc.Port)
+	}
+	for _, svc := range d.Removed {
+		fmt.Printf("- %s %s:%d\n", svc.Name, svc.HostName, svc.Port)
+	}
+	for _, c := range d.Changed {
+		fmt.Printf("~ %s\n", c.After.Name)
+		if c.Before.HostName != c.After.HostName || c.Before.Port != c.After.Port {
+			fmt.Printf("    target %s:%d -> %s:%d\n", c.Before.HostName, c.Before.Port, c.After.HostName, c.After.Port)
+		}
+		if strings.Join(c.Before.Addrs, " ") != strings.Join(c.After.Addrs, " ") {
+			fmt.Printf("    addrs  %v -> %v\n", c.Before.Addrs, c.After.Addrs)
+		}
+		if strings.Join(c.Before.Text, " ") != strings.Join(c.After.Text, " ") {
+			fmt.Printf("    text   %v -> %v\n", c.Before.Text, c.After.Text)
+		}
+	}
+	if !d.Empty() {
+		os.Exit(1)
+	}
+}
+
+func readInventory(path string) *zeroconf.Inventory {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalln("Failed to read snapshot:", err.Error())
+	}
+	var inv zeroconf.Inventory
+	if err := json.Unmarshal(data, &inv); err != nil {
+		log.Fatalf("Failed to parse snapshot %s: %v", path, err)
+	}
+	return &inv
+}
@@ -2,10 +2,15 @@ package zeroconf
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -42,10 +47,182 @@ func reusePortControl(network, address string, c syscall.RawConn) error {
 	return setReusePort(c)
 }
 
-func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
+// listenControl returns the function setting up sockets before they are bound:
+// port reuse, and binding to the VRF device if one is configured.
+func listenControl(o connOpts) func(network, address string, c syscall.RawConn) error {
+	if o.vrf == "" {
+		return reusePortControl
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := setReusePort(c); err != nil {
+			return err
+		}
+		return bindToDevice(c, o.vrf)
+	}
+}
+
+// vrfFilter restricts filter, which may be nil, to the interfaces enslaved to
+// the VRF master device with the given name.
+func vrfFilter(vrf string, filter func(net.Interface) bool) func(net.Interface) bool {
+	member := vrfMember(vrf)
+	return func(iface net.Interface) bool {
+		return member(iface) && (filter == nil || filter(iface))
+	}
+}
+
+// checkVRF verifies that the VRF master device with the given name exists.
+func checkVRF(vrf string) error {
+	if _, err := net.InterfaceByName(vrf); err != nil {
+		return fmt.Errorf("VRF device %s: %v", vrf, err)
+	}
+	return nil
+}
+
+// Membership lists, per address family, the interfaces the mDNS multicast
+// groups were joined on and those on which joining failed. Interfaces without
+// an address of a family are not tried for it.
+type Membership struct {
+	IPv4Joined []net.Interface
+	IPv4Failed []net.Interface
+	IPv6Joined []net.Interface
+	IPv6Failed []net.Interface
+}
+
+// record notes the outcome of joining the group of a family on iface. Failing
+// to join again on an interface already joined is not recorded, since joining
+// twice fails. The lists are replaced, never modified in place, so copies of m
+// can be handed out.
+func (m *Membership) record(ipv6 bool, iface net.Interface, err error) {
+	joined, failed := &m.IPv4Joined, &m.IPv4Failed
+	if ipv6 {
+		joined, failed = &m.IPv6Joined, &m.IPv6Failed
+	}
+	if err != nil && hasInterface(*joined, iface.Index) {
+		return
+	}
+	*joined = withoutInterface(*joined, iface.Index)
+	*failed = withoutInterface(*failed, iface.Index)
+	if err == nil {
+		*joined = append(*joined, iface)
+	} else {
+		*failed = append(*failed, iface)
+	}
+}
+
+// rejoined notes the outcome of joining the group of a family on iface again
+// after leaving it, so a failure is recorded even if it was joined before.
+func (m *Membership) rejoined(ipv6 bool, iface net.Interface, err error) {
+	if err != nil {
+		if ipv6 {
+			m.IPv6Joined = withoutInterface(m.IPv6Joined, iface.Index)
+		} else {
+			m.IPv4Joined = withoutInterface(m.IPv4Joined, iface.Index)
+		}
+	}
+	m.record(ipv6, iface, err)
+}
+
+// remove forgets the interface with the given index.
+func (m *Membership) remove(index int) {
+	m.IPv4Joined = withoutInterface(m.IPv4Joined, index)
+	m.IPv4Failed = withoutInterface(m.IPv4Failed, index)
+	m.IPv6Joined = withoutInterface(m.IPv6Joined, index)
+	m.IPv6Failed = withoutInterface(m.IPv6Failed, index)
+}
+
+// ConnOption configures the connections created by NewIPv4MulticastConn and
+// NewIPv6MulticastConn.
+type ConnOption func(*connOpts)
+
+type connOpts struct {
+	readBuffer   int
+	loopback     bool
+	trafficClass int
+	hopLimit     int
+	vrf          string
+	events       connEvents
+}
+
+// defaultReadBuffer is the receive buffer size of the sockets, large enough to
+// not drop bursts of announcements.
+const defaultReadBuffer = 1024 * 1024
+
+func applyConnOpts(options []ConnOption) connOpts {
+	conf := connOpts{
+		readBuffer: defaultReadBuffer,
+		loopback:   true,
+		hopLimit:   onLinkTTL,
+	}
+	for _, o := range options {
+		if o != nil {
+			o(&conf)
+		}
+	}
+	return conf
+}
+
+// WithReadBuffer sets the receive buffer size of the socket. Defaults to 1 MiB.
+func WithReadBuffer(bytes int) ConnOption {
+	return func(o *connOpts) {
+		o.readBuffer = bytes
+	}
+}
+
+// WithMulticastLoopback sets whether packets sent are delivered to the sockets
+// of the same host, e.g. so other processes see the services published. The
+// zeroconf Server and Resolver rely on it being enabled, the default.
+func WithMulticastLoopback(enable bool) ConnOption {
+	return func(o *connOpts) {
+		o.loopback = enable
+	}
+}
+
+// WithConnTrafficClass sets the IPv4 TOS or IPv6 traffic class of the packets
+// sent, see WithTrafficClass.
+func WithConnTrafficClass(tc int) ConnOption {
+	return func(o *connOpts) {
+		o.trafficClass = tc
+	}
+}
+
+// WithConnHopLimit sets the IPv4 TTL or IPv6 hop limit of the packets sent,
+// see WithMulticastTTL. Defaults to 255.
+func WithConnHopLimit(n int) ConnOption {
+	return func(o *connOpts) {
+		o.hopLimit = n
+	}
+}
+
+// WithConnVRF binds the socket to the VRF master device with the given name,
+// see WithVRF. The interfaces to join the group on must be enslaved to it.
+func WithConnVRF(name string) ConnOption {
+	return func(o *connOpts) {
+		o.vrf = name
+	}
+}
+
+// NewIPv4MulticastConn creates an mDNS connection as the Resolver and Server
+// do for themselves, to pass to WithCustomConn: the socket is bound to port
+// 5353 with port reuse, reports the interface, destination and TTL of received
+// packets, sends with TTL 255 and joins the multicast group on the given
+// interfaces, or on all multicast interfaces if none are given. It fails if no
+// group could be joined. The caller closes the connection.
+func NewIPv4MulticastConn(ifaces []net.Interface, opts ...ConnOption) (*ipv4.PacketConn, error) {
+	return newUdp4Multicast(ifaces, nil, applyConnOpts(opts))
+}
+
+// NewIPv6MulticastConn is the IPv6 counterpart of NewIPv4MulticastConn.
+func NewIPv6MulticastConn(ifaces []net.Interface, opts ...ConnOption) (*ipv6.PacketConn, error) {
+	return newUdp6Multicast(ifaces, nil, applyConnOpts(opts))
+}
+
+// newUdp6Multicast opens an IPv6 mDNS socket set up according to o and joins
+// the multicast group on the given interfaces, recording the outcome in m if
+// not nil.
+func newUdp6Multicast(interfaces []net.Interface, m *Membership, o connOpts) (*ipv6.PacketConn, error) {
 	// 使用 ListenConfig 来支持端口复用
 	lc := &net.ListenConfig{
-		Control: reusePortControl,
+		Control: listenControl(o),
 	}
 
 	conn, err := lc.ListenPacket(context.Background(), "udp6", mdnsWildcardAddrIPv6.String())
@@ -60,7 +237,7 @@ func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
 	}
 
 	// 设置接收缓冲区大小
-	if err := udpConn.SetReadBuffer(1024 * 1024); err != nil { // 1MB
+	if err := udpConn.SetReadBuffer(o.readBuffer); err != nil {
 		log.Printf("[WARN] Failed to set read buffer: %v", err)
 	}
 
@@ -68,11 +245,17 @@ func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
 	pkConn := ipv6.NewPacketConn(udpConn)
 	pkConn.SetControlMessage(ipv6.FlagInterface, true)
 	pkConn.SetControlMessage(ipv6.FlagDst, true)
+	pkConn.SetControlMessage(ipv6.FlagHopLimit, true)
 
-	_ = pkConn.SetMulticastHopLimit(255)
+	_ = pkConn.SetMulticastHopLimit(o.hopLimit)
+	_ = pkConn.SetHopLimit(o.hopLimit)
+	_ = pkConn.SetMulticastLoopback(o.loopback)
+	if o.trafficClass != 0 {
+		setTrafficClass(nil, pkConn, o.trafficClass)
+	}
 
 	if len(interfaces) == 0 {
-		interfaces = listMulticastInterfaces()
+		interfaces = listMulticastInterfaces(nil)
 	}
 	// log.Println("Using multicast interfaces: ", interfaces)
 
@@ -84,10 +267,15 @@ func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
 			continue
 		}
 		attemptedJoins++
-		if err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
+		err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6})
+		if err != nil {
 			// log.Println("Udp6 JoinGroup failed for iface ", iface)
 			failedJoins++
 		}
+		if m != nil {
+			m.record(true, iface, err)
+		}
+		o.events.joined(true, iface, err)
 	}
 	if attemptedJoins == 0 {
 		pkConn.Close()
@@ -101,10 +289,97 @@ func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
 	return pkConn, nil
 }
 
-func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
+// joinDualStackMulticast opens a single AF_INET6 mDNS socket with IPV6_V6ONLY
+// disabled, so it receives both IPv4 and IPv6 packets, and joins both multicast
+// groups on the given interfaces, recording the outcome in m if not nil. The
+// socket is returned wrapped once per family: the IPv6 connection reads all
+// packets, IPv4 ones with a v4-mapped source, and the IPv4 connection sends to
+// the IPv4 group. It fails on platforms without v4-mapped addresses, e.g.
+// OpenBSD.
+func joinDualStackMulticast(interfaces []net.Interface, m *Membership, o connOpts) (*ipv4.PacketConn, *ipv6.PacketConn, error) {
 	// 使用 ListenConfig 来支持端口复用
 	lc := &net.ListenConfig{
-		Control: reusePortControl,
+		Control: listenControl(o),
+	}
+	// With the "udp" network and a wildcard address, Go opens an AF_INET6
+	// socket with IPV6_V6ONLY disabled wherever v4-mapped addresses work.
+	conn, err := lc.ListenPacket(context.Background(), "udp", fmt.Sprintf(":%d", ipv6Addr.Port))
+	if err != nil {
+		return nil, nil, err
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected *net.UDPConn, got %T", conn)
+	}
+	if laddr, ok := udpConn.LocalAddr().(*net.UDPAddr); !ok || laddr.IP.To4() != nil {
+		udpConn.Close()
+		return nil, nil, fmt.Errorf("dual-stack sockets are not supported on this platform")
+	}
+
+	// 设置接收缓冲区大小以避免丢包
+	if err := udpConn.SetReadBuffer(o.readBuffer); err != nil {
+		log.Printf("[WARN] Failed to set read buffer: %v", err)
+	}
+
+	pkConn4 := ipv4.NewPacketConn(udpConn)
+	_ = pkConn4.SetMulticastTTL(o.hopLimit)
+	_ = pkConn4.SetTTL(o.hopLimit)
+	_ = pkConn4.SetMulticastLoopback(o.loopback)
+	pkConn6 := ipv6.NewPacketConn(udpConn)
+	pkConn6.SetControlMessage(ipv6.FlagInterface, true)
+	pkConn6.SetControlMessage(ipv6.FlagDst, true)
+	pkConn6.SetControlMessage(ipv6.FlagHopLimit, true)
+	_ = pkConn6.SetMulticastHopLimit(o.hopLimit)
+	_ = pkConn6.SetHopLimit(o.hopLimit)
+	_ = pkConn6.SetMulticastLoopback(o.loopback)
+
+	if len(interfaces) == 0 {
+		interfaces = listMulticastInterfaces(nil)
+	}
+	var joined, attempted int
+	for _, iface := range interfaces {
+		if interfaceSupportsIPv4(&iface) {
+			attempted++
+			err := pkConn4.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4})
+			if err == nil {
+				joined++
+			}
+			if m != nil {
+				m.record(false, iface, err)
+			}
+			o.events.joined(false, iface, err)
+		}
+		if interfaceSupportsIPv6(&iface) {
+			attempted++
+			err := pkConn6.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6})
+			if err == nil {
+				joined++
+			}
+			if m != nil {
+				m.record(true, iface, err)
+			}
+			o.events.joined(true, iface, err)
+		}
+	}
+	if attempted == 0 {
+		udpConn.Close()
+		return nil, nil, fmt.Errorf("udp: no multicast-capable interfaces found")
+	}
+	if joined == 0 {
+		udpConn.Close()
+		return nil, nil, fmt.Errorf("udp: failed to join any of these interfaces: %v", interfaces)
+	}
+	return pkConn4, pkConn6, nil
+}
+
+// newUdp4Multicast opens an IPv4 mDNS socket set up according to o and joins
+// the multicast group on the given interfaces, recording the outcome in m if
+// not nil.
+func newUdp4Multicast(interfaces []net.Interface, m *Membership, o connOpts) (*ipv4.PacketConn, error) {
+	// 使用 ListenConfig 来支持端口复用
+	lc := &net.ListenConfig{
+		Control: listenControl(o),
 	}
 
 	conn, err := lc.ListenPacket(context.Background(), "udp4", mdnsWildcardAddrIPv4.String())
@@ -120,7 +395,7 @@ func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
 	}
 
 	// 设置接收缓冲区大小以避免丢包
-	if err := udpConn.SetReadBuffer(1024 * 1024); err != nil { // 1MB
+	if err := udpConn.SetReadBuffer(o.readBuffer); err != nil {
 		log.Printf("[WARN] Failed to set read buffer: %v", err)
 	}
 
@@ -128,10 +403,16 @@ func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
 	pkConn := ipv4.NewPacketConn(udpConn)
 	pkConn.SetControlMessage(ipv4.FlagInterface, true)
 	pkConn.SetControlMessage(ipv4.FlagDst, true)
-	_ = pkConn.SetMulticastTTL(255)
+	pkConn.SetControlMessage(ipv4.FlagTTL, true)
+	_ = pkConn.SetMulticastTTL(o.hopLimit)
+	_ = pkConn.SetTTL(o.hopLimit)
+	_ = pkConn.SetMulticastLoopback(o.loopback)
+	if o.trafficClass != 0 {
+		setTrafficClass(pkConn, nil, o.trafficClass)
+	}
 
 	if len(interfaces) == 0 {
-		interfaces = listMulticastInterfaces()
+		interfaces = listMulticastInterfaces(nil)
 	}
 	// log.Println("Using multicast interfaces: ", interfaces)
 
@@ -143,10 +424,15 @@ func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
 			continue
 		}
 		attemptedJoins++
-		if err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
+		err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4})
+		if err != nil {
 			// log.Println("Udp4 JoinGroup failed for iface ", iface)
 			failedJoins++
 		}
+		if m != nil {
+			m.record(false, iface, err)
+		}
+		o.events.joined(false, iface, err)
 	}
 	if attemptedJoins == 0 {
 		pkConn.Close()
@@ -160,6 +446,214 @@ func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
 	return pkConn, nil
 }
 
+// multicastIfMu serializes setting the multicast interface of a socket and
+// writing to it, on systems where control messages cannot select the interface
+// of each packet, so concurrent senders do not use each other's interface.
+var multicastIfMu sync.Mutex
+
+// writeMu serializes setting the write deadline of a socket and writing to it.
+// Deadlines apply to the socket rather than to each write, and a socket may be
+// shared by servers and resolvers through a Transport, so senders must not
+// change the deadline of each other's writes.
+var writeMu sync.Mutex
+
+// writeWithDeadline calls write with the write deadline of conn set to
+// deadline.
+func writeWithDeadline(conn interface{ SetWriteDeadline(time.Time) error }, deadline time.Time, write func() error) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	conn.SetWriteDeadline(deadline)
+	return write()
+}
+
+// perPacketInterface reports whether control messages select the interface
+// each packet is sent on.
+// See https://pkg.go.dev/golang.org/x/net/ipv4#pkg-note-BUG
+// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
+func perPacketInterface() bool {
+	switch runtime.GOOS {
+	case "darwin", "ios", "linux":
+		return true
+	}
+	return false
+}
+
+// writeMulticast4 sends buf to the IPv4 mDNS group on iface.
+func writeMulticast4(conn *ipv4.PacketConn, iface *net.Interface, buf []byte, deadline time.Time) error {
+	var wcm ipv4.ControlMessage
+	if perPacketInterface() {
+		wcm.IfIndex = iface.Index
+	} else {
+		multicastIfMu.Lock()
+		defer multicastIfMu.Unlock()
+		if err := conn.SetMulticastInterface(iface); err != nil {
+			log.Printf("[WARN] mdns: Failed to set multicast interface: %s error: %v", iface.Name, err)
+		}
+	}
+	return writeWithDeadline(conn, deadline, func() error {
+		_, err := conn.WriteTo(buf, &wcm, ipv4Addr)
+		return err
+	})
+}
+
+// writeMulticast6 sends buf to the IPv6 mDNS group on iface.
+func writeMulticast6(conn *ipv6.PacketConn, iface *net.Interface, buf []byte, deadline time.Time) error {
+	var wcm ipv6.ControlMessage
+	if perPacketInterface() {
+		wcm.IfIndex = iface.Index
+	} else {
+		multicastIfMu.Lock()
+		defer multicastIfMu.Unlock()
+		if err := conn.SetMulticastInterface(iface); err != nil {
+			log.Printf("[WARN] mdns: Failed to set multicast interface: %s error: %v", iface.Name, err)
+		}
+	}
+	return writeWithDeadline(conn, deadline, func() error {
+		_, err := conn.WriteTo(buf, &wcm, ipv6Addr)
+		return err
+	})
+}
+
+// writeMulticastAll4 sends buf to the IPv4 mDNS group on each of ifaces and
+// returns the outcome per interface. On Linux the packets are handed to the
+// kernel in a single sendmmsg call, saving a system call per interface.
+func writeMulticastAll4(conn *ipv4.PacketConn, ifaces []net.Interface, buf []byte, deadline time.Time) []error {
+	errs := make([]error, len(ifaces))
+	if runtime.GOOS != "linux" {
+		for i := range ifaces {
+			errs[i] = writeMulticast4(conn, &ifaces[i], buf, deadline)
+		}
+		return errs
+	}
+	msgs := make([]ipv4.Message, len(ifaces))
+	for i := range ifaces {
+		cm := ipv4.ControlMessage{IfIndex: ifaces[i].Index}
+		msgs[i] = ipv4.Message{Buffers: [][]byte{buf}, OOB: cm.Marshal(), Addr: ipv4Addr}
+	}
+	writeWithDeadline(conn, deadline, func() error {
+		writeBatch(len(msgs), errs, func(from int) (int, error) {
+			return conn.WriteBatch(msgs[from:], 0)
+		})
+		return nil
+	})
+	return errs
+}
+
+// writeMulticastAll6 sends buf to the IPv6 mDNS group on each of ifaces, see
+// writeMulticastAll4.
+func writeMulticastAll6(conn *ipv6.PacketConn, ifaces []net.Interface, buf []byte, deadline time.Time) []error {
+	errs := make([]error, len(ifaces))
+	if runtime.GOOS != "linux" {
+		for i := range ifaces {
+			errs[i] = writeMulticast6(conn, &ifaces[i], buf, deadline)
+		}
+		return errs
+	}
+	msgs := make([]ipv6.Message, len(ifaces))
+	for i := range ifaces {
+		cm := ipv6.ControlMessage{IfIndex: ifaces[i].Index}
+		msgs[i] = ipv6.Message{Buffers: [][]byte{buf}, OOB: cm.Marshal(), Addr: ipv6Addr}
+	}
+	writeWithDeadline(conn, deadline, func() error {
+		writeBatch(len(msgs), errs, func(from int) (int, error) {
+			return conn.WriteBatch(msgs[from:], 0)
+		})
+		return nil
+	})
+	return errs
+}
+
+// writeBatch writes count messages with write, which writes the messages from
+// the given one on and returns how many were written. A message failing to be
+// written is skipped, its error recorded in errs, and the rest written again.
+func writeBatch(count int, errs []error, write func(from int) (int, error)) {
+	for sent := 0; sent < count; {
+		n, err := write(sent)
+		if n > 0 {
+			sent += n
+		}
+		if err != nil && sent < count {
+			errs[sent] = err
+			sent++
+		}
+	}
+}
+
+// interfaceByIndex returns the interface with the given index, or one carrying
+// the index only if it cannot be looked up.
+func interfaceByIndex(index int) *net.Interface {
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		return iface
+	}
+	return &net.Interface{Index: index}
+}
+
+// setHopLimit sets the IPv4 TTL and IPv6 hop limit of the packets sent on the
+// given connections, either of which may be nil. Failures are logged only.
+func setHopLimit(ipv4conn *ipv4.PacketConn, ipv6conn *ipv6.PacketConn, n int) {
+	if ipv4conn != nil {
+		if err := ipv4conn.SetMulticastTTL(n); err != nil {
+			log.Printf("[WARN] zeroconf: failed to set IPv4 multicast TTL: %v", err)
+		}
+		_ = ipv4conn.SetTTL(n)
+	}
+	if ipv6conn != nil {
+		if err := ipv6conn.SetMulticastHopLimit(n); err != nil {
+			log.Printf("[WARN] zeroconf: failed to set IPv6 multicast hop limit: %v", err)
+		}
+		_ = ipv6conn.SetHopLimit(n)
+	}
+}
+
+// setTrafficClass sets the IPv4 TOS and IPv6 traffic class of the packets sent
+// on the given connections, either of which may be nil. Failures are logged
+// only, as the packets are delivered regardless.
+func setTrafficClass(ipv4conn *ipv4.PacketConn, ipv6conn *ipv6.PacketConn, tc int) {
+	if ipv4conn != nil {
+		if err := ipv4conn.SetTOS(tc); err != nil {
+			log.Printf("[WARN] zeroconf: failed to set IPv4 TOS: %v", err)
+		}
+	}
+	if ipv6conn != nil {
+		if err := ipv6conn.SetTrafficClass(tc); err != nil {
+			log.Printf("[WARN] zeroconf: failed to set IPv6 traffic class: %v", err)
+		}
+	}
+}
+
+// packetInfo holds what the control messages tell about a received packet.
+type packetInfo struct {
+	ifIndex int    // Interface index, zero if unknown
+	ttl     int    // IP TTL or hop limit, -1 if unknown
+	dst     net.IP // Destination address, nil if unknown
+}
+
+// unicast reports whether the packet was addressed to one of our unicast
+// addresses rather than to the multicast group.
+func (i packetInfo) unicast() bool {
+	return i.dst != nil && !i.dst.IsMulticast()
+}
+
+// dstAddr returns the destination of the packet on the mDNS port, or nil if
+// unknown.
+func (i packetInfo) dstAddr() net.Addr {
+	if i.dst == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: i.dst, Port: ipv4Addr.Port}
+}
+
+// onLinkTTL is the IP TTL or hop limit all mDNS packets are sent with, which
+// packets from other links cannot arrive with (RFC6762 section 11).
+const onLinkTTL = 255
+
+// isOnLink reports whether a packet received with the given IP TTL or hop limit
+// may have originated on the local link. A negative ttl means unknown, e.g. on
+// systems without control messages, and is accepted.
+func isOnLink(ttl int) bool {
+	return ttl < 0 || ttl == onLinkTTL
+}
+
 // interfaceSupportsIPv4 checks if an interface supports IPv4
 func interfaceSupportsIPv4(iface *net.Interface) bool {
 	addrs, err := iface.Addrs()
@@ -206,7 +700,9 @@ func interfaceSupportsIPv6(iface *net.Interface) bool {
 	return false
 }
 
-func listMulticastInterfaces() []net.Interface {
+// listMulticastInterfaces returns the interfaces which are up and support
+// multicast, and for which filter, if not nil, returns true.
+func listMulticastInterfaces(filter func(net.Interface) bool) []net.Interface {
 	var interfaces []net.Interface
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -216,7 +712,7 @@ func listMulticastInterfaces() []net.Interface {
 		if (ifi.Flags & net.FlagUp) == 0 {
 			continue
 		}
-		if (ifi.Flags & net.FlagMulticast) > 0 {
+		if (ifi.Flags&net.FlagMulticast) > 0 && (filter == nil || filter(ifi)) {
 			interfaces = append(interfaces, ifi)
 		}
 	}
@@ -224,18 +720,194 @@ func listMulticastInterfaces() []net.Interface {
 	return interfaces
 }
 
+// loopbackInterfaces returns the loopback interfaces which are up. Multicast
+// sent on them is delivered to the sockets of the same host only, even where
+// the system does not flag them as multicast capable, as Linux does.
+func loopbackInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var interfaces []net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagLoopback != 0 {
+			interfaces = append(interfaces, ifi)
+		}
+	}
+	return interfaces
+}
+
+// loopbackMulticast6 reports whether IPv6 multicast can be sent on the given
+// loopback interfaces. Linux routes IPv6 multicast to its loopback interface
+// only if it is flagged as multicast capable, which it is not by default, so
+// the loopback mode uses IPv4 alone there.
+func loopbackMulticast6(ifaces []net.Interface) bool {
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagMulticast == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// virtualIfacePrefixes are the name prefixes of the interfaces commonly created
+// for containers, virtual machines and tunnels.
+var virtualIfacePrefixes = []string{
+	"docker", "veth", "br-", "virbr", "vnet", "vmnet", "vboxnet", "lxcbr", "lxdbr",
+	"cni", "flannel", "cali", "weave", "kube-", "podman", "tun", "tap", "utun",
+}
+
+// SkipVirtualInterfaces is a filter for WithInterfaceFilter and
+// WithServerInterfaceFilter which skips virtual interfaces, recognized by
+// their name, e.g. docker0, veth* and br-* of container runtimes, or tun and
+// tap devices. Joining the multicast groups on hundreds of container
+// interfaces slows startup and publishes addresses unreachable from the
+// network.
+func SkipVirtualInterfaces(iface net.Interface) bool {
+	name := strings.ToLower(iface.Name)
+	for _, prefix := range virtualIfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveIfaces returns the interfaces with the given names, followed by the
+// multicast interfaces having an address in one of the given networks.
+func resolveIfaces(names, cidrs []string) ([]net.Interface, error) {
+	var interfaces []net.Interface
+	seen := make(map[int]bool)
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %v", name, err)
+		}
+		if !seen[iface.Index] {
+			seen[iface.Index] = true
+			interfaces = append(interfaces, *iface)
+		}
+	}
+	if len(cidrs) == 0 {
+		return interfaces, nil
+	}
+
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", cidr, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	matched := false
+	for _, iface := range listMulticastInterfaces(nil) {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+	addrs:
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, n := range nets {
+				if n.Contains(ipnet.IP) {
+					matched = true
+					if !seen[iface.Index] {
+						seen[iface.Index] = true
+						interfaces = append(interfaces, iface)
+					}
+					break addrs
+				}
+			}
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("no multicast interface in %v", cidrs)
+	}
+	return interfaces, nil
+}
+
+// isBindError reports whether err is the failure to bind a socket, e.g. since
+// another daemon owns port 5353 without allowing it to be shared.
+func isBindError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "listen"
+}
+
+// isMsgTooBig reports whether err is the failure to send a packet larger than
+// the MTU of the interface (EMSGSIZE, WSAEMSGSIZE on Windows).
+func isMsgTooBig(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EMSGSIZE || errno == wsaEMSGSIZE
+}
+
+// wsaEMSGSIZE is the Windows socket error code of oversized datagrams.
+const wsaEMSGSIZE = syscall.Errno(10040)
+
+// newQueryConn4 opens an IPv4 UDP socket on an ephemeral port to send queries
+// from. Responders answer queries whose source port is not 5353 by unicast to
+// that port (RFC6762 section 6.7), so the replies are read from the same
+// socket. It joins no multicast group.
+func newQueryConn4(o connOpts) (*net.UDPConn, *ipv4.PacketConn, error) {
+	udpConn, err := listenUDP(o, "udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, nil, err
+	}
+	pkConn := ipv4.NewPacketConn(udpConn)
+	_ = pkConn.SetMulticastTTL(onLinkTTL)
+	_ = pkConn.SetTTL(onLinkTTL)
+	_ = pkConn.SetMulticastLoopback(true)
+	return udpConn, pkConn, nil
+}
+
+// newQueryConn6 opens an IPv6 UDP socket on an ephemeral port to send queries
+// from, see newQueryConn4.
+func newQueryConn6(o connOpts) (*net.UDPConn, *ipv6.PacketConn, error) {
+	udpConn, err := listenUDP(o, "udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		return nil, nil, err
+	}
+	pkConn := ipv6.NewPacketConn(udpConn)
+	_ = pkConn.SetMulticastHopLimit(onLinkTTL)
+	_ = pkConn.SetHopLimit(onLinkTTL)
+	_ = pkConn.SetMulticastLoopback(true)
+	return udpConn, pkConn, nil
+}
+
+// listenUDP opens a UDP socket bound to addr, and to the VRF device if one is
+// configured.
+func listenUDP(o connOpts, network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := &net.ListenConfig{Control: listenControl(o)}
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("expected *net.UDPConn, got %T", conn)
+	}
+	return udpConn, nil
+}
+
 // createUnicastListeners creates unicast UDP listeners on interface IPs
-func createUnicastListeners(interfaces []net.Interface, listenIPv4, listenIPv6 bool) ([]*net.UDPConn, []*net.UDPConn, error) {
+func createUnicastListeners(interfaces []net.Interface, listenIPv4, listenIPv6 bool, o connOpts) ([]*net.UDPConn, []*net.UDPConn, error) {
 	var ipv4Listeners []*net.UDPConn
 	var ipv6Listeners []*net.UDPConn
 
 	if len(interfaces) == 0 {
-		interfaces = listMulticastInterfaces()
+		interfaces = listMulticastInterfaces(nil)
 	}
 
 	// 使用 ListenConfig 来支持端口复用
 	lc := &net.ListenConfig{
-		Control: reusePortControl,
+		Control: listenControl(o),
 	}
 
 	for _, iface := range interfaces {
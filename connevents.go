@@ -0,0 +1,81 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// ConnEventType identifies a change of the sockets or multicast memberships of
+// a Server or Resolver.
+type ConnEventType int
+
+// Connection events delivered to the channel set with WithConnEvents or
+// WithServerConnEvents.
+const (
+	ConnGroupJoined    ConnEventType = iota // The multicast group was joined on an interface
+	ConnGroupLeft                           // The multicast group was left on an interface
+	ConnSocketError                         // Joining, reading or sending failed
+	ConnRebound                             // A socket was replaced after persistent read errors
+	ConnInterfaceAdded                      // An interface was taken into use at runtime
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnGroupJoined:
+		return "group joined"
+	case ConnGroupLeft:
+		return "group left"
+	case ConnSocketError:
+		return "socket error"
+	case ConnRebound:
+		return "rebound"
+	case ConnInterfaceAdded:
+		return "interface added"
+	}
+	return "unknown"
+}
+
+// ConnEvent describes a change of the sockets or multicast memberships.
+type ConnEvent struct {
+	Type      ConnEventType
+	Time      time.Time
+	Interface net.Interface // Interface concerned, zero for events of a whole socket
+	IPv6      bool          // Whether the IPv6 group or socket is concerned, false for send errors
+	Err       error         // Failure of a ConnSocketError event
+}
+
+// connEvents is the channel connection events are delivered to, nil if none.
+type connEvents chan<- ConnEvent
+
+// emit delivers e unless the channel is full, so a slow reader never stalls
+// the sockets.
+func (ch connEvents) emit(e ConnEvent) {
+	if ch == nil {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case ch <- e:
+	default:
+	}
+}
+
+// joined reports the outcome of joining the group of a family on iface.
+func (ch connEvents) joined(ipv6 bool, iface net.Interface, err error) {
+	if err != nil {
+		ch.emit(ConnEvent{Type: ConnSocketError, Interface: iface, IPv6: ipv6, Err: fmt.Errorf("failed to join multicast group on %s: %v", iface.Name, err)})
+		return
+	}
+	ch.emit(ConnEvent{Type: ConnGroupJoined, Interface: iface, IPv6: ipv6})
+}
+
+// failed reports a failed read or send on a socket of the given family, and
+// on iface if not nil.
+func (ch connEvents) failed(ipv6 bool, iface *net.Interface, err error) {
+	e := ConnEvent{Type: ConnSocketError, IPv6: ipv6, Err: err}
+	if iface != nil {
+		e.Interface = *iface
+	}
+	ch.emit(e)
+}
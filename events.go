@@ -0,0 +1,53 @@
+package zeroconf
+
+// ServerEventType identifies a step in the lifecycle of a registered service.
+type ServerEventType int
+
+// Lifecycle events reported to the handler set with WithEventHandler.
+const (
+	EventProbing          ServerEventType = iota // The names are being verified before use
+	EventAnnounced                               // The names were claimed and announced
+	EventConflictDetected                        // Another host uses one of our names
+	EventRenamed                                 // A name was changed to resolve a conflict
+	EventShuttingDown                            // The service is being withdrawn
+)
+
+func (t ServerEventType) String() string {
+	switch t {
+	case EventProbing:
+		return "probing"
+	case EventAnnounced:
+		return "announced"
+	case EventConflictDetected:
+		return "conflict detected"
+	case EventRenamed:
+		return "renamed"
+	case EventShuttingDown:
+		return "shutting down"
+	}
+	return "unknown"
+}
+
+// ServerEvent describes a lifecycle event of a registered service.
+type ServerEvent struct {
+	Type     ServerEventType
+	Instance string // Current service instance name
+	// Name the event is about: the conflicting name for EventConflictDetected,
+	// the new name for EventRenamed. OldName is the name it replaced.
+	Name    string
+	OldName string
+}
+
+// notify reports a lifecycle event to the event handler, if any. It must not be
+// called with s.mu held.
+func (s *Server) notify(e ServerEvent) {
+	if s.onEvent == nil {
+		return
+	}
+	s.mu.RLock()
+	if s.service != nil {
+		e.Instance = s.service.Instance
+	}
+	s.mu.RUnlock()
+	s.onEvent(e)
+}
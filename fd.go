@@ -0,0 +1,118 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Sockets created outside of Go, typically on Android where they are handed
+// over from Java through gomobile. Multicast reception requires the app to hold
+// a WifiManager.MulticastLock, and inside a VPN app the sockets must be passed
+// to VpnService.protect so they bypass the tunnel. The usual handoff is:
+//
+//	MulticastLock lock = wifiManager.createMulticastLock("mdns");
+//	lock.acquire();
+//	DatagramSocket socket = new DatagramSocket(null);
+//	socket.setReuseAddress(true);
+//	socket.bind(new InetSocketAddress(5353));
+//	vpnService.protect(socket); // VPN apps only
+//	int fd = ParcelFileDescriptor.fromDatagramSocket(socket).detachFd();
+//
+// and fd is passed to NewTransportFromFDs. Since gomobile cannot bind slices of
+// net.Interface, wrappers exported to Java usually pass nil for the interfaces.
+
+// PacketConnsFromFDs wraps UDP sockets bound to port 5353, given by file
+// descriptor, as mDNS multicast connections and joins the multicast groups on
+// the given interfaces, or on all multicast interfaces if none are given. A
+// negative descriptor leaves the connection of that family nil. The package
+// takes ownership of the descriptors, as Java code gives it up with
+// ParcelFileDescriptor.detachFd, and closes them once wrapped.
+func PacketConnsFromFDs(ipv4fd, ipv6fd int, ifaces []net.Interface) (*ipv4.PacketConn, *ipv6.PacketConn, error) {
+	if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces(nil)
+	}
+	var (
+		ipv4conn *ipv4.PacketConn
+		ipv6conn *ipv6.PacketConn
+	)
+	if ipv4fd >= 0 {
+		conn, err := filePacketConn(ipv4fd, "ipv4")
+		if err != nil {
+			return nil, nil, err
+		}
+		ipv4conn = ipv4.NewPacketConn(conn)
+		ipv4conn.SetControlMessage(ipv4.FlagInterface, true)
+		ipv4conn.SetControlMessage(ipv4.FlagDst, true)
+		ipv4conn.SetControlMessage(ipv4.FlagTTL, true)
+		_ = ipv4conn.SetMulticastTTL(onLinkTTL)
+		_ = ipv4conn.SetTTL(onLinkTTL)
+		for _, iface := range ifaces {
+			if interfaceSupportsIPv4(&iface) {
+				// The socket may have joined already.
+				_ = ipv4conn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4})
+			}
+		}
+	}
+	if ipv6fd >= 0 {
+		conn, err := filePacketConn(ipv6fd, "ipv6")
+		if err != nil {
+			if ipv4conn != nil {
+				ipv4conn.Close()
+			}
+			return nil, nil, err
+		}
+		ipv6conn = ipv6.NewPacketConn(conn)
+		ipv6conn.SetControlMessage(ipv6.FlagInterface, true)
+		ipv6conn.SetControlMessage(ipv6.FlagDst, true)
+		ipv6conn.SetControlMessage(ipv6.FlagHopLimit, true)
+		_ = ipv6conn.SetMulticastHopLimit(onLinkTTL)
+		_ = ipv6conn.SetHopLimit(onLinkTTL)
+		for _, iface := range ifaces {
+			if interfaceSupportsIPv6(&iface) {
+				_ = ipv6conn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6})
+			}
+		}
+	}
+	return ipv4conn, ipv6conn, nil
+}
+
+// NewTransportFromFDs creates a Transport from sockets created outside of Go,
+// see PacketConnsFromFDs. Pass it to WithServerTransport and WithTransport to
+// register and browse through these sockets. At least one descriptor must be
+// given.
+func NewTransportFromFDs(ipv4fd, ipv6fd int, ifaces []net.Interface) (*Transport, error) {
+	if ipv4fd < 0 && ipv6fd < 0 {
+		return nil, fmt.Errorf("no socket given")
+	}
+	if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces(nil)
+	}
+	ipv4conn, ipv6conn, err := PacketConnsFromFDs(ipv4fd, ipv6fd, ifaces)
+	if err != nil {
+		return nil, err
+	}
+	return newTransportConns(ipv4conn, ipv6conn, ifaces, nil), nil
+}
+
+// filePacketConn returns the UDP connection of a socket given by descriptor.
+func filePacketConn(fd int, family string) (net.PacketConn, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("mdns-%s", family))
+	if f == nil {
+		return nil, fmt.Errorf("invalid %s socket descriptor %d", family, fd)
+	}
+	// FilePacketConn duplicates the descriptor.
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s socket descriptor %d: %v", family, fd, err)
+	}
+	if _, ok := conn.(*net.UDPConn); !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%s socket descriptor %d is not a UDP socket", family, fd)
+	}
+	return conn, nil
+}
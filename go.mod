@@ -9,11 +9,11 @@ require (
 	github.com/miekg/dns v1.1.66
 	github.com/pkg/errors v0.9.1
 	golang.org/x/net v0.41.0
+	golang.org/x/sys v0.33.0
 )
 
 require (
 	golang.org/x/mod v0.25.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
 )
@@ -0,0 +1,115 @@
+package zeroconf
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// groupHealth watches whether packets of other hosts keep arriving on each
+// interface. Some Wi-Fi drivers and access points silently drop IGMP and MLD
+// memberships, after which the host stops receiving multicast while sending
+// still works. The health task periodically sends the group joins again, which
+// repairs such memberships without reopening the sockets, and warns about
+// interfaces that stay silent.
+type groupHealth struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// When a packet of another host last arrived, by interface index. Index 0
+	// holds packets whose interface the system does not report.
+	last map[int]time.Time
+	// Addresses of this host, whose packets looped back are ignored
+	local map[string]struct{}
+	// Interfaces reported as silent, until a packet arrives on them
+	warned map[int]bool
+}
+
+func newGroupHealth(interval time.Duration) *groupHealth {
+	h := &groupHealth{
+		interval: interval,
+		last:     make(map[int]time.Time),
+		warned:   make(map[int]bool),
+	}
+	h.refreshLocal()
+	return h
+}
+
+// refreshLocal reloads the addresses of this host.
+func (h *groupHealth) refreshLocal() {
+	local := make(map[string]struct{})
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				local[ipnet.IP.String()] = struct{}{}
+			}
+		}
+	}
+	h.mu.Lock()
+	h.local = local
+	h.mu.Unlock()
+}
+
+// seen records a packet received from src on the interface with the given
+// index. Our own packets are looped back regardless of the membership, so they
+// are not counted.
+func (h *groupHealth) seen(ifIndex int, src net.Addr) {
+	udpAddr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.local[udpAddr.IP.String()]; ok {
+		return
+	}
+	h.last[ifIndex] = time.Now()
+	delete(h.warned, ifIndex)
+}
+
+// silent returns the interfaces on which no packet of another host arrived
+// since the given time and which were not reported yet.
+func (h *groupHealth) silent(ifaces []net.Interface, since time.Time) []net.Interface {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last[0].After(since) {
+		// Without interface information any packet proves reception.
+		return nil
+	}
+	var silent []net.Interface
+	for _, iface := range ifaces {
+		if h.last[iface.Index].After(since) || h.warned[iface.Index] {
+			continue
+		}
+		h.warned[iface.Index] = true
+		silent = append(silent, iface)
+	}
+	return silent
+}
+
+// run sends the group joins again on every interface at each interval until
+// done is closed, and warns about interfaces silent for the whole interval.
+func (h *groupHealth) run(done <-chan struct{}, ifaces func() []net.Interface, rejoin func(iface *net.Interface) error) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	since := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			list := ifaces()
+			for _, iface := range h.silent(list, since) {
+				log.Printf("[WARN] zeroconf: no mDNS packet from other hosts on %s for %v, multicast membership may have been dropped", iface.Name, h.interval)
+			}
+			for i := range list {
+				if err := rejoin(&list[i]); err != nil {
+					log.Printf("[WARN] zeroconf: failed to rejoin multicast groups on %s: %v", list[i].Name, err)
+				}
+			}
+			h.refreshLocal()
+			since = now
+		}
+	}
+}
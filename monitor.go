@@ -0,0 +1,348 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Default interval at which the interface monitor polls link states
+	defaultMonitorInterval = 5 * time.Second
+	// Minimum time between two re-probes triggered by the interface monitor
+	reprobeMinInterval = 10 * time.Second
+)
+
+// monitorInterfaces polls the link state of the server's interfaces. When an
+// interface regains connectivity, another host may have claimed our names
+// during the partition, so the unique records are probed again before they are
+// announced and answered for. Re-probes are rate limited to one per
+// reprobeMinInterval; restorations within that period are coalesced.
+//
+// If the server was registered without an explicit list of interfaces, it also
+// joins the multicast groups on interfaces that come up later, e.g. VPNs or
+// docking stations, and probes and announces its records there. Servers of a
+// Responder leave the memberships to the monitor of the responder, which
+// hands them the new interfaces.
+//
+// Address changes on the interfaces, e.g. after a DHCP renewal or an IPv6
+// privacy address rotation, are published right away: goodbyes are sent for
+// the stale address records and the new ones are announced with the cache-flush
+// bit set.
+func (s *Server) monitorInterfaces() {
+	if s.monitorInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.monitorInterval)
+	defer ticker.Stop()
+
+	up := linkStates(s.interfaces())
+	var (
+		pending     bool
+		lastReprobe time.Time
+	)
+	for {
+		select {
+		case <-s.shouldShutdown:
+			return
+		case <-ticker.C:
+		}
+
+		if s.responder == nil && s.addInterfaces() {
+			pending = true
+		}
+		s.refreshAddrs()
+		current := linkStates(s.interfaces())
+		for index, isUp := range current {
+			if isUp && !up[index] {
+				// Memberships may be lost while the link was down.
+				if iface, err := net.InterfaceByIndex(index); err == nil && s.responder == nil {
+					s.rejoinGroups(iface)
+				}
+				pending = true
+			}
+		}
+		up = current
+
+		if pending && time.Since(lastReprobe) >= reprobeMinInterval && s.state.load() == stateRunning {
+			pending = false
+			lastReprobe = time.Now()
+			go s.probe()
+		}
+	}
+}
+
+// interfaces returns the interfaces the server is currently using.
+func (s *Server) interfaces() []net.Interface {
+	s.ifacesMu.Lock()
+	defer s.ifacesMu.Unlock()
+	return s.ifaces
+}
+
+// addInterfaces starts using the multicast interfaces that appeared since the
+// server was registered, unless it was given an explicit list, and reports
+// whether any was added. Their addresses are picked up by refreshAddrs.
+func (s *Server) addInterfaces() bool {
+	s.ifacesMu.Lock()
+	auto := s.autoIfaces
+	s.ifacesMu.Unlock()
+	if !auto {
+		return false
+	}
+	known := make(map[int]bool)
+	for _, iface := range s.interfaces() {
+		known[iface.Index] = true
+	}
+	var added []net.Interface
+	for _, iface := range listMulticastInterfaces(s.ifaceFilter) {
+		if known[iface.Index] || !s.joinGroups(&iface) {
+			continue
+		}
+		log.Printf("[INFO] zeroconf: using new interface %s", iface.Name)
+		s.connEvents.emit(ConnEvent{Type: ConnInterfaceAdded, Interface: iface})
+		added = append(added, iface)
+	}
+	if len(added) == 0 {
+		return false
+	}
+
+	s.ifacesMu.Lock()
+	ifaces := make([]net.Interface, 0, len(s.ifaces)+len(added))
+	s.ifaces = append(append(ifaces, s.ifaces...), added...)
+	s.ifacesMu.Unlock()
+	return true
+}
+
+// adoptInterface starts using an interface the monitor of the responder took
+// into use, unless the server was given an explicit list of interfaces or
+// uses the interface already.
+func (s *Server) adoptInterface(iface net.Interface) {
+	s.ifacesMu.Lock()
+	auto := s.autoIfaces
+	s.ifacesMu.Unlock()
+	if !auto || s.servesInterface(iface.Index) || !s.joinGroups(&iface) {
+		return
+	}
+	s.ifacesMu.Lock()
+	ifaces := make([]net.Interface, 0, len(s.ifaces)+1)
+	s.ifaces = append(append(ifaces, s.ifaces...), iface)
+	s.ifacesMu.Unlock()
+	log.Printf("[INFO] zeroconf: using new interface %s", iface.Name)
+	s.connEvents.emit(ConnEvent{Type: ConnInterfaceAdded, Interface: iface})
+
+	s.refreshAddrs()
+	if s.state.load() == stateRunning {
+		go s.probe()
+	}
+}
+
+// AddInterface starts using iface while the server is running: the multicast
+// groups are joined on it, its addresses are published and the unique records
+// are probed and announced again. Interfaces appearing later are no longer
+// picked up by the interface monitor, the caller drives membership from then
+// on. Adding an interface in use already does nothing. On a shared transport
+// the groups are joined only if no other user joined them already.
+func (s *Server) AddInterface(iface net.Interface) error {
+	if s.native != nil {
+		return errNativeBackend
+	}
+	s.ifacesMu.Lock()
+	s.autoIfaces = false
+	s.ifacesMu.Unlock()
+	if s.servesInterface(iface.Index) {
+		return nil
+	}
+	if !s.joinGroups(&iface) {
+		return fmt.Errorf("failed to join multicast groups on %s", iface.Name)
+	}
+
+	s.ifacesMu.Lock()
+	ifaces := make([]net.Interface, 0, len(s.ifaces)+1)
+	s.ifaces = append(append(ifaces, s.ifaces...), iface)
+	s.ifacesMu.Unlock()
+	log.Printf("[INFO] zeroconf: using interface %s", iface.Name)
+	s.connEvents.emit(ConnEvent{Type: ConnInterfaceAdded, Interface: iface})
+
+	s.refreshAddrs()
+	if s.state.load() == stateRunning {
+		go s.probe()
+	}
+	return nil
+}
+
+// RemoveInterface stops using iface: goodbye packets are sent for the records
+// on it, the multicast groups are left and its addresses are withdrawn. On a
+// shared transport the groups stay joined while other users hold them. As with
+// AddInterface, the interface monitor no longer adds interfaces.
+func (s *Server) RemoveInterface(iface net.Interface) error {
+	if s.native != nil {
+		return errNativeBackend
+	}
+	s.ifacesMu.Lock()
+	s.autoIfaces = false
+	s.ifacesMu.Unlock()
+	if !s.servesInterface(iface.Index) {
+		return fmt.Errorf("interface %s is not in use", iface.Name)
+	}
+
+	var err error
+	if state := s.state.load(); state == stateRunning || state == stateAnnouncing {
+		err = s.goodbye(iface.Index, s.sharedRecords())
+	}
+	s.leaveGroups(&iface)
+
+	s.ifacesMu.Lock()
+	s.ifaces = withoutInterface(s.ifaces, iface.Index)
+	s.ifacesMu.Unlock()
+	log.Printf("[INFO] zeroconf: no longer using interface %s", iface.Name)
+
+	s.refreshAddrs()
+	return err
+}
+
+// refreshAddrs updates the published addresses to the ones currently assigned
+// to the interfaces, withdrawing stale address records and announcing the new
+// ones. Proxy registrations publish fixed addresses and are left alone.
+func (s *Server) refreshAddrs() {
+	if len(s.proxyHosts) > 0 {
+		return
+	}
+	var v4, v6 []net.IP
+	for _, iface := range s.interfaces() {
+		a4, a6 := addrsForInterface(&iface, s.temporaryAddrs, s.linkLocalOnly)
+		if s.ipTraffic&IPv4 > 0 {
+			v4 = append(v4, filterIPs(a4, s.allowedAddrs)...)
+		}
+		if s.ipTraffic&IPv6 > 0 {
+			v6 = append(v6, filterIPs(a6, s.allowedAddrs)...)
+		}
+	}
+
+	s.mu.Lock()
+	stale := append(missingIPs(s.service.AddrIPv4, v4), missingIPs(s.service.AddrIPv6, v6)...)
+	changed := len(stale) > 0 || len(missingIPs(v4, s.service.AddrIPv4)) > 0 || len(missingIPs(v6, s.service.AddrIPv6)) > 0
+	if changed {
+		s.service.AddrIPv4 = v4
+		s.service.AddrIPv6 = v6
+	}
+	hostName := s.service.HostName
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	log.Printf("[INFO] zeroconf: addresses of %s changed to %v %v", hostName, v4, v6)
+
+	if state := s.state.load(); state != stateRunning && state != stateAnnouncing {
+		// Probing announces the current addresses anyway.
+		return
+	}
+	if len(stale) > 0 {
+		// Goodbyes are sent per interface, which may publish the addresses
+		// under its own host name.
+		for _, intf := range s.interfaces() {
+			s.mu.RLock()
+			host := s.hostName(intf.Index)
+			s.mu.RUnlock()
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			for _, ip := range stale {
+				hdr := dns.RR_Header{Name: host, Class: dns.ClassINET, Ttl: 0}
+				if ip.To4() != nil {
+					hdr.Rrtype = dns.TypeA
+					resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+				} else {
+					hdr.Rrtype = dns.TypeAAAA
+					resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+				}
+			}
+			s.stats.goodbyesSent.Add(1)
+			if err := s.multicastResponse(resp, intf.Index); err != nil {
+				log.Println("[ERR] zeroconf: failed to send goodbye:", err.Error())
+			}
+		}
+	}
+	go s.reannounce(s.addrRecords)
+}
+
+// missingIPs returns the addresses of a which are not in b.
+func missingIPs(a, b []net.IP) []net.IP {
+	var missing []net.IP
+	for _, ip := range a {
+		found := false
+		for _, other := range b {
+			if ip.Equal(other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, ip)
+		}
+	}
+	return missing
+}
+
+// servesInterface reports whether the server uses the interface with the given
+// index.
+func (s *Server) servesInterface(index int) bool {
+	for _, iface := range s.interfaces() {
+		if iface.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceFor returns the index of the server's interface on whose subnet
+// addr is, or 0 if none.
+func (s *Server) interfaceFor(addr net.Addr) int {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+	for _, iface := range s.interfaces() {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.Contains(udpAddr.IP) {
+				return iface.Index
+			}
+		}
+	}
+	return 0
+}
+
+// joinGroups takes a hold on the mDNS multicast groups on iface, joining them
+// on the sockets unless another user of the transport did already, and
+// reports whether any is joined.
+func (s *Server) joinGroups(iface *net.Interface) bool {
+	return s.transport.join(iface, s.connEvents)
+}
+
+// leaveGroups releases the hold on the mDNS multicast groups on iface. They are
+// left once no other user of the transport holds them.
+func (s *Server) leaveGroups(iface *net.Interface) {
+	s.transport.leave(iface, s.connEvents)
+}
+
+// rejoinGroups leaves and joins again the mDNS multicast groups on iface, so
+// that a fresh membership report is sent.
+func (s *Server) rejoinGroups(iface *net.Interface) error {
+	if !interfaceSupportsIPv4(iface) && !interfaceSupportsIPv6(iface) {
+		return nil
+	}
+	return s.transport.rejoin(iface, s.connEvents)
+}
+
+// linkStates reports for each of ifaces, by index, whether it is up and has a
+// carrier.
+func linkStates(ifaces []net.Interface) map[int]bool {
+	states := make(map[int]bool, len(ifaces))
+	for _, iface := range ifaces {
+		ifi, err := net.InterfaceByIndex(iface.Index)
+		states[iface.Index] = err == nil && ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagRunning != 0
+	}
+	return states
+}
@@ -0,0 +1,67 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+)
+
+// errNativeBackend is returned by the features relying on our own sockets when
+// the service is registered through the DNS-SD API of the system.
+var errNativeBackend = fmt.Errorf("not supported by the native backend")
+
+// registerNative registers entry through the DNS-SD API of the system. The
+// returned server only supports the features the API offers.
+func registerNative(entry *ServiceEntry, conf serverOpts) (*Server, error) {
+	n, err := newNativeService()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		service:        entry,
+		ttl:            defaultTTL,
+		hostTTL:        hostRecordTTL,
+		shouldShutdown: make(chan struct{}),
+		nameStore:      conf.nameStore,
+		onRename:       conf.onRename,
+		onError:        conf.onError,
+		onEvent:        conf.onEvent,
+		native:         n,
+	}
+	s.loadNames()
+	s.state.store(stateProbing)
+	s.notify(ServerEvent{Type: EventProbing})
+	if err := s.nativeRegister(); err != nil {
+		return nil, err
+	}
+	s.state.store(stateRunning)
+	s.notify(ServerEvent{Type: EventAnnounced})
+	return s, nil
+}
+
+// nativeRegister registers the current state of the service with the system,
+// replacing the previous registration. The system resolves name conflicts
+// itself; renames are reported like ours.
+func (s *Server) nativeRegister() error {
+	s.mu.RLock()
+	entry := s.service.clone()
+	s.mu.RUnlock()
+
+	instance, err := s.native.register(entry)
+	if err != nil {
+		return err
+	}
+	if instance == "" || instance == entry.Instance {
+		return nil
+	}
+	log.Printf("[WARN] zeroconf: name conflict for %s, renamed to %s by the system", entry.Instance, instance)
+	s.mu.Lock()
+	s.service.setInstance(instance)
+	s.conflicts++
+	s.mu.Unlock()
+	s.saveNames()
+	if s.onRename != nil {
+		s.onRename(entry.Instance, instance)
+	}
+	s.notify(ServerEvent{Type: EventRenamed, Name: instance, OldName: entry.Instance})
+	return nil
+}
@@ -0,0 +1,223 @@
+//go:build darwin && cgo
+
+package zeroconf
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <dns_sd.h>
+
+DNSServiceErrorType zeroconfRegister(DNSServiceRef *ref, const char *name, const char *regtype, const char *domain, uint16_t port, uint16_t txtLen, const void *txt, uintptr_t context);
+*/
+import "C"
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Time mDNSResponder may take to reply to a registration
+	nativeRegisterTimeout = 10 * time.Second
+	// Interval at which the goroutine servicing a registration checks
+	// whether it was withdrawn
+	nativePollInterval = 250 * time.Millisecond
+)
+
+// nativeResult is the reply to a registration.
+type nativeResult struct {
+	err  C.DNSServiceErrorType
+	name string
+}
+
+var (
+	// Replies by the context passed to DNSServiceRegister
+	nativeMu          sync.Mutex
+	nativeResults     = make(map[uintptr]*nativeResult)
+	nativeNextContext uintptr
+)
+
+// nativeService is a registration with mDNSResponder through the dns_sd API.
+// Its socket is serviced until the registration is withdrawn, so later
+// replies, e.g. after a conflict, do not fill it up.
+type nativeService struct {
+	mu      sync.Mutex
+	ref     C.DNSServiceRef
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newNativeService() (*nativeService, error) {
+	return &nativeService{}, nil
+}
+
+// register registers entry, replacing the previous registration, and returns
+// the instance name mDNSResponder finally registered.
+func (n *nativeService) register(entry *ServiceEntry) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deregister()
+
+	name := C.CString(entry.Instance)
+	defer C.free(unsafe.Pointer(name))
+	regtype := C.CString(nativeRegType(entry))
+	defer C.free(unsafe.Pointer(regtype))
+	domain := C.CString(entry.Domain)
+	defer C.free(unsafe.Pointer(domain))
+	var txt unsafe.Pointer
+	data := nativeTXT(entry.Text)
+	if len(data) > 0 {
+		txt = C.CBytes(data)
+		defer C.free(txt)
+	}
+
+	nativeMu.Lock()
+	nativeNextContext++
+	ctx := nativeNextContext
+	nativeMu.Unlock()
+	defer func() {
+		nativeMu.Lock()
+		delete(nativeResults, ctx)
+		nativeMu.Unlock()
+	}()
+
+	var ref C.DNSServiceRef
+	if e := C.zeroconfRegister(&ref, name, regtype, domain, C.uint16_t(entry.Port), C.uint16_t(len(data)), txt, C.uintptr_t(ctx)); e != 0 {
+		return "", fmt.Errorf("DNSServiceRegister failed: error %d", int(e))
+	}
+	// The first reply tells whether the names could be claimed and which
+	// instance name was finally used. Processing blocks, so it waits for
+	// the socket to be readable first.
+	fd := int(C.DNSServiceRefSockFD(ref))
+	if ready, err := nativeWaitReadable(fd, nativeRegisterTimeout); !ready {
+		C.DNSServiceRefDeallocate(ref)
+		if err == nil {
+			err = fmt.Errorf("no reply within %v", nativeRegisterTimeout)
+		}
+		return "", fmt.Errorf("DNSServiceRegister failed: %v", err)
+	}
+	if e := C.DNSServiceProcessResult(ref); e != 0 {
+		C.DNSServiceRefDeallocate(ref)
+		return "", fmt.Errorf("DNSServiceProcessResult failed: error %d", int(e))
+	}
+	nativeMu.Lock()
+	res := nativeResults[ctx]
+	nativeMu.Unlock()
+	if res == nil || res.err != 0 {
+		C.DNSServiceRefDeallocate(ref)
+		if res == nil {
+			return "", fmt.Errorf("DNSServiceRegister failed: no reply")
+		}
+		return "", fmt.Errorf("DNSServiceRegister failed: error %d", int(res.err))
+	}
+	n.ref = ref
+	n.done = make(chan struct{})
+	n.stopped.Add(1)
+	go n.serve(ref, fd, ctx, n.done)
+	return res.name, nil
+}
+
+// serve processes the replies arriving for a registration until done is
+// closed.
+func (n *nativeService) serve(ref C.DNSServiceRef, fd int, ctx uintptr, done chan struct{}) {
+	defer n.stopped.Done()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		ready, err := nativeWaitReadable(fd, nativePollInterval)
+		if err != nil {
+			log.Printf("[WARN] zeroconf: failed to wait for mDNSResponder: %v", err)
+			return
+		}
+		if !ready {
+			continue
+		}
+		if e := C.DNSServiceProcessResult(ref); e != 0 {
+			log.Printf("[WARN] zeroconf: DNSServiceProcessResult failed: error %d", int(e))
+			return
+		}
+		nativeMu.Lock()
+		delete(nativeResults, ctx)
+		nativeMu.Unlock()
+	}
+}
+
+// nativeWaitReadable waits up to timeout for fd to become readable and
+// reports whether it did.
+func nativeWaitReadable(fd int, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := int(time.Until(deadline) / time.Millisecond)
+		if wait <= 0 {
+			return false, nil
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, wait)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return false, err
+		}
+		return n > 0, nil
+	}
+}
+
+// close withdraws the registration.
+func (n *nativeService) close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deregister()
+	return nil
+}
+
+// deregister withdraws the current registration, if any. n.mu must be held.
+// The reference is deallocated only once the goroutine servicing it stopped.
+func (n *nativeService) deregister() {
+	if n.ref != nil {
+		close(n.done)
+		n.stopped.Wait()
+		C.DNSServiceRefDeallocate(n.ref)
+		n.ref = nil
+	}
+}
+
+//export zeroconfRegistered
+func zeroconfRegistered(err C.DNSServiceErrorType, name *C.char, ctx C.uintptr_t) {
+	res := &nativeResult{err: err}
+	if name != nil {
+		res.name = C.GoString(name)
+	}
+	nativeMu.Lock()
+	nativeResults[uintptr(ctx)] = res
+	nativeMu.Unlock()
+}
+
+// nativeRegType returns the service type with its subtypes in the form
+// expected by DNSServiceRegister, e.g. "_http._tcp,_printer".
+func nativeRegType(entry *ServiceEntry) string {
+	regtype := entry.Service
+	for _, subtype := range entry.Subtypes {
+		regtype += "," + strings.SplitN(subtype, "._sub.", 2)[0]
+	}
+	return regtype
+}
+
+// nativeTXT returns the TXT record data in wire format.
+func nativeTXT(text []string) []byte {
+	var data []byte
+	for _, t := range text {
+		data = append(data, byte(len(t)))
+		data = append(data, t...)
+	}
+	return data
+}
@@ -0,0 +1,21 @@
+//go:build darwin && cgo
+
+package zeroconf
+
+/*
+#include <stdint.h>
+#include <arpa/inet.h>
+#include <dns_sd.h>
+#include "_cgo_export.h"
+
+static void zeroconfRegisterReply(DNSServiceRef ref, DNSServiceFlags flags, DNSServiceErrorType err, const char *name, const char *regtype, const char *domain, void *context) {
+	zeroconfRegistered(err, (char *)name, (uintptr_t)context);
+}
+
+// The host name is left to mDNSResponder, which publishes the addresses of the
+// system under its own host name.
+DNSServiceErrorType zeroconfRegister(DNSServiceRef *ref, const char *name, const char *regtype, const char *domain, uint16_t port, uint16_t txtLen, const void *txt, uintptr_t context) {
+	return DNSServiceRegister(ref, 0, 0, name, regtype, domain, NULL, htons(port), txtLen, txt, zeroconfRegisterReply, (void *)context);
+}
+*/
+import "C"
@@ -0,0 +1,21 @@
+//go:build !windows && !(darwin && cgo)
+
+package zeroconf
+
+import "fmt"
+
+// nativeService is a registration with the DNS-SD API of the system, which is
+// only used on Windows and macOS.
+type nativeService struct{}
+
+func newNativeService() (*nativeService, error) {
+	return nil, fmt.Errorf("native DNS-SD backend is only available on Windows and macOS with cgo")
+}
+
+func (n *nativeService) register(entry *ServiceEntry) (string, error) {
+	return "", errNativeBackend
+}
+
+func (n *nativeService) close() error {
+	return nil
+}
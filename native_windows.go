@@ -0,0 +1,270 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// DNS-SD API of Windows 10 and later
+var (
+	dnsapi                          = syscall.NewLazyDLL("dnsapi.dll")
+	procDnsServiceConstructInstance = dnsapi.NewProc("DnsServiceConstructInstance")
+	procDnsServiceFreeInstance      = dnsapi.NewProc("DnsServiceFreeInstance")
+	procDnsServiceRegister          = dnsapi.NewProc("DnsServiceRegister")
+	procDnsServiceDeRegister        = dnsapi.NewProc("DnsServiceDeRegister")
+)
+
+const (
+	dnsQueryRequestVersion1 = 1
+	dnsRequestPending       = 9506
+	// Time to wait for the system to complete a registration, which includes
+	// probing the names
+	nativeRegisterTimeout = 10 * time.Second
+)
+
+// dnsServiceInstance mirrors DNS_SERVICE_INSTANCE.
+type dnsServiceInstance struct {
+	instanceName   *uint16
+	hostName       *uint16
+	ip4Address     *uint32
+	ip6Address     *[16]byte
+	port           uint16
+	priority       uint16
+	weight         uint16
+	propertyCount  uint32
+	keys           **uint16
+	values         **uint16
+	interfaceIndex uint32
+}
+
+// dnsServiceRegisterRequest mirrors DNS_SERVICE_REGISTER_REQUEST.
+type dnsServiceRegisterRequest struct {
+	version         uint32
+	interfaceIndex  uint32
+	serviceInstance uintptr // *dnsServiceInstance allocated by the system
+	callback        uintptr
+	queryContext    uintptr
+	credentials     uintptr
+	unicastEnabled  int32
+}
+
+// nativeCompletion is the result of an asynchronous registration call.
+type nativeCompletion struct {
+	status   uintptr
+	instance string
+}
+
+var (
+	// Completion callback shared by all registrations, since Windows limits
+	// the number of callbacks a process may create. The query context
+	// identifies the waiting registration.
+	nativeCallbackOnce sync.Once
+	nativeCallback     uintptr
+	nativeMu           sync.Mutex
+	nativeWaiters      = make(map[uintptr]chan nativeCompletion)
+	nativeNextContext  uintptr
+)
+
+// nativeService is a registration with DnsServiceRegister.
+type nativeService struct {
+	mu       sync.Mutex
+	instance uintptr // *dnsServiceInstance allocated by the system
+	request  *dnsServiceRegisterRequest
+}
+
+func newNativeService() (*nativeService, error) {
+	if err := procDnsServiceRegister.Find(); err != nil {
+		return nil, fmt.Errorf("native DNS-SD API unavailable: %v", err)
+	}
+	nativeCallbackOnce.Do(func() {
+		nativeCallback = syscall.NewCallback(func(status, ctx uintptr, instance *dnsServiceInstance) uintptr {
+			var name string
+			if instance != nil {
+				name = utf16PtrToString(instance.instanceName)
+				procDnsServiceFreeInstance.Call(uintptr(unsafe.Pointer(instance)))
+			}
+			nativeMu.Lock()
+			ch := nativeWaiters[ctx]
+			delete(nativeWaiters, ctx)
+			nativeMu.Unlock()
+			if ch != nil {
+				ch <- nativeCompletion{status: status, instance: name}
+			}
+			return 0
+		})
+	})
+	return &nativeService{}, nil
+}
+
+// register registers entry, replacing the previous registration, and returns
+// the instance name the system finally registered.
+func (n *nativeService) register(entry *ServiceEntry) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.deregister(); err != nil {
+		return "", err
+	}
+
+	inst, err := constructInstance(entry)
+	if err != nil {
+		return "", err
+	}
+	req := &dnsServiceRegisterRequest{
+		version:         dnsQueryRequestVersion1,
+		serviceInstance: inst,
+		callback:        nativeCallback,
+	}
+	done := nativeWait(req)
+	r, _, _ := procDnsServiceRegister.Call(uintptr(unsafe.Pointer(req)), 0)
+	if r != dnsRequestPending {
+		nativeCancel(req)
+		procDnsServiceFreeInstance.Call(inst)
+		return "", fmt.Errorf("DnsServiceRegister failed: %v", syscall.Errno(r))
+	}
+	select {
+	case c := <-done:
+		if c.status != 0 {
+			procDnsServiceFreeInstance.Call(inst)
+			return "", fmt.Errorf("DnsServiceRegister failed: %v", syscall.Errno(c.status))
+		}
+		n.instance, n.request = inst, req
+		return strings.SplitN(c.instance, "._", 2)[0], nil
+	case <-time.After(nativeRegisterTimeout):
+		// The request may still complete; withdraw it and free the instance
+		// rather than leaving a registration nobody owns.
+		nativeCancel(req)
+		n.instance, n.request = inst, req
+		if err := n.deregister(); err != nil {
+			log.Printf("[WARN] zeroconf: failed to withdraw timed out registration: %v", err)
+			procDnsServiceFreeInstance.Call(inst)
+			n.instance, n.request = 0, nil
+		}
+		return "", fmt.Errorf("DnsServiceRegister timed out")
+	}
+}
+
+// close withdraws the registration.
+func (n *nativeService) close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deregister()
+}
+
+// deregister withdraws the current registration, if any. n.mu must be held.
+func (n *nativeService) deregister() error {
+	if n.request == nil {
+		return nil
+	}
+	req := n.request
+	done := nativeWait(req)
+	r, _, _ := procDnsServiceDeRegister.Call(uintptr(unsafe.Pointer(req)), 0)
+	if r != dnsRequestPending {
+		nativeCancel(req)
+		return fmt.Errorf("DnsServiceDeRegister failed: %v", syscall.Errno(r))
+	}
+	select {
+	case <-done:
+	case <-time.After(nativeRegisterTimeout):
+	}
+	procDnsServiceFreeInstance.Call(n.instance)
+	n.instance, n.request = 0, nil
+	return nil
+}
+
+// nativeWait assigns a query context to req and returns the channel receiving
+// its completion.
+func nativeWait(req *dnsServiceRegisterRequest) chan nativeCompletion {
+	ch := make(chan nativeCompletion, 1)
+	nativeMu.Lock()
+	nativeNextContext++
+	req.queryContext = nativeNextContext
+	nativeWaiters[req.queryContext] = ch
+	nativeMu.Unlock()
+	return ch
+}
+
+// nativeCancel forgets the completion of a call that failed synchronously.
+func nativeCancel(req *dnsServiceRegisterRequest) {
+	nativeMu.Lock()
+	delete(nativeWaiters, req.queryContext)
+	nativeMu.Unlock()
+}
+
+// constructInstance builds the DNS_SERVICE_INSTANCE of entry with
+// DnsServiceConstructInstance. It must be freed with DnsServiceFreeInstance.
+func constructInstance(entry *ServiceEntry) (uintptr, error) {
+	name, err := syscall.UTF16PtrFromString(fmt.Sprintf("%s.%s", entry.Instance, trimDot(entry.ServiceName())))
+	if err != nil {
+		return 0, err
+	}
+	host, err := syscall.UTF16PtrFromString(trimDot(entry.HostName))
+	if err != nil {
+		return 0, err
+	}
+	var ip4, ip6 unsafe.Pointer
+	if len(entry.AddrIPv4) > 0 {
+		var a [4]byte
+		copy(a[:], entry.AddrIPv4[0].To4())
+		ip4 = unsafe.Pointer(&a)
+	}
+	if len(entry.AddrIPv6) > 0 {
+		var a [16]byte
+		copy(a[:], entry.AddrIPv6[0].To16())
+		ip6 = unsafe.Pointer(&a)
+	}
+
+	var keys, values []*uint16
+	for _, t := range entry.Text {
+		k, v, _ := strings.Cut(t, "=")
+		pk, err := syscall.UTF16PtrFromString(k)
+		if err != nil {
+			return 0, err
+		}
+		pv, err := syscall.UTF16PtrFromString(v)
+		if err != nil {
+			return 0, err
+		}
+		keys, values = append(keys, pk), append(values, pv)
+	}
+	var pkeys, pvalues unsafe.Pointer
+	if len(keys) > 0 {
+		pkeys, pvalues = unsafe.Pointer(&keys[0]), unsafe.Pointer(&values[0])
+	}
+
+	r, _, _ := procDnsServiceConstructInstance.Call(
+		uintptr(unsafe.Pointer(name)),
+		uintptr(unsafe.Pointer(host)),
+		uintptr(ip4),
+		uintptr(ip6),
+		uintptr(entry.Port),
+		0,
+		0,
+		uintptr(len(keys)),
+		uintptr(pkeys),
+		uintptr(pvalues),
+	)
+	runtime.KeepAlive(keys)
+	runtime.KeepAlive(values)
+	if r == 0 {
+		return 0, fmt.Errorf("DnsServiceConstructInstance failed")
+	}
+	return r, nil
+}
+
+// utf16PtrToString converts a NUL-terminated UTF-16 string.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	var s []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Add(ptr, 2) {
+		s = append(s, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(s)
+}
@@ -0,0 +1,188 @@
+package zeroconf
+
+import (
+	"context"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RRSection identifies the message section a record was found in.
+type RRSection uint8
+
+// Message sections of an ObservedRR.
+const (
+	SectionAnswer RRSection = iota
+	SectionAuthority
+	SectionAdditional
+)
+
+// ObservedRR is a resource record seen on the network, together with metadata
+// about the message it was carried in.
+type ObservedRR struct {
+	RR       dns.RR
+	Section  RRSection
+	Response bool     // Whether the record came with a response or a query (known answers, probes)
+	Src      net.Addr // Sender of the message
+	Received time.Time
+}
+
+// Observer watches arbitrary mDNS records by name pattern and type, without
+// interpreting them as services. It is meant for tooling and research on
+// records the ServiceEntry model does not cover.
+type Observer struct {
+	c      *client
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	subs map[*rrSubscription]struct{}
+}
+
+type rrSubscription struct {
+	pattern string
+	types   []uint16
+	ch      chan *ObservedRR
+}
+
+// observerBufferSize is the number of records buffered per subscription.
+// Records arriving while the buffer is full are dropped and counted in
+// ResolverStats.ChannelDrops.
+const observerBufferSize = 64
+
+// NewObserver creates an observer and joins the UDP multicast groups to listen
+// for mDNS messages.
+func NewObserver(options ...ClientOption) (*Observer, error) {
+	c, err := newClient(applyClientOpts(options))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Observer{
+		c:      c,
+		cancel: cancel,
+		subs:   make(map[*rrSubscription]struct{}),
+	}
+	msgCh := make(chan *dnsMsg, 265)
+	c.startReceivers(ctx, msgCh)
+	go o.mainloop(ctx, msgCh)
+	return o, nil
+}
+
+// SubscribeRR delivers all records whose owner name matches pattern and whose
+// type is one of types (all types if none are given). The pattern uses
+// path.Match syntax and is matched case-insensitively against the fully
+// qualified name, e.g. "*._companion-link._tcp.local.". The returned function
+// ends the subscription and closes the channel.
+func (o *Observer) SubscribeRR(pattern string, types ...uint16) (<-chan *ObservedRR, func()) {
+	sub := &rrSubscription{
+		pattern: strings.ToLower(dns.Fqdn(pattern)),
+		types:   types,
+		ch:      make(chan *ObservedRR, observerBufferSize),
+	}
+	o.mu.Lock()
+	o.subs[sub] = struct{}{}
+	o.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			o.mu.Lock()
+			if _, ok := o.subs[sub]; ok {
+				delete(o.subs, sub)
+				close(sub.ch)
+			}
+			o.mu.Unlock()
+		})
+	}
+}
+
+// Query multicasts a question for name and qtype, prompting responders to
+// answer with records the subscriptions may be interested in.
+func (o *Observer) Query(name string, qtype uint16) error {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = false
+	return o.c.sendQuery(m)
+}
+
+// Stats returns a snapshot of the observer's traffic counters.
+func (o *Observer) Stats() ResolverStats {
+	return o.c.stats.snapshot()
+}
+
+// Close stops the observer, closes its connections and all subscription
+// channels.
+func (o *Observer) Close() {
+	o.cancel()
+}
+
+func (o *Observer) mainloop(ctx context.Context, msgCh chan *dnsMsg) {
+	for {
+		select {
+		case <-ctx.Done():
+			o.c.shutdown()
+			o.mu.Lock()
+			for sub := range o.subs {
+				close(sub.ch)
+				delete(o.subs, sub)
+			}
+			o.mu.Unlock()
+			return
+		case m := <-msgCh:
+			o.dispatch(m)
+		}
+	}
+}
+
+// dispatch hands the records of a message to the matching subscriptions.
+func (o *Observer) dispatch(m *dnsMsg) {
+	now := time.Now()
+	sections := [][]dns.RR{m.msg.Answer, m.msg.Ns, m.msg.Extra}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, records := range sections {
+		for _, rr := range records {
+			for sub := range o.subs {
+				if !sub.matches(rr) {
+					continue
+				}
+				obs := &ObservedRR{
+					RR:       rr,
+					Section:  RRSection(i),
+					Response: m.msg.Response,
+					Src:      m.src,
+					Received: now,
+				}
+				select {
+				case sub.ch <- obs:
+				default:
+					o.c.stats.channelDrops.Add(1)
+				}
+			}
+		}
+	}
+}
+
+func (sub *rrSubscription) matches(rr dns.RR) bool {
+	hdr := rr.Header()
+	if len(sub.types) > 0 {
+		found := false
+		for _, t := range sub.types {
+			if t == hdr.Rrtype || t == dns.TypeANY {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	ok, _ := path.Match(sub.pattern, strings.ToLower(hdr.Name))
+	return ok
+}
@@ -0,0 +1,156 @@
+package zeroconf
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Space taken by the IPv6 and UDP headers, the larger of both families
+	packetOverhead = 40 + 8
+	// MTU assumed for interfaces not reporting one
+	defaultMTU = 1500
+	// Maximum size of a Multicast DNS packet including the IP and UDP
+	// headers (RFC6762 section 17)
+	maxPacketSize = 9000
+	// Maximum size of a DNS message sent to a unicast peer, which may be
+	// reached over links of any MTU, so the payload of an Ethernet frame
+	unicastPacketSize = defaultMTU - packetOverhead
+)
+
+// packetSize returns the maximum size of a DNS message sent on the interface
+// with the given index, or on all interfaces of the server if ifIndex is zero.
+func (s *Server) packetSize(ifIndex int) int {
+	mtu := 0
+	for _, intf := range s.interfaces() {
+		if ifIndex != 0 && intf.Index != ifIndex {
+			continue
+		}
+		if intf.MTU > 0 && (mtu == 0 || intf.MTU < mtu) {
+			mtu = intf.MTU
+		}
+	}
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	// From RFC6762
+	//    Multicast DNS messages carried by UDP may be up to the IP MTU of the
+	//    physical interface, less the space required for the IP header (20
+	//    bytes for IPv4; 40 bytes for IPv6) and the UDP header (8 bytes).
+	//    [...] even when fragmentation is used, a Multicast DNS packet,
+	//    including IP and UDP headers, MUST NOT exceed 9000 bytes.
+	if mtu > maxPacketSize {
+		mtu = maxPacketSize
+	}
+	size := mtu - packetOverhead
+	// Interfaces which rejected packets as too large, e.g. VPNs whose MTU
+	// shrank, get the size learned then.
+	s.sendMu.Lock()
+	for index, limit := range s.packetLimits {
+		if (ifIndex == 0 || index == ifIndex) && limit < size {
+			size = limit
+		}
+	}
+	s.sendMu.Unlock()
+	return size
+}
+
+// shrinkPacketSize returns the size to split messages into on the interface
+// with the given index after a packet of size bytes was rejected as too large,
+// and remembers it for the later messages.
+func (s *Server) shrinkPacketSize(ifIndex, size int) int {
+	limit := smallerPacketSize(ifIndex, size)
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.packetLimits == nil {
+		s.packetLimits = make(map[int]int)
+	}
+	s.packetLimits[ifIndex] = limit
+	return limit
+}
+
+// smallerPacketSize returns the size to split a message into after a packet of
+// size bytes was rejected as too large (EMSGSIZE) on the interface with the
+// given index: the current MTU of the interface if it shrank meanwhile,
+// otherwise half the size, but no less than the 512 bytes every link carries.
+func smallerPacketSize(ifIndex, size int) int {
+	limit := size / 2
+	if iface, err := net.InterfaceByIndex(ifIndex); err == nil && iface.MTU > 0 && iface.MTU-packetOverhead < size {
+		limit = iface.MTU - packetOverhead
+	}
+	if limit < dns.MinMsgSize {
+		limit = dns.MinMsgSize
+	}
+	return limit
+}
+
+// resplit sends msg, whose packet of size bytes was rejected as too large, again
+// split into packets of the size returned by shrink, with send. Parts rejected
+// as well are split further, until a part cannot get any smaller, e.g. a single
+// large record, whose error is returned.
+func resplit(msg *dns.Msg, size int, shrink func(size int) int, send func([]byte) error) error {
+	for _, part := range splitMessage(msg, shrink(size)) {
+		buf, err := part.Pack()
+		if err != nil {
+			return err
+		}
+		err = send(buf)
+		if isMsgTooBig(err) && len(buf) < size {
+			err = resplit(part, len(buf), shrink, send)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitMessage compresses msg and splits its records across as many messages
+// of at most size bytes as needed. Questions are only sent in the first
+// message. Queries with more known answers than fit in one packet have the TC
+// bit set on all but the last message (RFC6762 section 7.2); the TC bit of
+// responses stays clear (RFC6762 section 18.5). A single record exceeding size
+// is sent alone.
+func splitMessage(msg *dns.Msg, size int) []*dns.Msg {
+	msg.Compress = true
+	if msg.Len() <= size {
+		return []*dns.Msg{msg}
+	}
+
+	part := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.MsgHdr = msg.MsgHdr
+		m.Compress = true
+		return m
+	}
+	cur := part()
+	cur.Question = msg.Question
+	msgs := []*dns.Msg{cur}
+	add := func(section func(m *dns.Msg) *[]dns.RR, rr dns.RR) {
+		records := section(cur)
+		*records = append(*records, rr)
+		if cur.Len() <= size || len(cur.Question)+len(cur.Answer)+len(cur.Ns)+len(cur.Extra) == 1 {
+			return
+		}
+		*records = (*records)[:len(*records)-1]
+		cur = part()
+		msgs = append(msgs, cur)
+		records = section(cur)
+		*records = append(*records, rr)
+	}
+	for _, rr := range msg.Answer {
+		add(func(m *dns.Msg) *[]dns.RR { return &m.Answer }, rr)
+	}
+	for _, rr := range msg.Ns {
+		add(func(m *dns.Msg) *[]dns.RR { return &m.Ns }, rr)
+	}
+	for _, rr := range msg.Extra {
+		add(func(m *dns.Msg) *[]dns.RR { return &m.Extra }, rr)
+	}
+
+	for i, m := range msgs {
+		m.Truncated = !msg.Response && i < len(msgs)-1
+	}
+	return msgs
+}
@@ -0,0 +1,67 @@
+package zeroconf
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// txtRecords returns n TXT records of the instance, each about 100 bytes on
+// the wire.
+func txtRecords(n int) []dns.RR {
+	var records []dns.RR
+	for i := 0; i < n; i++ {
+		records = append(records, &dns.TXT{
+			Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d._test._tcp.local.", i), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+			Txt: []string{fmt.Sprintf("%080d", i)},
+		})
+	}
+	return records
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  bool
+		answers   int
+		size      int
+		wantParts int
+	}{
+		{"fits", true, 3, 1500, 1},
+		{"response split", true, 40, 1500, 3},
+		{"query split", false, 40, 1500, 3},
+		{"record larger than size", true, 2, 50, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.Response = tt.response
+			if !tt.response {
+				msg.Question = []dns.Question{{Name: "_test._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}}
+			}
+			msg.Answer = txtRecords(tt.answers)
+
+			parts := splitMessage(msg, tt.size)
+			if len(parts) != tt.wantParts {
+				t.Fatalf("got %d parts, want %d", len(parts), tt.wantParts)
+			}
+			records := 0
+			for i, part := range parts {
+				records += len(part.Answer)
+				if len(part.Answer) > 1 && part.Len() > tt.size {
+					t.Errorf("part %d has %d bytes, more than %d", i, part.Len(), tt.size)
+				}
+				if i > 0 && len(part.Question) > 0 {
+					t.Errorf("part %d repeats the question", i)
+				}
+				if wantTC := !tt.response && i < len(parts)-1; part.Truncated != wantTC {
+					t.Errorf("part %d has TC %v, want %v", i, part.Truncated, wantTC)
+				}
+			}
+			if records != tt.answers {
+				t.Errorf("parts hold %d records, want %d", records, tt.answers)
+			}
+		})
+	}
+}
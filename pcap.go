@@ -0,0 +1,177 @@
+package zeroconf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CapturedPacket is an mDNS datagram sent or received, as handed to the
+// functions set with WithPacketTap and WithServerPacketTap.
+type CapturedPacket struct {
+	Time    time.Time
+	Sent    bool         // Whether the packet was sent rather than received
+	IfIndex int          // Interface index, zero if unknown
+	Src     *net.UDPAddr // Source address, nil if unknown, e.g. of sent packets
+	Dst     *net.UDPAddr // Destination address, nil if unknown
+	Data    []byte       // The DNS message
+}
+
+// capturePacket hands a copy of a datagram to fn, if set.
+func capturePacket(fn func(CapturedPacket), sent bool, ifIndex int, src, dst net.Addr, data []byte) {
+	if fn == nil {
+		return
+	}
+	p := CapturedPacket{
+		Time:    time.Now(),
+		Sent:    sent,
+		IfIndex: ifIndex,
+		Data:    append([]byte(nil), data...),
+	}
+	p.Src, _ = src.(*net.UDPAddr)
+	p.Dst, _ = dst.(*net.UDPAddr)
+	fn(p)
+}
+
+const (
+	// LINKTYPE_RAW: packets start with an IPv4 or IPv6 header
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+)
+
+// PcapWriter writes captured packets in pcap format, e.g. to a file opened in
+// Wireshark, without running tcpdump with elevated privileges. Since only the
+// DNS messages are captured, the IP and UDP headers are synthesized; unknown
+// addresses are written as unspecified ones, and ports as 5353. It is safe for
+// concurrent use.
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewPcapWriter writes the pcap file header to w and returns a writer for the
+// packets.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket appends a packet to the capture.
+func (p *PcapWriter) WritePacket(pkt CapturedPacket) error {
+	data := ipPacket(pkt)
+	if len(data) > pcapSnapLen {
+		return fmt.Errorf("packet of %d bytes exceeds the snapshot length", len(data))
+	}
+	rec := make([]byte, 16, 16+len(data))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(pkt.Time.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(pkt.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(data)))
+	rec = append(rec, data...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(rec)
+	return err
+}
+
+// ipPacket wraps the DNS message of pkt in IP and UDP headers. The family is
+// the one of the known addresses, IPv4 if none is.
+func ipPacket(pkt CapturedPacket) []byte {
+	src, dst := endpoint(pkt.Src), endpoint(pkt.Dst)
+	v4 := (pkt.Src == nil || pkt.Src.IP.To4() != nil) && (pkt.Dst == nil || pkt.Dst.IP.To4() != nil)
+	var srcIP, dstIP net.IP
+	if v4 {
+		srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		if srcIP == nil {
+			srcIP = net.IPv4zero.To4()
+		}
+		if dstIP == nil {
+			dstIP = net.IPv4zero.To4()
+		}
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		if pkt.Src == nil {
+			srcIP = net.IPv6unspecified
+		}
+		if pkt.Dst == nil {
+			dstIP = net.IPv6unspecified
+		}
+	}
+
+	udp := make([]byte, 8, 8+len(pkt.Data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(pkt.Data)))
+	udp = append(udp, pkt.Data...)
+	// The checksum covers a pseudo header of the addresses, protocol and
+	// length.
+	sum := checksumAdd(0, srcIP)
+	sum = checksumAdd(sum, dstIP)
+	sum += 17 + uint32(len(udp))
+	csum := checksumFold(checksumAdd(sum, udp))
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], csum)
+
+	var ip []byte
+	if v4 {
+		ip = make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = onLinkTTL
+		ip[9] = 17
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], checksumFold(checksumAdd(0, ip)))
+	} else {
+		ip = make([]byte, 40, 40+len(udp))
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = 17
+		ip[7] = onLinkTTL
+		copy(ip[8:], srcIP)
+		copy(ip[24:], dstIP)
+	}
+	return append(ip, udp...)
+}
+
+// endpoint returns addr, or the unspecified address with the mDNS port if it
+// is nil.
+func endpoint(addr *net.UDPAddr) *net.UDPAddr {
+	if addr == nil {
+		return &net.UDPAddr{Port: ipv4Addr.Port}
+	}
+	return addr
+}
+
+// checksumAdd adds b as big endian 16 bit words to the one's complement sum.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds the sum into the 16 bit Internet checksum.
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,177 @@
+package zeroconf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// NameRecord holds the names finally claimed by a registration, together with
+// the outcome of the conflict resolution that led to them.
+type NameRecord struct {
+	Instance  string    `json:"instance"`  // Claimed instance name
+	HostName  string    `json:"hostname"`  // Claimed host name (fully qualified)
+	Conflicts int       `json:"conflicts"` // Number of conflicts resolved so far
+	Updated   time.Time `json:"updated"`   // Time of the last change
+}
+
+// NameStore persists the names claimed by registrations, so a device keeps
+// advertising the same names across restarts even after it had to rename
+// itself due to a conflict. Keys are the originally requested service instance
+// names.
+type NameStore interface {
+	// Load returns the record stored for key. The boolean is false if no
+	// record exists.
+	Load(key string) (NameRecord, bool, error)
+	// Save stores the record for key, replacing any previous one.
+	Save(key string, rec NameRecord) error
+}
+
+// nameStoreVersion is the current version of the FileNameStore file format.
+// Files with an older version are upgraded on the next write, files with a
+// newer version are rejected.
+const nameStoreVersion = 1
+
+// nameStoreLockTimeout bounds how long a FileNameStore waits for the lock held
+// by another process.
+const nameStoreLockTimeout = 5 * time.Second
+
+type nameStoreFile struct {
+	Version int                   `json:"version"`
+	Names   map[string]NameRecord `json:"names"`
+}
+
+// FileNameStore is a NameStore backed by a JSON file. Access is serialized
+// within the process by a mutex and across processes by locking a file next to
+// the state file, and writes replace the file atomically. The lock file is left
+// in place; the lock itself is released by the operating system if its holder
+// dies.
+type FileNameStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileNameStore returns a NameStore keeping its state in the file at path.
+// The file is created on the first Save.
+func NewFileNameStore(path string) *FileNameStore {
+	return &FileNameStore{path: path}
+}
+
+// Load implements NameStore.
+func (f *FileNameStore) Load(key string) (NameRecord, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	unlock, err := f.lock()
+	if err != nil {
+		return NameRecord{}, false, err
+	}
+	defer unlock()
+
+	state, err := f.read()
+	if err != nil {
+		return NameRecord{}, false, err
+	}
+	rec, ok := state.Names[key]
+	return rec, ok, nil
+}
+
+// Save implements NameStore.
+func (f *FileNameStore) Save(key string, rec NameRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := f.read()
+	if err != nil {
+		return err
+	}
+	if rec.Updated.IsZero() {
+		rec.Updated = time.Now()
+	}
+	state.Names[key] = rec
+	state.Version = nameStoreVersion
+	return f.write(state)
+}
+
+// read loads the state file. A missing file yields an empty state.
+func (f *FileNameStore) read() (*nameStoreFile, error) {
+	state := &nameStoreFile{Version: nameStoreVersion}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		state.Names = make(map[string]NameRecord)
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("zeroconf: corrupt name store %s: %v", f.path, err)
+	}
+	if state.Version > nameStoreVersion {
+		return nil, fmt.Errorf("zeroconf: name store %s has unsupported version %d", f.path, state.Version)
+	}
+	if state.Names == nil {
+		state.Names = make(map[string]NameRecord)
+	}
+	return state, nil
+}
+
+// write atomically replaces the state file.
+func (f *FileNameStore) write(state *nameStoreFile) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// lock acquires the cross-process lock and returns its release function.
+func (f *FileNameStore) lock() (func(), error) {
+	lockPath := f.path + ".lock"
+	lf, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(nameStoreLockTimeout)
+	for {
+		locked, err := tryLockFile(lf)
+		if err != nil {
+			lf.Close()
+			return nil, err
+		}
+		if locked {
+			return func() {
+				unlockFile(lf)
+				lf.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			lf.Close()
+			return nil, fmt.Errorf("zeroconf: timeout waiting for lock %s", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,65 @@
+package zeroconf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileNameStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "names.json")
+	store := NewFileNameStore(path)
+
+	if _, ok, err := store.Load("Printer"); err != nil || ok {
+		t.Fatalf("Load on a missing file = %v, %v, want no record", ok, err)
+	}
+	want := NameRecord{Instance: "Printer (2)", HostName: "printer-2.local.", Conflicts: 1}
+	if err := store.Save("Printer", want); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := NewFileNameStore(path).Load("Printer")
+	if err != nil || !ok {
+		t.Fatalf("Load = %v, %v, want the saved record", ok, err)
+	}
+	if got.Instance != want.Instance || got.HostName != want.HostName || got.Conflicts != want.Conflicts || got.Updated.IsZero() {
+		t.Errorf("Load = %+v, want %+v with the update time set", got, want)
+	}
+}
+
+func TestFileNameStoreRejectsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "names.json")
+	data := fmt.Sprintf(`{"version": %d, "names": {}}`, nameStoreVersion+1)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewFileNameStore(path).Load("Printer"); err == nil {
+		t.Error("Load of a newer version succeeded")
+	}
+}
+
+func TestFileNameStoreConcurrentSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "names.json")
+	// Separate stores lock against each other like separate processes.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("Service %d", i)
+			if err := NewFileNameStore(path).Save(key, NameRecord{Instance: key}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	store := NewFileNameStore(path)
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("Service %d", i)
+		if _, ok, err := store.Load(key); err != nil || !ok {
+			t.Errorf("Load(%q) = %v, %v, want the saved record", key, ok, err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package zeroconf
+
+import "net"
+
+// platformPacketReader returns nil: elsewhere the control messages of x/net
+// report the interface and destination of each packet.
+func platformPacketReader(l interface{}) func([]byte) (int, packetInfo, net.Addr, error) {
+	return nil
+}
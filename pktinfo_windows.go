@@ -0,0 +1,149 @@
+//go:build windows
+
+package zeroconf
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/windows"
+)
+
+// fionbio is the ioctl switching a socket to non-blocking mode.
+const fionbio = 0x8004667e
+
+// platformPacketReader reads packets with WSARecvMsg, as x/net does not
+// implement control messages on Windows, so the interface each packet arrived
+// on and its destination address are learnt from IP_PKTINFO or IPV6_PKTINFO.
+// The TTL is not reported. It returns nil if the socket cannot be set up for
+// it, packets are then read without that information.
+func platformPacketReader(l interface{}) func([]byte) (int, packetInfo, net.Addr, error) {
+	var (
+		pc         net.PacketConn
+		level, opt int
+	)
+	switch pConn := l.(type) {
+	case *ipv4.PacketConn:
+		pc, level, opt = pConn.PacketConn, windows.IPPROTO_IP, windows.IP_PKTINFO
+	case *ipv6.PacketConn:
+		pc, level, opt = pConn.PacketConn, windows.IPPROTO_IPV6, windows.IPV6_PKTINFO
+	default:
+		return nil
+	}
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if sockErr = windows.SetsockoptInt(windows.Handle(fd), level, opt, 1); sockErr != nil {
+			return
+		}
+		// WSARecvMsg must not block: the runtime waits for the socket to
+		// become readable when it reports WSAEWOULDBLOCK.
+		nonBlocking, ret := uint32(1), uint32(0)
+		sockErr = windows.WSAIoctl(windows.Handle(fd), fionbio, (*byte)(unsafe.Pointer(&nonBlocking)),
+			uint32(unsafe.Sizeof(nonBlocking)), nil, 0, &ret, nil, 0)
+	})
+	if err != nil || sockErr != nil {
+		return nil
+	}
+
+	oob := make([]byte, 128)
+	return func(b []byte) (n int, info packetInfo, src net.Addr, err error) {
+		info.ttl = -1
+		var (
+			rsa  syscall.RawSockaddrAny
+			oobn int
+		)
+		readErr := raw.Read(func(fd uintptr) bool {
+			buf := windows.WSABuf{Len: uint32(len(b)), Buf: &b[0]}
+			msg := windows.WSAMsg{
+				Name:        &rsa,
+				Namelen:     int32(unsafe.Sizeof(rsa)),
+				Buffers:     &buf,
+				BufferCount: 1,
+				Control:     windows.WSABuf{Len: uint32(len(oob)), Buf: &oob[0]},
+			}
+			var received uint32
+			err = windows.WSARecvMsg(windows.Handle(fd), &msg, &received, nil, nil)
+			if err == windows.WSAEWOULDBLOCK {
+				return false
+			}
+			n, oobn = int(received), int(msg.Control.Len)
+			return true
+		})
+		if readErr != nil {
+			return 0, info, nil, readErr
+		}
+		if err != nil {
+			return 0, info, nil, err
+		}
+		sa, err := rsa.Sockaddr()
+		if err != nil {
+			return 0, info, nil, err
+		}
+		switch sa := sa.(type) {
+		case *syscall.SockaddrInet4:
+			src = &net.UDPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port}
+		case *syscall.SockaddrInet6:
+			src = &net.UDPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port, Zone: zoneName(int(sa.ZoneId))}
+		}
+		info.ifIndex, info.dst = parsePktinfo(oob[:oobn])
+		return n, info, src, nil
+	}
+}
+
+// parsePktinfo returns the interface index and destination address found in
+// the IP_PKTINFO or IPV6_PKTINFO control message of a packet, if any.
+func parsePktinfo(oob []byte) (ifIndex int, dst net.IP) {
+	align := func(n int) int {
+		a := int(unsafe.Sizeof(uintptr(0)))
+		return (n + a - 1) &^ (a - 1)
+	}
+	hdrLen := align(int(unsafe.Sizeof(windows.WSACMSGHDR{})))
+	for len(oob) >= hdrLen {
+		h := (*windows.WSACMSGHDR)(unsafe.Pointer(&oob[0]))
+		msgLen := int(h.Len)
+		if msgLen < hdrLen || msgLen > len(oob) {
+			break
+		}
+		data := oob[hdrLen:msgLen]
+		switch {
+		case h.Level == windows.IPPROTO_IP && h.Type == windows.IP_PKTINFO &&
+			len(data) >= int(unsafe.Sizeof(windows.IN_PKTINFO{})):
+			pi := (*windows.IN_PKTINFO)(unsafe.Pointer(&data[0]))
+			ifIndex, dst = int(pi.Ifindex), net.IP(append([]byte(nil), pi.Addr[:]...))
+		case h.Level == windows.IPPROTO_IPV6 && h.Type == windows.IPV6_PKTINFO &&
+			len(data) >= int(unsafe.Sizeof(windows.IN6_PKTINFO{})):
+			pi := (*windows.IN6_PKTINFO)(unsafe.Pointer(&data[0]))
+			ifIndex, dst = int(pi.Ifindex), net.IP(append([]byte(nil), pi.Addr[:]...))
+		}
+		if next := align(msgLen); next < len(oob) {
+			oob = oob[next:]
+		} else {
+			break
+		}
+	}
+	return ifIndex, dst
+}
+
+// zoneName returns the name of the interface with the given index, to use as
+// the zone of a link-local address.
+func zoneName(index int) string {
+	if index == 0 {
+		return ""
+	}
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		return iface.Name
+	}
+	return strconv.Itoa(index)
+}
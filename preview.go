@@ -0,0 +1,93 @@
+package zeroconf
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// PreviewRegistration returns the records and the packed packets registering
+// entry would send on an interface, without touching the network: the probes
+// followed by the announcements. It lets applications verify the content, size
+// and escaping of their advertisement before deployment.
+//
+// The entry is completed like Register does: the domain defaults to "local.",
+// and the host name to the one set by WithHostName or the system's one. Only
+// the addresses set on the entry are published, restricted by
+// WithAllowedAddrs.
+func PreviewRegistration(entry *ServiceEntry, opts ...ServerOption) ([]dns.RR, [][]byte, error) {
+	if entry == nil {
+		return nil, nil, fmt.Errorf("missing service entry")
+	}
+	conf := applyServerOpts(opts)
+
+	e := entry.clone()
+	if err := validateEntry(e); err != nil {
+		return nil, nil, err
+	}
+	var err error
+	if e.Text, err = splitTXT(e.Text); err != nil {
+		return nil, nil, err
+	}
+	if e.Domain == "" {
+		e.Domain = "local."
+	}
+	if conf.hostName != "" {
+		if err := validateHostName(conf.hostName); err != nil {
+			return nil, nil, err
+		}
+		e.HostName = conf.hostName
+	}
+	if e.HostName == "" {
+		var err error
+		if e.HostName, err = os.Hostname(); err != nil {
+			return nil, nil, fmt.Errorf("could not determine host")
+		}
+	}
+	e.HostName = qualifyHostName(e.HostName, e.Domain)
+	allowed, err := parseAllowedAddrs(conf.allowedAddrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.AddrIPv4, e.AddrIPv6 = filterIPs(e.AddrIPv4, allowed), filterIPs(e.AddrIPv6, allowed)
+	if conf.ipTraffic&IPv4 == 0 {
+		e.AddrIPv4 = nil
+	}
+	if conf.ipTraffic&IPv6 == 0 {
+		e.AddrIPv6 = nil
+	}
+
+	s := &Server{
+		service:       e,
+		ttl:           defaultTTL,
+		hostTTL:       hostRecordTTL,
+		announcements: conf.announcements,
+		noCacheFlush:  conf.noCacheFlush,
+	}
+	s.setTTLs(conf)
+
+	var packets [][]byte
+	for i := 0; i < probeCount; i++ {
+		buf, err := s.probeQuery(i == 0).Pack()
+		if err != nil {
+			return nil, nil, err
+		}
+		packets = append(packets, buf)
+	}
+
+	resp := new(dns.Msg)
+	resp.MsgHdr.Response = true
+	resp.Compress = true
+	resp.Answer = []dns.RR{}
+	resp.Extra = []dns.RR{}
+	s.composeLookupAnswers(resp, s.ttl, 0)
+	buf, err := resp.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < s.announcements; i++ {
+		packets = append(packets, buf)
+	}
+	return resp.Answer, packets, nil
+}
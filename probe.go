@@ -0,0 +1,737 @@
+package zeroconf
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Number of probes sent before claiming a unique name (RFC6762 section 8.1)
+	probeCount = 3
+	// Interval between two probes
+	probeInterval = 250 * time.Millisecond
+	// Time within which another conflict for a name we defended means the
+	// other host insists on it
+	defenseWindow = 10 * time.Second
+	// Number of conflicts within conflictWindow after which probing is
+	// throttled, and the delay before each further probe sequence (RFC6762
+	// section 8.1)
+	conflictLimit   = 15
+	conflictWindow  = 10 * time.Second
+	conflictBackoff = 5 * time.Second
+)
+
+// serverState describes where a Server is in its registration lifecycle.
+type serverState int32
+
+const (
+	stateProbing serverState = iota
+	stateAnnouncing
+	stateRunning
+	stateConflict
+	statePaused
+)
+
+// atomicState is a serverState which can be accessed concurrently.
+type atomicState struct {
+	v atomic.Int32
+}
+
+func (a *atomicState) load() serverState {
+	return serverState(a.v.Load())
+}
+
+func (a *atomicState) store(state serverState) {
+	a.v.Store(int32(state))
+}
+
+func (a *atomicState) compareAndSwap(old, new serverState) bool {
+	return a.v.CompareAndSwap(int32(old), int32(new))
+}
+
+// probe verifies that nobody else owns our unique names and announces the
+// service afterwards. On a conflict the conflicting name is changed and probing
+// starts over (RFC6762 section 9). A probe queued behind Pause does nothing.
+func (s *Server) probe() {
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+	if s.state.load() == statePaused {
+		return
+	}
+
+	throttled := false
+	for {
+		if throttled && !s.sleep(conflictBackoff) {
+			return
+		}
+		conflict, ok := s.probeOnce()
+		if !ok {
+			return
+		}
+		if conflict == "" {
+			break
+		}
+		s.resolveConflict(conflict)
+		storm := s.conflictStorm()
+		if storm && !throttled {
+			log.Printf("[WARN] zeroconf: %d conflicts within %v, delaying probes by %v", conflictLimit, conflictWindow, conflictBackoff)
+		}
+		throttled = storm
+	}
+
+	s.state.store(stateAnnouncing)
+	s.recordsChanged()
+	s.announce()
+	s.state.store(stateRunning)
+}
+
+// probeOnce sends the probe sequence. It returns the name a conflict was
+// detected for, or an empty string if the names may be claimed. The boolean is
+// false if the server was shut down meanwhile.
+func (s *Server) probeOnce() (string, bool) {
+	// Forget conflicts reported for names we no longer use.
+	select {
+	case <-s.conflict:
+	default:
+	}
+	select {
+	case <-s.tiebreakLost:
+	default:
+	}
+	s.state.store(stateProbing)
+	s.notify(ServerEvent{Type: EventProbing})
+	s.recordsChanged()
+
+	// From RFC6762
+	//    When the host is ready to send its probe packets, it SHOULD first wait
+	//    for a short random delay time, uniformly distributed in the range
+	//    0-250 ms. [...] 250 ms after the first query, the host should send a
+	//    second; then, 250 ms after that, a third.
+	randomizer := rand.New(rand.NewSource(time.Now().UnixNano()))
+	if !s.sleep(time.Duration(randomizer.Intn(250)) * time.Millisecond) {
+		return "", false
+	}
+	for i := 0; i < probeCount; i++ {
+		s.mu.RLock()
+		q := s.probeQuery(i == 0)
+		s.mu.RUnlock()
+		s.stats.probesSent.Add(1)
+		if err := s.multicastResponse(q, 0); err != nil {
+			log.Println("[ERR] zeroconf: failed to send probe:", err.Error())
+		}
+		select {
+		case name := <-s.conflict:
+			return name, true
+		case <-s.tiebreakLost:
+			// From RFC6762
+			//    [...] the host that lost the tiebreak MUST defer to the
+			//    winning host by waiting one second, and then begin probing
+			//    for this record again.
+			if !s.sleep(time.Second) {
+				return "", false
+			}
+			i = -1
+		case <-s.shouldShutdown:
+			return "", false
+		case <-time.After(probeInterval):
+		}
+	}
+	return "", true
+}
+
+// resolveConflict picks a new name for the conflicting host or instance name,
+// persists it and notifies the rename handler.
+func (s *Server) resolveConflict(name string) {
+	s.state.store(stateConflict)
+	s.stats.conflictsDetected.Add(1)
+	s.notify(ServerEvent{Type: EventConflictDetected, Name: name})
+	s.mu.Lock()
+	s.conflicts++
+	var (
+		renamed          func()
+		oldName, newName string
+		hostRenamed      = true
+	)
+	if i := s.aliasIndex(name); i >= 0 {
+		oldName, newName = s.aliases[i], nextHostName(s.aliases[i])
+		s.aliases[i] = newName
+		log.Printf("[WARN] zeroconf: alias conflict for %s, renaming to %s", oldName, newName)
+	} else if strings.EqualFold(name, s.service.HostName) {
+		oldName, newName = s.service.HostName, nextHostName(s.service.HostName)
+		s.service.HostName = newName
+		// The target of a proxy registration publishes the addresses given
+		// for it under the new name.
+		if i := s.proxyHostIndex(oldName); i >= 0 {
+			s.proxyHosts[i].Name = newName
+		}
+		log.Printf("[WARN] zeroconf: host name conflict for %s, renaming to %s", oldName, newName)
+	} else if i := s.proxyHostIndex(name); i >= 0 {
+		oldName, newName = s.proxyHosts[i].Name, nextHostName(s.proxyHosts[i].Name)
+		s.proxyHosts[i].Name = newName
+		log.Printf("[WARN] zeroconf: proxied host name conflict for %s, renaming to %s", oldName, newName)
+	} else if iface := s.ifaceHostNameIndex(name); iface != "" {
+		oldName, newName = s.ifaceHostNames[iface], nextHostName(s.ifaceHostNames[iface])
+		s.ifaceHostNames[iface] = newName
+		log.Printf("[WARN] zeroconf: host name conflict for %s on %s, renaming to %s", oldName, iface, newName)
+	} else {
+		old, instance := s.service.Instance, nextInstanceName(s.service.Instance)
+		oldName, newName, hostRenamed = old, instance, false
+		s.service.setInstance(instance)
+		log.Printf("[WARN] zeroconf: name conflict for %s, renaming to %s", old, instance)
+		if s.onRename != nil {
+			renamed = func() { s.onRename(old, instance) }
+		}
+	}
+	if hostRenamed && s.onHostRename != nil {
+		old, host := oldName, newName
+		renamed = func() { s.onHostRename(old, host) }
+	}
+	s.mu.Unlock()
+
+	s.saveNames()
+	if renamed != nil {
+		renamed()
+	}
+	s.notify(ServerEvent{Type: EventRenamed, Name: newName, OldName: oldName})
+}
+
+// ifaceHostNameIndex returns the interface whose host name is name, or "".
+func (s *Server) ifaceHostNameIndex(name string) string {
+	for iface, host := range s.ifaceHostNames {
+		if strings.EqualFold(host, name) {
+			return iface
+		}
+	}
+	return ""
+}
+
+// conflictStorm records a conflict and reports whether there were too many
+// conflicts recently to probe again right away.
+func (s *Server) conflictStorm() bool {
+	// From RFC6762
+	//    If fifteen conflicts occur within any ten-second period, then the
+	//    host MUST wait at least five seconds before each successive
+	//    additional probe attempt.
+	now := time.Now()
+	recent := s.recentConflicts[:0]
+	for _, t := range s.recentConflicts {
+		if now.Sub(t) < conflictWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.recentConflicts = append(recent, now)
+	return len(s.recentConflicts) >= conflictLimit
+}
+
+// aliasIndex returns the index of name in the aliases, or -1.
+func (s *Server) aliasIndex(name string) int {
+	for i, alias := range s.aliases {
+		if strings.EqualFold(alias, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	instanceCounter = regexp.MustCompile(`^(.*) \((\d+)\)$`)
+	hostCounter     = regexp.MustCompile(`^(.*)-(\d+)$`)
+)
+
+// nextInstanceName appends or increments the " (N)" suffix used to rename
+// conflicting instances, e.g. "My Service" becomes "My Service (2)".
+func nextInstanceName(name string) string {
+	if m := instanceCounter.FindStringSubmatch(name); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("%s (%d)", m[1], n+1)
+	}
+	return name + " (2)"
+}
+
+// nextHostName appends or increments the "-N" suffix of the first label of a
+// host name, e.g. "myhost.local." becomes "myhost-2.local.".
+func nextHostName(host string) string {
+	label, rest := host, ""
+	if i := strings.Index(host, "."); i >= 0 {
+		label, rest = host[:i], host[i:]
+	}
+	if m := hostCounter.FindStringSubmatch(label); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("%s-%d%s", m[1], n+1, rest)
+	}
+	return label + "-2" + rest
+}
+
+// announce sends unsolicited responses for all records of the service.
+func (s *Server) announce() {
+	// From RFC6762
+	//    The Multicast DNS responder MUST send at least two unsolicited
+	//    responses, one second apart. To provide increased robustness against
+	//    packet loss, a responder MAY send up to eight unsolicited responses,
+	//    provided that the interval between unsolicited responses increases by
+	//    at least a factor of two with every response sent.
+	timeout := 1 * time.Second
+	for i := 0; i < s.announcements; i++ {
+		if i > 0 {
+			if !s.sleep(timeout) {
+				return
+			}
+			timeout *= 2
+		}
+		for _, intf := range s.interfaces() {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			// TODO: make response authoritative if we are the publisher
+			resp.Compress = true
+			resp.Answer = []dns.RR{}
+			resp.Extra = []dns.RR{}
+			s.mu.RLock()
+			s.composeLookupAnswers(resp, s.ttl, intf.Index)
+			s.mu.RUnlock()
+			if err := s.multicastResponse(resp, intf.Index); err != nil {
+				log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
+			}
+		}
+		if len(s.peers) > 0 {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			s.mu.RLock()
+			s.composeLookupAnswers(resp, s.ttl, 0)
+			s.mu.RUnlock()
+			s.announceToPeers(resp)
+		}
+		if i == 0 {
+			s.notify(ServerEvent{Type: EventAnnounced})
+		}
+	}
+}
+
+// reannounce multicasts the records returned by compose for each interface,
+// following the schedule of the initial announcements. It is used to propagate
+// changes of individual records; while probing, the changes are part of the
+// upcoming announcements anyway.
+func (s *Server) reannounce(compose func(ifIndex int) []dns.RR) {
+	timeout := 1 * time.Second
+	for i := 0; i < s.announcements; i++ {
+		if i > 0 {
+			if !s.sleep(timeout) {
+				return
+			}
+			timeout *= 2
+		}
+		if s.state.load() != stateRunning {
+			return
+		}
+		if i == 0 {
+			s.recordsChanged()
+		}
+		for _, intf := range s.interfaces() {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			resp.Compress = true
+			s.mu.RLock()
+			resp.Answer = compose(intf.Index)
+			s.mu.RUnlock()
+			if len(resp.Answer) == 0 {
+				continue
+			}
+			if err := s.multicastResponse(resp, intf.Index); err != nil {
+				log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
+			}
+		}
+		if len(s.peers) > 0 {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			s.mu.RLock()
+			resp.Answer = compose(0)
+			s.mu.RUnlock()
+			if len(resp.Answer) > 0 {
+				s.announceToPeers(resp)
+			}
+		}
+	}
+}
+
+// sleep waits for d and reports false if the server was shut down meanwhile.
+func (s *Server) sleep(d time.Duration) bool {
+	select {
+	case <-s.shouldShutdown:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// probeQuery builds a probe for the service instance name and the host name,
+// with the records we intend to claim in the authority section. The first
+// probe asks for unicast responses (RFC6762 section 8.1).
+func (s *Server) probeQuery(unicast bool) *dns.Msg {
+	qclass := uint16(dns.ClassINET)
+	if unicast {
+		qclass |= qClassCacheFlush
+	}
+	q := new(dns.Msg)
+	q.RecursionDesired = false
+	q.Question = []dns.Question{
+		{Name: s.service.ServiceInstanceName(), Qtype: dns.TypeANY, Qclass: qclass},
+		{Name: s.service.HostName, Qtype: dns.TypeANY, Qclass: qclass},
+	}
+	for _, host := range s.ifaceHostNames {
+		q.Question = append(q.Question, dns.Question{Name: host, Qtype: dns.TypeANY, Qclass: qclass})
+	}
+	for _, alias := range s.aliases {
+		q.Question = append(q.Question, dns.Question{Name: alias, Qtype: dns.TypeANY, Qclass: qclass})
+	}
+
+	srv := &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   s.service.ServiceInstanceName(),
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    s.hostTTL,
+		},
+		Priority: 0,
+		Weight:   0,
+		Port:     uint16(s.service.Port),
+		Target:   s.service.HostName,
+	}
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   s.service.ServiceInstanceName(),
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    s.hostTTL,
+		},
+		Txt: s.service.Text,
+	}
+	q.Ns = []dns.RR{srv, txt}
+	q.Ns = s.appendAddrs(q.Ns, s.ttl, 0)
+	q.Ns = s.appendHostInfo(q.Ns, s.ttl, 0)
+	for _, intf := range s.interfaces() {
+		if _, ok := s.ifaceHostNames[intf.Name]; ok {
+			q.Ns = s.appendAddrs(q.Ns, s.ttl, intf.Index)
+		}
+	}
+	q.Ns = s.appendAliases(q.Ns, s.ttl)
+	// The cache-flush bit is never set in the authority section of probes.
+	for _, rr := range q.Ns {
+		rr.Header().Class &^= qClassCacheFlush
+	}
+	return q
+}
+
+// tiebreak compares a probe received while probing ourselves with our own
+// probe, and makes the prober defer if the other host wins for any name both
+// are probing for (RFC6762 section 8.2).
+func (s *Server) tiebreak(query *dns.Msg) {
+	s.mu.RLock()
+	ours := s.probeQuery(false).Ns
+	s.mu.RUnlock()
+	for _, q := range query.Question {
+		mine := recordsNamed(ours, q.Name)
+		if len(mine) == 0 {
+			continue
+		}
+		if compareRecordSets(mine, recordsNamed(query.Ns, q.Name)) < 0 {
+			log.Printf("[INFO] zeroconf: lost simultaneous probe tiebreak for %s, deferring", q.Name)
+			select {
+			case s.tiebreakLost <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// recordsNamed returns the records owned by name.
+func recordsNamed(records []dns.RR, name string) []dns.RR {
+	var named []dns.RR
+	for _, rr := range records {
+		if strings.EqualFold(rr.Header().Name, name) {
+			named = append(named, rr)
+		}
+	}
+	return named
+}
+
+// compareRecordSets compares two sets of records lexicographically as
+// described in RFC6762 section 8.2 and returns -1, 0 or 1.
+func compareRecordSets(a, b []dns.RR) int {
+	// From RFC6762
+	//    [...] both hosts sort their records into (lexicographical) order,
+	//    and then compare the records pairwise, using the same comparison
+	//    technique described above, until a difference is found. [...] If
+	//    either list of records runs out of records before any difference is
+	//    found, then the list with records remaining is deemed to have won
+	//    the tiebreak.
+	a, b = sortedRecords(a), sortedRecords(b)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareRecords(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func sortedRecords(records []dns.RR) []dns.RR {
+	sorted := append([]dns.RR(nil), records...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareRecords(sorted[i], sorted[j]) < 0
+	})
+	return sorted
+}
+
+// compareRecords compares the class, excluding the cache-flush bit, then the
+// type and then the raw rdata of two records.
+func compareRecords(a, b dns.RR) int {
+	ha, hb := a.Header(), b.Header()
+	ca, cb := ha.Class&^qClassCacheFlush, hb.Class&^qClassCacheFlush
+	switch {
+	case ca != cb:
+		if ca < cb {
+			return -1
+		}
+		return 1
+	case ha.Rrtype != hb.Rrtype:
+		if ha.Rrtype < hb.Rrtype {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(rdata(a), rdata(b))
+}
+
+// rdata returns the uncompressed wire format of the data of rr.
+func rdata(rr dns.RR) []byte {
+	buf := make([]byte, dns.Len(rr)+256)
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	start, err := dns.PackDomainName(rr.Header().Name, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	// Skip type, class, TTL and rdata length.
+	return buf[start+10 : end]
+}
+
+// handleResponse inspects responses from other hosts for records conflicting
+// with our unique records.
+func (s *Server) handleResponse(msg *dns.Msg, from net.Addr) {
+	if s.service == nil {
+		return
+	}
+	s.mu.RLock()
+	var events []*SecurityEvent
+	if s.rogue != nil {
+		events = s.rogue.inspect(s, msg, from)
+	}
+	var conflict string
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		if s.isConflict(rr, from) {
+			conflict = rr.Header().Name
+			break
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, event := range events {
+		s.reportError(event)
+	}
+	if conflict != "" {
+		s.signalConflict(conflict)
+	}
+}
+
+// signalConflict notifies the prober about a conflicting record for name, or
+// defends the name if it was already claimed.
+func (s *Server) signalConflict(name string) {
+	switch s.state.load() {
+	case stateProbing:
+		select {
+		case s.conflict <- name:
+		default:
+		}
+	case stateAnnouncing, stateRunning:
+		s.defend(name)
+	}
+}
+
+// defend handles a conflicting record for a name we own. The first conflict is
+// answered by multicasting our records for the name, which corrects stale
+// cache entries and tells the other host the name is taken. If the conflict
+// recurs within defenseWindow, the other host persists and the name is probed
+// again, which renames it once the other host answers the probes.
+func (s *Server) defend(name string) {
+	// From RFC6762
+	//    Whenever a Multicast DNS responder receives any Multicast DNS
+	//    response (solicited or otherwise) containing a conflicting resource
+	//    record in any of the Resource Record Sections, the Multicast DNS
+	//    responder MUST immediately reset its conflicted unique record to
+	//    probing state, and go through the startup steps described above in
+	//    Section 8.
+	key := strings.ToLower(name)
+	now := time.Now()
+	s.defenseMu.Lock()
+	last, ok := s.defended[key]
+	persists := ok && now.Sub(last) < defenseWindow
+	if persists {
+		delete(s.defended, key)
+	} else {
+		s.defended[key] = now
+	}
+	s.defenseMu.Unlock()
+
+	if persists {
+		// A service paused meanwhile stays paused.
+		if s.state.compareAndSwap(stateRunning, stateProbing) || s.state.compareAndSwap(stateAnnouncing, stateProbing) {
+			log.Printf("[WARN] zeroconf: %s is still claimed by another host, probing again", name)
+			go s.probe()
+		}
+		return
+	}
+
+	for _, intf := range s.interfaces() {
+		resp := new(dns.Msg)
+		resp.MsgHdr.Response = true
+		resp.Compress = true
+		s.mu.RLock()
+		all := new(dns.Msg)
+		s.composeLookupAnswers(all, s.ttl, intf.Index)
+		s.mu.RUnlock()
+		resp.Answer = recordsNamed(append(all.Answer, all.Extra...), name)
+		if len(resp.Answer) == 0 {
+			continue
+		}
+		if err := s.multicastResponse(resp, intf.Index); err != nil {
+			log.Println("[ERR] zeroconf: failed to defend records:", err.Error())
+		}
+	}
+}
+
+// refresh announces the records again whenever 80% of their shortest TTL
+// elapsed, if enabled with WithAutoRefresh. Records are only refreshed while
+// running; probing announces them anyway.
+func (s *Server) refresh() {
+	if !s.autoRefresh {
+		return
+	}
+	for {
+		ttl := s.ttl
+		if s.hostTTL < ttl {
+			ttl = s.hostTTL
+		}
+		if ttl == 0 {
+			ttl = hostRecordTTL
+		}
+		if !s.sleep(time.Duration(ttl) * time.Second * 8 / 10) {
+			return
+		}
+		if s.state.load() != stateRunning {
+			continue
+		}
+		for _, intf := range s.interfaces() {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			s.mu.RLock()
+			s.composeLookupAnswers(resp, s.ttl, intf.Index)
+			s.mu.RUnlock()
+			if err := s.multicastResponse(resp, intf.Index); err != nil {
+				log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
+			}
+		}
+		if len(s.peers) > 0 {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			s.mu.RLock()
+			s.composeLookupAnswers(resp, s.ttl, 0)
+			s.mu.RUnlock()
+			s.announceToPeers(resp)
+		}
+	}
+}
+
+// isConflict reports whether rr claims one of our unique names with data
+// different from ours. Address records for our host name are only considered
+// when they originate from another host, since the system's own mDNS responder
+// may publish the same host name with a different set of addresses.
+func (s *Server) isConflict(rr dns.RR, from net.Addr) bool {
+	hdr := rr.Header()
+	if hdr.Ttl == 0 {
+		// Goodbye packets never conflict.
+		return false
+	}
+	if s.isAlias(hdr.Name) {
+		// An alias may only be a CNAME to our host name.
+		cname, ok := rr.(*dns.CNAME)
+		return !ok || !strings.EqualFold(cname.Target, s.service.HostName)
+	}
+	switch r := rr.(type) {
+	case *dns.SRV:
+		if !strings.EqualFold(hdr.Name, s.service.ServiceInstanceName()) {
+			return false
+		}
+		return int(r.Port) != s.service.Port || !s.isHostName(r.Target)
+	case *dns.TXT:
+		if !strings.EqualFold(hdr.Name, s.service.ServiceInstanceName()) {
+			return false
+		}
+		return strings.Join(r.Txt, "\x00") != strings.Join(s.service.Text, "\x00")
+	case *dns.A:
+		if !s.isHostName(hdr.Name) || isLocalAddr(from) {
+			return false
+		}
+		return !containsIP(s.service.AddrIPv4, r.A)
+	case *dns.AAAA:
+		if !s.isHostName(hdr.Name) || isLocalAddr(from) {
+			return false
+		}
+		return !containsIP(s.service.AddrIPv6, r.AAAA)
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalAddr reports whether addr is one of the addresses of this host.
+func isLocalAddr(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
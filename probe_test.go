@@ -0,0 +1,59 @@
+package zeroconf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNextHostName(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"myhost.local.", "myhost-2.local."},
+		{"myhost-2.local.", "myhost-3.local."},
+		{"myhost-9.local.", "myhost-10.local."},
+		{"my-host.local.", "my-host-2.local."},
+		{"myhost", "myhost-2"},
+	}
+	for _, tt := range tests {
+		if got := nextHostName(tt.host); got != tt.want {
+			t.Errorf("nextHostName(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCompareRecordSets(t *testing.T) {
+	a := func(ip string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "host.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.ParseIP(ip)}
+	}
+	flushed := func(rr dns.RR) dns.RR {
+		rr = dns.Copy(rr)
+		rr.Header().Class |= qClassCacheFlush
+		return rr
+	}
+	srv := &dns.SRV{Hdr: dns.RR_Header{Name: "host.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120}, Port: 80, Target: "host.local."}
+
+	tests := []struct {
+		name string
+		a, b []dns.RR
+		want int
+	}{
+		{"equal", []dns.RR{a("192.0.2.1")}, []dns.RR{a("192.0.2.1")}, 0},
+		{"cache-flush bit ignored", []dns.RR{flushed(a("192.0.2.1"))}, []dns.RR{a("192.0.2.1")}, 0},
+		{"order ignored", []dns.RR{a("192.0.2.1"), a("192.0.2.2")}, []dns.RR{a("192.0.2.2"), a("192.0.2.1")}, 0},
+		{"lower rdata loses", []dns.RR{a("192.0.2.1")}, []dns.RR{a("192.0.2.2")}, -1},
+		{"higher rdata wins", []dns.RR{a("192.0.2.3")}, []dns.RR{a("192.0.2.2")}, 1},
+		{"higher type wins", []dns.RR{srv}, []dns.RR{a("192.0.2.9")}, 1},
+		{"records remaining win", []dns.RR{a("192.0.2.1"), a("192.0.2.2")}, []dns.RR{a("192.0.2.1")}, 1},
+		{"fewer records lose", nil, []dns.RR{a("192.0.2.1")}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareRecordSets(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareRecordSets = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
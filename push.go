@@ -0,0 +1,431 @@
+package zeroconf
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DNS Stateful Operations opcode and TLV types (RFC8490, RFC8765)
+	dsoOpcode      = 6
+	dsoKeepalive   = 0x0001
+	dsoSubscribe   = 0x0040
+	dsoPush        = 0x0041
+	dsoUnsubscribe = 0x0042
+	dsoReconfirm   = 0x0043
+	// Response code for unsupported DSO TLVs (RFC8490 section 5.1.1)
+	rcodeDSOTypeNI = 11
+
+	// TTL of PUSH records removing a record (RFC8765 section 6.3.1)
+	pushRemoveRecord = 0xFFFFFFFF
+
+	// Time a write to a subscriber may take before its session is closed
+	pushWriteTimeout = 5 * time.Second
+	// Number of messages queued for a subscriber; a session whose queue is
+	// full is closed
+	pushQueueSize = 64
+)
+
+// PushServer serves DNS Push Notifications (RFC8765) for published services,
+// so remote clients, e.g. of a wide-area registration or a discovery gateway,
+// learn about new, changed and withdrawn records immediately instead of
+// polling. Clients subscribe to a name and type over a DNS Stateful Operations
+// session; the initial records are sent right away and every later change is
+// pushed.
+//
+// RFC8765 requires TLS: pass a listener created with tls.NewListener, usually
+// on port 853 and advertised as _dns-push-tls._tcp.
+type PushServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	services map[*Server][]dns.RR // Records last pushed, by service
+	sessions map[*pushSession]struct{}
+	closed   bool
+}
+
+// pushSession is a DSO session of a client. Messages are queued and written
+// by a goroutine of the session, so a slow subscriber does not hold up the
+// others.
+type pushSession struct {
+	conn  net.Conn
+	queue chan []byte
+	subs  map[uint16]dns.Question // by message ID of the SUBSCRIBE request
+}
+
+// NewPushServer serves DNS Push sessions on the listener until Shutdown.
+func NewPushServer(l net.Listener) *PushServer {
+	p := &PushServer{
+		listener: l,
+		services: make(map[*Server][]dns.RR),
+		sessions: make(map[*pushSession]struct{}),
+	}
+	go p.serve()
+	return p
+}
+
+// Publish makes the records of the service available to subscribers and
+// notifies them of all later changes until Withdraw is called or the service is
+// shut down.
+func (p *PushServer) Publish(s *Server) {
+	s.mu.Lock()
+	if s.pushServers == nil {
+		s.pushServers = make(map[*PushServer]struct{})
+	}
+	s.pushServers[p] = struct{}{}
+	s.mu.Unlock()
+	p.update(s)
+}
+
+// Withdraw removes the records of the service, notifying the subscribers.
+func (p *PushServer) Withdraw(s *Server) {
+	s.mu.Lock()
+	delete(s.pushServers, p)
+	s.mu.Unlock()
+	p.set(s, nil)
+}
+
+// Shutdown closes the listener and all sessions.
+func (p *PushServer) Shutdown() {
+	p.mu.Lock()
+	p.closed = true
+	services := p.services
+	p.services = make(map[*Server][]dns.RR)
+	for sess := range p.sessions {
+		sess.conn.Close()
+	}
+	p.mu.Unlock()
+	p.listener.Close()
+	for s := range services {
+		s.mu.Lock()
+		delete(s.pushServers, p)
+		s.mu.Unlock()
+	}
+}
+
+// recordsChanged pushes the current records of the service to the push servers
+// publishing it. It must not be called with s.mu held.
+func (s *Server) recordsChanged() {
+	for _, p := range s.publishers() {
+		p.update(s)
+	}
+}
+
+// publishers returns the push servers publishing the service.
+func (s *Server) publishers() []*PushServer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	servers := make([]*PushServer, 0, len(s.pushServers))
+	for p := range s.pushServers {
+		servers = append(servers, p)
+	}
+	return servers
+}
+
+// update pushes the changes of the records of s.
+func (p *PushServer) update(s *Server) {
+	var records []dns.RR
+	if state := s.state.load(); state == stateRunning || state == stateAnnouncing {
+		resp := new(dns.Msg)
+		s.mu.RLock()
+		s.composeLookupAnswers(resp, s.ttl, 0)
+		s.mu.RUnlock()
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			rr = dns.Copy(rr)
+			rr.Header().Class &^= qClassCacheFlush
+			records = append(records, rr)
+		}
+	}
+	p.set(s, records)
+}
+
+// set replaces the records of s and pushes the differences to the subscribers.
+func (p *PushServer) set(s *Server, records []dns.RR) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	old := p.services[s]
+	if records == nil {
+		delete(p.services, s)
+	} else {
+		p.services[s] = records
+	}
+
+	var changes []dns.RR
+	for _, rr := range old {
+		if !containsRecord(records, rr) {
+			removed := dns.Copy(rr)
+			removed.Header().Ttl = pushRemoveRecord
+			changes = append(changes, removed)
+		}
+	}
+	for _, rr := range records {
+		if !containsRecord(old, rr) {
+			changes = append(changes, rr)
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	for sess := range p.sessions {
+		sess.push(changes)
+	}
+}
+
+// records returns the current records matching q. p.mu must be held.
+func (p *PushServer) records(q dns.Question) []dns.RR {
+	var matched []dns.RR
+	for _, records := range p.services {
+		for _, rr := range records {
+			if matchesQuestion(rr, q) {
+				matched = append(matched, rr)
+			}
+		}
+	}
+	return matched
+}
+
+// serve accepts sessions until the listener is closed.
+func (p *PushServer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("[WARN] zeroconf: failed to accept DNS Push session: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		sess := &pushSession{
+			conn:  conn,
+			queue: make(chan []byte, pushQueueSize),
+			subs:  make(map[uint16]dns.Question),
+		}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return
+		}
+		p.sessions[sess] = struct{}{}
+		p.mu.Unlock()
+		go sess.writer()
+		go p.handle(sess)
+	}
+}
+
+// handle reads the DSO messages of a session until it is closed.
+func (p *PushServer) handle(sess *pushSession) {
+	defer func() {
+		// Messages are only queued by this goroutine and with p.mu held,
+		// so none is queued after the queue is closed.
+		p.mu.Lock()
+		delete(p.sessions, sess)
+		close(sess.queue)
+		p.mu.Unlock()
+		sess.conn.Close()
+	}()
+
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(sess.conn, length[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(sess.conn, msg); err != nil {
+			return
+		}
+		if len(msg) < 12 {
+			return
+		}
+		id := binary.BigEndian.Uint16(msg[0:])
+		flags := binary.BigEndian.Uint16(msg[2:])
+		if flags&0x8000 != 0 || int(flags>>11&0xF) != dsoOpcode {
+			// Responses are not expected and other messages are not
+			// served on DNS Push sessions.
+			return
+		}
+		tlvType, data, ok := firstTLV(msg[12:])
+		if !ok {
+			return
+		}
+		switch tlvType {
+		case dsoKeepalive:
+			// Accept the timeouts proposed by the client.
+			if id != 0 {
+				sess.respond(id, dns.RcodeSuccess, dsoKeepalive, data)
+			}
+		case dsoSubscribe:
+			q, ok := parseSubscription(data)
+			if !ok || id == 0 {
+				sess.respond(id, dns.RcodeFormatError, 0, nil)
+				continue
+			}
+			p.mu.Lock()
+			sess.subs[id] = q
+			sess.respond(id, dns.RcodeSuccess, 0, nil)
+			if initial := p.records(q); len(initial) > 0 {
+				sess.send(initial)
+			}
+			p.mu.Unlock()
+		case dsoUnsubscribe:
+			if len(data) == 2 {
+				p.mu.Lock()
+				delete(sess.subs, binary.BigEndian.Uint16(data))
+				p.mu.Unlock()
+			}
+		case dsoReconfirm:
+			// Our own records are always current.
+		default:
+			if id != 0 {
+				sess.respond(id, rcodeDSOTypeNI, 0, nil)
+			}
+		}
+	}
+}
+
+// push queues the changes matching the subscriptions of the session. The
+// PushServer lock must be held.
+func (sess *pushSession) push(changes []dns.RR) {
+	var matched []dns.RR
+	for _, rr := range changes {
+		for _, q := range sess.subs {
+			if matchesQuestion(rr, q) {
+				matched = append(matched, rr)
+				break
+			}
+		}
+	}
+	if len(matched) > 0 {
+		sess.send(matched)
+	}
+}
+
+// send queues a PUSH message with the records.
+func (sess *pushSession) send(records []dns.RR) {
+	var data []byte
+	for _, rr := range records {
+		buf := make([]byte, dns.Len(rr)+256)
+		n, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			continue
+		}
+		data = append(data, buf[:n]...)
+	}
+	sess.write(0, 0, dns.RcodeSuccess, dsoPush, data)
+}
+
+// respond queues the response to a DSO request.
+func (sess *pushSession) respond(id uint16, rcode int, tlvType uint16, data []byte) {
+	sess.write(id, 0x8000, rcode, tlvType, data)
+}
+
+// write queues a DSO message with at most one TLV. A session whose queue is
+// full is closed.
+func (sess *pushSession) write(id, qr uint16, rcode int, tlvType uint16, data []byte) {
+	msg := make([]byte, 2+12, 2+12+4+len(data))
+	binary.BigEndian.PutUint16(msg[2:], id)
+	binary.BigEndian.PutUint16(msg[4:], qr|dsoOpcode<<11|uint16(rcode&0xF))
+	if tlvType != 0 {
+		msg = binary.BigEndian.AppendUint16(msg, tlvType)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+	}
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+
+	select {
+	case sess.queue <- msg:
+	default:
+		log.Printf("[WARN] zeroconf: DNS Push subscriber %s is too slow, closing session", sess.conn.RemoteAddr())
+		sess.conn.Close()
+	}
+}
+
+// writer writes the queued messages until the session ends. A failing session
+// is closed.
+func (sess *pushSession) writer() {
+	failed := false
+	for msg := range sess.queue {
+		if failed {
+			continue
+		}
+		sess.conn.SetWriteDeadline(time.Now().Add(pushWriteTimeout))
+		if _, err := sess.conn.Write(msg); err != nil {
+			failed = true
+			sess.conn.Close()
+		}
+	}
+}
+
+// firstTLV returns the primary TLV of a DSO message.
+func firstTLV(b []byte) (uint16, []byte, bool) {
+	if len(b) < 4 {
+		return 0, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) < 4+length {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint16(b), b[4 : 4+length], true
+}
+
+// parseSubscription parses the data of a SUBSCRIBE TLV: an uncompressed name,
+// a type and a class.
+func parseSubscription(data []byte) (dns.Question, bool) {
+	name, off, err := dns.UnpackDomainName(data, 0)
+	if err != nil || len(data) != off+4 {
+		return dns.Question{}, false
+	}
+	return dns.Question{
+		Name:   name,
+		Qtype:  binary.BigEndian.Uint16(data[off:]),
+		Qclass: binary.BigEndian.Uint16(data[off+2:]),
+	}, true
+}
+
+// matchesQuestion reports whether rr answers q.
+func matchesQuestion(rr dns.RR, q dns.Question) bool {
+	hdr := rr.Header()
+	return wireName(hdr.Name) == wireName(q.Name) &&
+		(q.Qtype == dns.TypeANY || q.Qtype == hdr.Rrtype) &&
+		(q.Qclass == dns.ClassANY || q.Qclass == hdr.Class&^qClassCacheFlush)
+}
+
+// wireName returns name in the lower-case presentation format of its wire
+// format, so names received escaped, e.g. "My\ Service", and names built
+// from instance names compare equal.
+func wireName(name string) string {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	unpacked, _, err := dns.UnpackDomainName(buf[:n], 0)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(unpacked)
+}
+
+// containsRecord reports whether records holds rr, ignoring the TTL.
+func containsRecord(records []dns.RR, rr dns.RR) bool {
+	for _, r := range records {
+		if dns.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package zeroconf
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeDSO writes a DSO request with one TLV to a DNS Push session.
+func writeDSO(t *testing.T, conn net.Conn, id, tlvType uint16, data []byte) {
+	t.Helper()
+	msg := make([]byte, 2+12)
+	binary.BigEndian.PutUint16(msg[2:], id)
+	binary.BigEndian.PutUint16(msg[4:], dsoOpcode<<11)
+	msg = binary.BigEndian.AppendUint16(msg, tlvType)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	msg = append(msg, data...)
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readDSO reads a DSO message from a DNS Push session and returns its ID, its
+// flags and its TLV.
+func readDSO(t *testing.T, conn net.Conn) (id, flags, tlvType uint16, data []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	tlvType, data, _ = firstTLV(msg[12:])
+	return binary.BigEndian.Uint16(msg), binary.BigEndian.Uint16(msg[2:]), tlvType, data
+}
+
+// pushedRecords unpacks the records of a PUSH TLV.
+func pushedRecords(t *testing.T, data []byte) []dns.RR {
+	t.Helper()
+	var records []dns.RR
+	for off := 0; off < len(data); {
+		rr, next, err := dns.UnpackRR(data, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rr)
+		off = next
+	}
+	return records
+}
+
+// readPushedPTR reads a PUSH message holding a single PTR record.
+func readPushedPTR(t *testing.T, conn net.Conn) *dns.PTR {
+	t.Helper()
+	_, _, tlvType, data := readDSO(t, conn)
+	if tlvType != dsoPush {
+		t.Fatalf("TLV type %#x, want PUSH", tlvType)
+	}
+	records := pushedRecords(t, data)
+	if len(records) != 1 {
+		t.Fatalf("%d records pushed, want 1", len(records))
+	}
+	ptr, ok := records[0].(*dns.PTR)
+	if !ok {
+		t.Fatalf("pushed %v, want a PTR record", records[0])
+	}
+	return ptr
+}
+
+func TestPushServerSubscription(t *testing.T) {
+	s, events := registerVirtual(t, NewVirtualLink(), "192.0.2.1", "Printer", "printer", 631)
+	waitEvent(t, events, EventAnnounced)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPushServer(l)
+	defer p.Shutdown()
+	p.Publish(s)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	subscription := make([]byte, 256)
+	n, err := dns.PackDomainName("_test._tcp.local.", subscription, 0, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription = binary.BigEndian.AppendUint16(subscription[:n], dns.TypePTR)
+	subscription = binary.BigEndian.AppendUint16(subscription, dns.ClassINET)
+	writeDSO(t, conn, 1, dsoSubscribe, subscription)
+
+	id, flags, _, _ := readDSO(t, conn)
+	if id != 1 || flags&0x8000 == 0 || flags&0xF != dns.RcodeSuccess {
+		t.Fatalf("subscription answered with ID %d and flags %#x, want a successful response to 1", id, flags)
+	}
+
+	if ptr := readPushedPTR(t, conn); ptr.Ptr != "Printer._test._tcp.local." || ptr.Hdr.Ttl != s.ttl {
+		t.Errorf("pushed %v, want the PTR of Printer", ptr)
+	}
+	p.Withdraw(s)
+	if ptr := readPushedPTR(t, conn); ptr.Ptr != "Printer._test._tcp.local." || ptr.Hdr.Ttl != pushRemoveRecord {
+		t.Errorf("pushed %v, want the removal of the PTR of Printer", ptr)
+	}
+}
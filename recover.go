@@ -0,0 +1,36 @@
+package zeroconf
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// maxRestarts is the number of times a receive loop is restarted after a
+// panic, e.g. in the handling of a malformed message, before it is given up.
+const maxRestarts = 10
+
+// runRecovering runs loop until it returns, restarting it if it panics so a
+// long-running process keeps receiving. Panics are logged with their stack.
+func runRecovering(name string, loop func()) {
+	for restarts := 0; ; restarts++ {
+		if !runOnce(name, loop) {
+			return
+		}
+		if restarts == maxRestarts {
+			log.Printf("[ERR] zeroconf: %s panicked %d times, giving up", name, restarts+1)
+			return
+		}
+	}
+}
+
+// runOnce runs loop and reports whether it panicked.
+func runOnce(name string, loop func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[ERR] zeroconf: %s panicked: %v\n%s", name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+	loop()
+	return false
+}
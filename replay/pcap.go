@@ -0,0 +1,195 @@
+package replay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// mdnsPort is the UDP port of mDNS. Packets sent from or to it are replayed.
+const mdnsPort = 5353
+
+// maxRecordSize is the largest captured frame accepted, whatever snapshot
+// length a capture claims, so a corrupt length cannot make ReadPcap allocate
+// gigabytes.
+const maxRecordSize = 256 << 10
+
+// Link types of the captures ReadPcap understands.
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLoop      = 108
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+// Packet is an mDNS datagram read from a capture.
+type Packet struct {
+	Time time.Time
+	Src  *net.UDPAddr
+	Dst  *net.UDPAddr
+	Data []byte // The DNS message
+}
+
+// ReadPcap returns the mDNS packets, i.e. the UDP datagrams sent from or to
+// port 5353, of the capture in pcap format read from r, as written by tcpdump
+// -w or zeroconf.PcapWriter. Captures in pcapng format must be converted first,
+// e.g. with editcap -F pcap. Fragmented datagrams are skipped.
+func ReadPcap(r io.Reader) ([]Packet, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+	var (
+		order binary.ByteOrder
+		nanos bool
+	)
+	switch magic := binary.LittleEndian.Uint32(hdr); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, magic == 0x4d3cb2a1
+	case 0x0a0d0d0a:
+		return nil, fmt.Errorf("pcapng captures are not supported, convert with editcap -F pcap")
+	default:
+		return nil, fmt.Errorf("not a pcap capture")
+	}
+	snapLen := order.Uint32(hdr[16:])
+	if snapLen == 0 || snapLen > maxRecordSize {
+		// Some writers leave it unset or claim more than they capture.
+		snapLen = maxRecordSize
+	}
+	linkType := order.Uint32(hdr[20:]) & 0x0fffffff
+
+	var packets []Packet
+	rec := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return packets, nil
+			}
+			return nil, fmt.Errorf("failed to read pcap record: %v", err)
+		}
+		sec, frac := int64(order.Uint32(rec)), int64(order.Uint32(rec[4:]))
+		if !nanos {
+			frac *= 1000
+		}
+		inclLen := order.Uint32(rec[8:])
+		if inclLen > snapLen {
+			return nil, fmt.Errorf("pcap record of %d bytes exceeds the snapshot length of %d", inclLen, snapLen)
+		}
+		data := make([]byte, inclLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("failed to read pcap record: %v", err)
+		}
+		ip, ok := ipPayload(linkType, data, order)
+		if !ok {
+			continue
+		}
+		p, ok := udpPacket(ip)
+		if !ok {
+			continue
+		}
+		p.Time = time.Unix(sec, frac)
+		packets = append(packets, p)
+	}
+}
+
+// ipPayload strips the link layer header of a frame, returning the IP packet.
+func ipPayload(linkType uint32, frame []byte, order binary.ByteOrder) ([]byte, bool) {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return frame, true
+	case linkTypeNull, linkTypeLoop:
+		// The address family, in the byte order of the capturing host for
+		// NULL; the IP version in the packet tells it anyway.
+		if len(frame) < 4 {
+			return nil, false
+		}
+		return frame[4:], true
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+		etherType, off := binary.BigEndian.Uint16(frame[12:]), 14
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= off+4 {
+			// VLAN tags
+			etherType, off = binary.BigEndian.Uint16(frame[off+2:]), off+4
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+		return frame[off:], true
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		return frame[16:], true
+	case linkTypeLinuxSLL2:
+		if len(frame) < 20 {
+			return nil, false
+		}
+		return frame[20:], true
+	}
+	return nil, false
+}
+
+// udpPacket returns the mDNS datagram carried by an IP packet.
+func udpPacket(ip []byte) (Packet, bool) {
+	if len(ip) == 0 {
+		return Packet{}, false
+	}
+	var (
+		src, dst net.IP
+		udp      []byte
+	)
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return Packet{}, false
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		if ip[9] != 17 || len(ip) < ihl || binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 {
+			// Not UDP, or a fragment
+			return Packet{}, false
+		}
+		src, dst = net.IP(ip[12:16]), net.IP(ip[16:20])
+		udp = ip[ihl:]
+	case 6:
+		if len(ip) < 40 {
+			return Packet{}, false
+		}
+		src, dst = net.IP(ip[8:24]), net.IP(ip[24:40])
+		next, off := ip[6], 40
+		// Skip the hop-by-hop, routing and destination options headers.
+		for (next == 0 || next == 43 || next == 60) && len(ip) >= off+8 {
+			next, off = ip[off], off+8+int(ip[off+1])*8
+		}
+		if next != 17 || len(ip) < off {
+			return Packet{}, false
+		}
+		udp = ip[off:]
+	default:
+		return Packet{}, false
+	}
+
+	if len(udp) < 8 {
+		return Packet{}, false
+	}
+	sport, dport := int(binary.BigEndian.Uint16(udp)), int(binary.BigEndian.Uint16(udp[2:]))
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if sport != mdnsPort && dport != mdnsPort || length < 8 || length > len(udp) {
+		return Packet{}, false
+	}
+	return Packet{
+		Src:  &net.UDPAddr{IP: append(net.IP(nil), src...), Port: sport},
+		Dst:  &net.UDPAddr{IP: append(net.IP(nil), dst...), Port: dport},
+		Data: append([]byte(nil), udp[8:length]...),
+	}, true
+}
@@ -0,0 +1,90 @@
+// Package replay feeds captured mDNS traffic through the entry-building logic
+// of a zeroconf Resolver, to reproduce reports from the field offline:
+//
+//	f, _ := os.Open("capture.pcap")
+//	packets, err := replay.ReadPcap(f)
+//	...
+//	entries := make(chan *zeroconf.ServiceEntry)
+//	go func() {
+//		for entry := range entries {
+//			log.Println(entry)
+//		}
+//	}()
+//	err = replay.Browse(ctx, packets, "_http._tcp", "local.", entries)
+package replay
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/NullYing/zeroconf"
+)
+
+const (
+	// Address of the replaying resolver on its virtual link
+	replayAddr = "192.0.2.1"
+	// Time given to the resolver to process the last packet
+	settleTime = 100 * time.Millisecond
+	// Interval at which the progress of the resolver is polled
+	pollInterval = time.Millisecond
+)
+
+// mdnsGroup is the destination of the packets captured as multicast, of either
+// address family.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// Browse replays packets through a resolver browsing for service in domain,
+// which builds the entries exactly as on a live network, and sends them to
+// entries. The packets are replayed in order, each once the previous one was
+// received, rather than in capture time, so records do not expire meanwhile.
+// Browse returns once the last packet was processed or ctx is done; entries is
+// closed then.
+func Browse(ctx context.Context, packets []Packet, service, domain string, entries chan<- *zeroconf.ServiceEntry, opts ...zeroconf.QueryOption) error {
+	link := zeroconf.NewVirtualLink()
+	t, err := link.NewTransport(replayAddr)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	resolver, err := zeroconf.NewResolver(zeroconf.WithTransport(t))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := resolver.Browse(ctx, service, domain, nil, entries, opts...); err != nil {
+		return err
+	}
+
+	received := func() uint64 {
+		stats := resolver.Stats()
+		return stats.PacketsReceivedIPv4 + stats.PacketsReceivedIPv6
+	}
+	local := &net.UDPAddr{IP: net.ParseIP(replayAddr), Port: mdnsPort}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for _, p := range packets {
+		dst := local
+		if p.Dst == nil || p.Dst.IP.IsMulticast() {
+			dst = mdnsGroup
+		}
+		want := received() + 1
+		link.Inject(p.Src, dst, p.Data)
+		for received() < want {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(settleTime):
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Responder publishes any number of services through one set of sockets. Each
+// registration keeps its own probing, announcing and conflict handling, but
+// all of them share the multicast sockets and the receive loop, so a host
+// advertising many services does not bind and join once per service.
+//
+// The responder alone joins and leaves the multicast groups on the shared
+// sockets: its monitor joins the groups on interfaces that come up later, if
+// none were given, and hands them to the services, and joins them again when a
+// link is restored.
+type Responder struct {
+	transport *Transport
+	ifaces    []net.Interface
+	opts      []ServerOption
+
+	mu       sync.Mutex
+	services map[*Server]struct{}
+	closed   bool
+	done     chan struct{}
+}
+
+// NewResponder joins the mDNS multicast groups on the given interfaces, or on
+// all multicast interfaces if none are given. The options apply to all
+// services registered with the responder, before their own options.
+func NewResponder(ifaces []net.Interface, opts ...ServerOption) (*Responder, error) {
+	t, err := NewTransport(ifaces)
+	if err != nil {
+		return nil, err
+	}
+	r := &Responder{
+		transport: t,
+		ifaces:    ifaces,
+		opts:      opts,
+		services:  make(map[*Server]struct{}),
+		done:      make(chan struct{}),
+	}
+	go r.monitor(applyServerOpts(opts))
+	return r, nil
+}
+
+// monitor polls the interfaces like the monitor of a server does, on behalf of
+// all services, so the groups are joined once per interface.
+func (r *Responder) monitor(conf serverOpts) {
+	if conf.monitorInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(conf.monitorInterval)
+	defer ticker.Stop()
+
+	up := linkStates(r.transport.interfaces())
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		if len(r.ifaces) == 0 {
+			known := r.transport.interfaces()
+			for _, iface := range listMulticastInterfaces(conf.ifaceFilter) {
+				if hasInterface(known, iface.Index) || !r.transport.join(&iface, conf.connEvents) {
+					continue
+				}
+				log.Printf("[INFO] zeroconf: responder using new interface %s", iface.Name)
+				for _, s := range r.Services() {
+					s.adoptInterface(iface)
+				}
+			}
+		}
+		current := linkStates(r.transport.interfaces())
+		for index, isUp := range current {
+			if isUp && !up[index] {
+				// Memberships may be lost while the link was down.
+				if iface, err := net.InterfaceByIndex(index); err == nil {
+					r.transport.rejoin(iface, conf.connEvents)
+				}
+			}
+		}
+		up = current
+	}
+}
+
+// Transport returns the sockets of the responder, e.g. to share them with a
+// Resolver using WithTransport.
+func (r *Responder) Transport() *Transport {
+	return r.transport
+}
+
+// Register publishes a service like the package-level Register does. Shutting
+// the returned server down only withdraws this service.
+func (r *Responder) Register(instance, service, domain string, port int, text []string, opts ...ServerOption) (*Server, error) {
+	if err := r.checkOpen(); err != nil {
+		return nil, err
+	}
+	s, err := Register(instance, service, domain, port, text, r.ifaces, r.options(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.add(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RegisterProxyHosts publishes a service on behalf of other hosts like the
+// package-level RegisterProxyHosts does.
+func (r *Responder) RegisterProxyHosts(instance, service, domain string, port int, target string, hosts []ProxyHost, text []string, opts ...ServerOption) (*Server, error) {
+	if err := r.checkOpen(); err != nil {
+		return nil, err
+	}
+	s, err := RegisterProxyHosts(instance, service, domain, port, target, hosts, text, r.ifaces, r.options(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.add(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Services returns the services currently registered with the responder.
+func (r *Responder) Services() []*Server {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	services := make([]*Server, 0, len(r.services))
+	for s := range r.services {
+		services = append(services, s)
+	}
+	return services
+}
+
+// Unregister withdraws the service with the given instance name and service
+// type, e.g. "_http._tcp", while the other services keep running. Goodbyes are
+// sent for the records of the instance only; address records of a host name
+// still used by other services are kept. The instance name is the current one,
+// which differs from the registered one if the service was renamed.
+func (r *Responder) Unregister(instance, service string) error {
+	for _, s := range r.Services() {
+		s.mu.RLock()
+		match := strings.EqualFold(s.service.Instance, instance) && strings.EqualFold(s.service.Service, service)
+		s.mu.RUnlock()
+		if match {
+			return s.shutdown()
+		}
+	}
+	return fmt.Errorf("service %q of type %s is not registered", instance, service)
+}
+
+// Shutdown withdraws all services and closes the sockets.
+func (r *Responder) Shutdown() {
+	r.mu.Lock()
+	if !r.closed {
+		close(r.done)
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	for _, s := range r.Services() {
+		s.Shutdown()
+	}
+	r.transport.Close()
+}
+
+// options returns the options of a registration: the ones of the responder,
+// its transport and then the ones given.
+func (r *Responder) options(opts []ServerOption) []ServerOption {
+	all := append([]ServerOption{}, r.opts...)
+	all = append(all, WithServerTransport(r.transport), func(o *serverOpts) { o.responder = r })
+	return append(all, opts...)
+}
+
+// checkOpen fails if the responder was shut down.
+func (r *Responder) checkOpen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return fmt.Errorf("responder is shut down")
+	}
+	return nil
+}
+
+// add tracks a new registration, or withdraws it again if the responder was
+// shut down while it was being registered.
+func (r *Responder) add(s *Server) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		s.Shutdown()
+		return fmt.Errorf("responder is shut down")
+	}
+	if s.responder == nil {
+		// Native registrations do not pass through newServer.
+		s.responder = r
+	}
+	r.services[s] = struct{}{}
+	r.mu.Unlock()
+	return nil
+}
+
+// shares reports whether another registration than s publishes host, and
+// whether one publishes an instance of the service type, e.g.
+// "_http._tcp.local.".
+func (r *Responder) shares(s *Server, host, serviceType string) (sharedHost, sharedType bool) {
+	for _, other := range r.Services() {
+		if other == s {
+			continue
+		}
+		other.mu.RLock()
+		sharedHost = sharedHost || strings.EqualFold(other.service.HostName, host)
+		sharedType = sharedType || strings.EqualFold(other.service.ServiceName(), serviceType)
+		other.mu.RUnlock()
+	}
+	return sharedHost, sharedType
+}
+
+// remove stops tracking a registration that was shut down.
+func (r *Responder) remove(s *Server) {
+	r.mu.Lock()
+	delete(r.services, s)
+	r.mu.Unlock()
+}
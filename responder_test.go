@@ -0,0 +1,66 @@
+package zeroconf
+
+import (
+	"net"
+	"testing"
+)
+
+// newVirtualResponder returns a responder using a transport of the link.
+func newVirtualResponder(t *testing.T, link *VirtualLink, addr string) *Responder {
+	t.Helper()
+	tr, err := link.NewTransport(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Responder{
+		transport: tr,
+		opts:      []ServerOption{WithAnnouncements(1), WithInterfaceMonitor(0)},
+		services:  make(map[*Server]struct{}),
+		done:      make(chan struct{}),
+	}
+	t.Cleanup(r.Shutdown)
+	return r
+}
+
+// registerHost publishes a service of the host at 192.0.2.1 with r.
+func registerHost(r *Responder, instance, service string, port int) (*Server, error) {
+	hosts := []ProxyHost{{Name: "host", Addrs: []ProxyAddr{{IP: net.ParseIP("192.0.2.1")}}}}
+	return r.RegisterProxyHosts(instance, service, "local.", port, "host", hosts, nil)
+}
+
+func TestResponderServices(t *testing.T) {
+	r := newVirtualResponder(t, NewVirtualLink(), "192.0.2.1")
+	printer, err := registerHost(r, "Printer", "_ipp._tcp", 631)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registerHost(r, "Files", "_smb._tcp", 445); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(r.Services()); n != 2 {
+		t.Fatalf("%d services registered, want 2", n)
+	}
+	if printer.transport != r.Transport() {
+		t.Error("service does not use the transport of the responder")
+	}
+
+	if err := r.Unregister("Printer", "_ipp._tcp"); err != nil {
+		t.Fatal(err)
+	}
+	services := r.Services()
+	if len(services) != 1 || services[0].Instance() != "Files" {
+		t.Errorf("services after unregistering: %d, want Files only", len(services))
+	}
+	if err := r.Unregister("Printer", "_ipp._tcp"); err == nil {
+		t.Error("unregistering a withdrawn service succeeded")
+	}
+}
+
+func TestResponderShutdown(t *testing.T) {
+	r := newVirtualResponder(t, NewVirtualLink(), "192.0.2.1")
+	r.Shutdown()
+	s, err := registerHost(r, "Printer", "_ipp._tcp", 631)
+	if err == nil || s != nil {
+		t.Errorf("RegisterProxyHosts after shutdown = %v, %v, want no server and an error", s, err)
+	}
+}
@@ -0,0 +1,21 @@
+package zeroconf
+
+import (
+	"syscall"
+)
+
+// setReusePort 在Solaris/illumos系统上设置端口复用选项
+func setReusePort(c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		socketFd := int(fd)
+		// Solaris/illumos 没有 SO_REUSEPORT（Solaris 11.4 之前），但对于绑定到
+		// 多播地址的UDP套接字，SO_REUSEADDR 即允许多个进程绑定同一端口，
+		// 因此只需设置 SO_REUSEADDR 即可与其他mDNS守护进程共存
+		opErr = syscall.SetsockoptInt(socketFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
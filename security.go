@@ -0,0 +1,127 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SecurityEventKind classifies a SecurityEvent.
+type SecurityEventKind uint8
+
+// Kinds of SecurityEvent.
+const (
+	// RogueAnswer is raised when another host answers for a name we own.
+	RogueAnswer SecurityEventKind = iota
+	// ServiceTypeFlood is raised when a host advertises suspiciously many
+	// service types, a typical footprint of mDNS spoofing tools.
+	ServiceTypeFlood
+)
+
+func (k SecurityEventKind) String() string {
+	switch k {
+	case RogueAnswer:
+		return "rogue answer"
+	case ServiceTypeFlood:
+		return "service type flood"
+	}
+	return fmt.Sprintf("SecurityEventKind(%d)", uint8(k))
+}
+
+// SecurityEvent is reported through the server's error handler when the rogue
+// responder detector notices suspicious traffic.
+type SecurityEvent struct {
+	Kind  SecurityEventKind
+	Src   net.Addr // Host the suspicious records originated from
+	Name  string   // Name concerned, for RogueAnswer
+	RR    dns.RR   // Offending record, for RogueAnswer
+	Count int      // Number of service types seen, for ServiceTypeFlood
+}
+
+func (e *SecurityEvent) Error() string {
+	switch e.Kind {
+	case RogueAnswer:
+		return fmt.Sprintf("zeroconf: %s from %v for %s", e.Kind, e.Src, e.Name)
+	case ServiceTypeFlood:
+		return fmt.Sprintf("zeroconf: %s from %v: %d service types", e.Kind, e.Src, e.Count)
+	}
+	return fmt.Sprintf("zeroconf: %s from %v", e.Kind, e.Src)
+}
+
+// Service type counts are reset once they are older than this window.
+const rogueDetectionWindow = time.Minute
+
+// rogueDetector keeps track of the service types advertised per host.
+type rogueDetector struct {
+	maxServiceTypes int
+
+	mu    sync.Mutex
+	hosts map[string]*hostTypes
+}
+
+type hostTypes struct {
+	since    time.Time
+	types    map[string]struct{}
+	reported bool
+}
+
+func newRogueDetector(maxServiceTypes int) *rogueDetector {
+	return &rogueDetector{
+		maxServiceTypes: maxServiceTypes,
+		hosts:           make(map[string]*hostTypes),
+	}
+}
+
+// inspect looks at a response from another host and returns the security
+// events it raises.
+func (d *rogueDetector) inspect(s *Server, msg *dns.Msg, from net.Addr) []*SecurityEvent {
+	var events []*SecurityEvent
+	state := s.state.load()
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		if (state == stateRunning || state == stateAnnouncing) && s.isConflict(rr, from) {
+			events = append(events, &SecurityEvent{
+				Kind: RogueAnswer,
+				Src:  from,
+				Name: rr.Header().Name,
+				RR:   rr,
+			})
+		}
+		if ptr, ok := rr.(*dns.PTR); ok && strings.EqualFold(ptr.Hdr.Name, s.service.ServiceTypeName()) {
+			if n := d.countType(from, ptr.Ptr); n > 0 {
+				events = append(events, &SecurityEvent{
+					Kind:  ServiceTypeFlood,
+					Src:   from,
+					Count: n,
+				})
+			}
+		}
+	}
+	return events
+}
+
+// countType records that from advertised the service type t. It returns the
+// number of types seen if the host just exceeded the limit, zero otherwise.
+func (d *rogueDetector) countType(from net.Addr, t string) int {
+	host := from.String()
+	if udpAddr, ok := from.(*net.UDPAddr); ok {
+		host = udpAddr.IP.String()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.hosts[host]
+	if !ok || time.Since(h.since) > rogueDetectionWindow {
+		h = &hostTypes{since: time.Now(), types: make(map[string]struct{})}
+		d.hosts[host] = h
+	}
+	h.types[strings.ToLower(t)] = struct{}{}
+	if !h.reported && len(h.types) > d.maxServiceTypes {
+		h.reported = true
+		return len(h.types)
+	}
+	return 0
+}
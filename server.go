@@ -4,12 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -18,193 +18,1408 @@ import (
 )
 
 const (
-	// Number of Multicast responses sent for a query message (default: 1 < x < 9)
+	// Number of unsolicited announcements sent after probing (default: 1 < x < 9)
 	multicastRepetitions = 2
+	// Bounds for the number of announcements given by RFC6762 section 8.3
+	minAnnouncements = 2
+	maxAnnouncements = 8
+
+	// Number of goodbye packets sent on shutdown, their interval and the
+	// maximum time spent sending them
+	goodbyeRepetitions = 2
+	goodbyeInterval    = 250 * time.Millisecond
+	goodbyeTimeout     = 1 * time.Second
+
+	// Maximum time a single send may block, e.g. on a wedged interface
+	sendTimeout = 250 * time.Millisecond
+	// Number of failed sends in a row on an interface reported as an error
+	sendFailureLimit = 5
+
+	// Default TTL of the PTR records, as recommended by RFC6762 section 10
+	defaultTTL = 4500
+	// Maximum TTL in responses to legacy unicast queries
+	legacyUnicastTTL = 10
+	// Default TTL of the SRV, TXT and address records and of other records
+	// whose data include a host name
+	hostRecordTTL = 120
 )
 
-// Register a service by given arguments. This call will take the system's hostname
-// and lookup IP by that hostname.
-func Register(instance, service, domain string, port int, text []string, ifaces []net.Interface) (*Server, error) {
-	entry := NewServiceEntry(instance, service, domain)
-	entry.Port = port
-	entry.Text = text
+type serverOpts struct {
+	nameStore       NameStore
+	onRename        func(oldInstance, newInstance string)
+	onHostRename    func(oldHost, newHost string)
+	monitorInterval time.Duration
+	announcements   int
+	onError         func(error)
+	maxServiceTypes int
+	extraRecords    []dns.RR
+	aliases         []string
+	ptrTTL          uint32
+	recordTTL       uint32
+	delegate        questionDelegate
+	noCacheFlush    bool
+	hostName        string
+	transport       *Transport
+	responder       *Responder
+	queryHook       func(src net.Addr, q dns.Question) Action
+	queryInfoHook   func(src net.Addr, q dns.Question, unicast bool) Action
+	allowedAddrs    []string
+	recordHandler   func(q dns.Question) []dns.RR
+	onEvent         func(ServerEvent)
+	native          bool
+	ifaceHostNames  map[string]string
+	hostCPU         string
+	hostOS          string
+	peers           []string
+	autoRefresh     bool
+	ipTraffic       IPType
+	checkHopLimit   bool
+	ifaceFilter     func(net.Interface) bool
+	trafficClass    int
+	hopLimit        int
+	vrf             string
+	tap             func(CapturedPacket)
+	rejoinInterval  time.Duration
+	temporaryAddrs  bool
+	linkLocalOnly   bool
+	loopbackMode    bool
+	connEvents      connEvents
+}
 
-	if entry.Instance == "" {
-		return nil, fmt.Errorf("missing service instance name")
+// Action tells the server how to handle a question, see WithQueryHook.
+type Action int
+
+// Actions returned by query hooks.
+const (
+	ActionAnswer Action = iota // Answer the question as usual
+	ActionIgnore               // Do not answer the question
+)
+
+// questionDelegate answers questions for records the server publishes on behalf
+// of other hosts, and watches the responses seen on the network.
+type questionDelegate interface {
+	answer(q dns.Question, resp *dns.Msg)
+	observe(msg *dns.Msg, from net.Addr)
+}
+
+// ServerOption fills the option struct to configure a registered service.
+type ServerOption func(*serverOpts)
+
+// WithNameStore makes the server remember the names it finally claimed in the
+// given store. Stored names are loaded at registration time and take precedence
+// over the requested ones, so a device keeps its names across restarts.
+func WithNameStore(store NameStore) ServerOption {
+	return func(o *serverOpts) {
+		o.nameStore = store
 	}
-	if entry.Service == "" {
-		return nil, fmt.Errorf("missing service name")
+}
+
+// WithRenameHandler sets a function called whenever the service instance had to
+// be renamed because its name was already taken on the network.
+func WithRenameHandler(fn func(oldInstance, newInstance string)) ServerOption {
+	return func(o *serverOpts) {
+		o.onRename = fn
 	}
-	if entry.Domain == "" {
-		entry.Domain = "local."
+}
+
+// WithHostRenameHandler sets a function called whenever a host name had to be
+// renamed because it was already taken on the network: the host name of the
+// service, a host name set with WithInterfaceHostName, an alias or a host
+// published by a proxy registration. Names are fully qualified.
+func WithHostRenameHandler(fn func(oldHost, newHost string)) ServerOption {
+	return func(o *serverOpts) {
+		o.onHostRename = fn
 	}
-	if entry.Port == 0 {
-		return nil, fmt.Errorf("missing port")
+}
+
+// WithInterfaceMonitor sets the interval at which the server polls the link
+// state of its interfaces, in order to verify its names again after a network
+// partition healed. A zero interval disables the monitor. Defaults to 5 seconds.
+func WithInterfaceMonitor(interval time.Duration) ServerOption {
+	return func(o *serverOpts) {
+		o.monitorInterval = interval
+	}
+}
+
+// WithAnnouncements sets the number of unsolicited announcements sent once the
+// names have been claimed. The first two are sent one second apart, each
+// following interval doubles. The value is clamped to the range 2 to 8 allowed
+// by RFC6762; sending more improves discovery on lossy networks.
+func WithAnnouncements(n int) ServerOption {
+	return func(o *serverOpts) {
+		o.announcements = n
+	}
+}
+
+// WithErrorHandler sets a function called with errors occurring in the
+// background, such as security events raised by the rogue responder detector.
+func WithErrorHandler(fn func(error)) ServerOption {
+	return func(o *serverOpts) {
+		o.onError = fn
+	}
+}
+
+// WithRogueDetection enables the rogue responder detector. It raises a
+// SecurityEvent when another host answers for names we own once registered, or
+// when a host advertises more than maxServiceTypes service types within a
+// minute. Events are reported through the error handler.
+func WithRogueDetection(maxServiceTypes int) ServerOption {
+	return func(o *serverOpts) {
+		o.maxServiceTypes = maxServiceTypes
+	}
+}
+
+// WithExtraRecords adds arbitrary records, e.g. vendor specific TXT records at
+// another name, HINFO or URI records, to the additional section of the
+// announcements and responses of the service. Questions for these records are
+// answered as well. Records without a TTL get the TTL of the service.
+func WithExtraRecords(records ...dns.RR) ServerOption {
+	return func(o *serverOpts) {
+		o.extraRecords = append(o.extraRecords, records...)
+	}
+}
+
+// WithAliases publishes CNAME records pointing from each alias to the host
+// name of the service, e.g. "printer.local." for "brn123456.local.". The domain
+// is appended to aliases if missing. Aliases are unique names: they are probed
+// before being announced, and renamed like host names on conflicts.
+func WithAliases(aliases ...string) ServerOption {
+	return func(o *serverOpts) {
+		o.aliases = append(o.aliases, aliases...)
+	}
+}
+
+// WithPTRTTL sets the TTL of the PTR records, 4500 seconds by default. Kiosks
+// and other long-lived services may use longer TTLs to reduce traffic.
+func WithPTRTTL(ttl uint32) ServerOption {
+	return func(o *serverOpts) {
+		o.ptrTTL = ttl
+	}
+}
+
+// WithRecordTTL sets the TTL of the SRV, TXT, A and AAAA records, 120 seconds
+// by default. Short-lived services may use shorter TTLs so their records expire
+// quickly from caches if they disappear without sending goodbyes.
+func WithRecordTTL(ttl uint32) ServerOption {
+	return func(o *serverOpts) {
+		o.recordTTL = ttl
+	}
+}
+
+// WithoutCacheFlush clears the cache-flush bit on all records. By default it
+// is set on the unique records (SRV, TXT, A, AAAA, NSEC and CNAME) in
+// announcements and responses, as required by RFC6762 section 10.2. Only use
+// this for legacy clients which fail to parse the bit.
+func WithoutCacheFlush() ServerOption {
+	return func(o *serverOpts) {
+		o.noCacheFlush = true
+	}
+}
+
+// WithHostName sets the host name the service is published on, instead of the
+// one of the system. This is useful in containers and on appliances whose
+// kernel host name is meaningless. The domain is appended if missing, e.g.
+// "printer" becomes "printer.local.".
+func WithHostName(host string) ServerOption {
+	return func(o *serverOpts) {
+		o.hostName = host
+	}
+}
+
+// WithServerTransport makes the server send and receive through the sockets of
+// a shared Transport instead of opening its own, so resolvers in the same
+// process can use them as well.
+func WithServerTransport(t *Transport) ServerOption {
+	return func(o *serverOpts) {
+		o.transport = t
+	}
+}
+
+// WithQueryHook calls fn for every question received from another host before
+// it is answered. Applications may use it to log queries, rate-limit senders or
+// ignore known-abusive scanners by returning ActionIgnore. fn is called from the
+// receive loop and must not block.
+func WithQueryHook(fn func(src net.Addr, q dns.Question) Action) ServerOption {
+	return func(o *serverOpts) {
+		o.queryHook = fn
+	}
+}
+
+// WithQueryInfoHook is like WithQueryHook, and also tells fn whether the query
+// was addressed to us by unicast rather than to the multicast group, which is
+// useful for diagnostics. Both hooks may be set.
+func WithQueryInfoHook(fn func(src net.Addr, q dns.Question, unicast bool) Action) ServerOption {
+	return func(o *serverOpts) {
+		o.queryInfoHook = fn
+	}
+}
+
+// WithAllowedAddrs restricts the published addresses to the given ones instead
+// of every address of the selected interfaces. Each entry is either an IP
+// address, e.g. "192.168.1.10", or a CIDR prefix, e.g. "10.0.0.0/8". This keeps
+// virtual and overlay addresses of servers out of the advertisement. Proxy
+// registrations publish their given addresses regardless; the restriction
+// applies to the interface addresses of a target given without any.
+func WithAllowedAddrs(addrs ...string) ServerOption {
+	return func(o *serverOpts) {
+		o.allowedAddrs = append(o.allowedAddrs, addrs...)
+	}
+}
+
+// WithRecordHandler sets a function synthesizing answers dynamically, e.g.
+// per-tenant TXT records or computed URI records. Once the service is published,
+// it is called for every question not ignored by the query hook, and the records
+// it returns are answered along with ours: the server still decides between
+// unicast and multicast, applies rate limiting and builds the packets. Records
+// without a TTL get the TTL of the service, records without a class the class
+// IN. fn is called from the receive loop and must not block.
+func WithRecordHandler(fn func(q dns.Question) []dns.RR) ServerOption {
+	return func(o *serverOpts) {
+		o.recordHandler = fn
+	}
+}
+
+// WithEventHandler sets a function called on every step of the lifecycle of the
+// service: when its names are probed, once they were announced, on conflicts
+// and renames, and when it is shut down. Applications may use it to display the
+// registration status. fn is called from the server's goroutines and must not
+// block.
+func WithEventHandler(fn func(ServerEvent)) ServerOption {
+	return func(o *serverOpts) {
+		o.onEvent = fn
+	}
+}
+
+// WithNativeBackend registers the service through the DNS-SD API of the
+// operating system, DnsServiceRegister on Windows 10 and later or mDNSResponder
+// on macOS (which requires cgo), instead of answering queries on port 5353
+// itself. This avoids sharing the port with the system's mDNS responder. The
+// system then probes, announces and resolves conflicts; SetText, SetPort and
+// Rename register the service again, while features relying on our own
+// sockets, e.g. Pause and ForceAnnounce, return an error. On Windows only the
+// first address of each family is registered; on macOS the service is
+// published under the system's host name and addresses. Register fails on
+// systems without such an API.
+func WithNativeBackend() ServerOption {
+	return func(o *serverOpts) {
+		o.native = true
+	}
+}
+
+// WithInterfaceHostName publishes the service on the interface with the given
+// name under host instead of the main host name, e.g. "nas-iot" on the IoT VLAN
+// while the other interfaces use "nas". The SRV target and the address records
+// sent on that interface use host, and questions for it are only answered
+// there. The domain is appended if missing. Proxy registrations, whose SRV
+// target is given, fail with this option.
+func WithInterfaceHostName(iface, host string) ServerOption {
+	return func(o *serverOpts) {
+		if o.ifaceHostNames == nil {
+			o.ifaceHostNames = make(map[string]string)
+		}
+		o.ifaceHostNames[iface] = host
+	}
+}
+
+// WithHostInfo publishes an HINFO record with the given CPU and operating
+// system strings for the host name, as mDNSResponder does, e.g. "arm64" and
+// "Linux". Inventory tools browsing the network use it to identify devices.
+func WithHostInfo(cpu, os string) ServerOption {
+	return func(o *serverOpts) {
+		o.hostCPU, o.hostOS = cpu, os
+	}
+}
+
+// WithUnicastPeers additionally sends the announcements and goodbyes of the
+// service by unicast to the given peers, e.g. hosts across a WireGuard tunnel
+// multicast does not pass. Peers are IP addresses, with port 5353 unless given
+// as "host:port".
+func WithUnicastPeers(addrs ...string) ServerOption {
+	return func(o *serverOpts) {
+		o.peers = append(o.peers, addrs...)
+	}
+}
+
+// WithAutoRefresh makes the server announce its records again shortly before
+// their TTL expires, at 80% of the shortest TTL, for reflectors and caches
+// which drop expired records instead of querying for them.
+func WithAutoRefresh() ServerOption {
+	return func(o *serverOpts) {
+		o.autoRefresh = true
+	}
+}
+
+// WithIPTraffic restricts the server to IPv4 or IPv6, e.g. IPv6 for an
+// IPv6-only mode on hosts without IPv4: the sockets of the other family are
+// not opened and its addresses are not published. Register fails if no
+// interface of the selected family could be joined. Defaults to IPv4AndIPv6.
+func WithIPTraffic(t IPType) ServerOption {
+	return func(o *serverOpts) {
+		o.ipTraffic = t
+	}
+}
+
+// WithServerHopLimitCheck drops mDNS packets whose IP TTL or hop limit is not 255,
+// i.e. which did not originate on the local link (RFC6762 section 11). Queries
+// of legacy resolvers, which may use a lower TTL, and packets whose TTL the
+// system does not report are accepted.
+func WithServerHopLimitCheck() ServerOption {
+	return func(o *serverOpts) {
+		o.checkHopLimit = true
+	}
+}
+
+// WithServerInterfaceFilter restricts the interfaces used when none are given
+// to those for which fn returns true, e.g. to skip point-to-point links or
+// interfaces with a small MTU. It also applies to interfaces picked up by the
+// interface monitor.
+func WithServerInterfaceFilter(fn func(net.Interface) bool) ServerOption {
+	return func(o *serverOpts) {
+		o.ifaceFilter = fn
+	}
+}
+
+// WithServerTrafficClass sets the IPv4 TOS and IPv6 traffic class of the
+// packets sent, e.g. 0xc0 for DSCP CS6 on networks prioritizing control
+// traffic. The DSCP value takes the upper six bits. Sockets shared through
+// WithServerTransport are left alone.
+func WithServerTrafficClass(tc int) ServerOption {
+	return func(o *serverOpts) {
+		o.trafficClass = tc
+	}
+}
+
+// WithServerMulticastTTL sets the IPv4 TTL and IPv6 hop limit of the packets
+// sent, e.g. for lab networks where reflectors forward mDNS between segments.
+// RFC6762 requires 255, the default; resolvers checking the TTL drop other
+// values. Sockets shared through WithServerTransport are left alone.
+func WithServerMulticastTTL(ttl int) ServerOption {
+	return func(o *serverOpts) {
+		o.hopLimit = ttl
+	}
+}
+
+// WithServerVRF binds the server's sockets to the VRF master device with the
+// given name, e.g. on routers and appliances separating networks with VRFs.
+// Unless interfaces are given, the server uses the interfaces enslaved to the
+// VRF, including those the interface monitor picks up later. Linux only.
+func WithServerVRF(name string) ServerOption {
+	return func(o *serverOpts) {
+		o.vrf = name
+	}
+}
+
+// WithServerPacketTap sets a function receiving a copy of every datagram the
+// server sends or receives, e.g. to write it to a PcapWriter or a channel. It
+// is called from the sending and receiving goroutines and should not block.
+func WithServerPacketTap(fn func(CapturedPacket)) ServerOption {
+	return func(o *serverOpts) {
+		o.tap = fn
+	}
+}
+
+// WithServerGroupRejoin enables a health task which sends the multicast group
+// joins again at the given interval and warns about interfaces on which no
+// packet of another host arrived meanwhile. It repairs memberships some Wi-Fi
+// drivers and access points silently drop, without re-registering the service.
+// Sockets shared through WithServerTransport are left alone. Disabled by
+// default.
+func WithServerGroupRejoin(interval time.Duration) ServerOption {
+	return func(o *serverOpts) {
+		o.rejoinInterval = interval
+	}
+}
+
+// WithTemporaryAddrs sets whether temporary IPv6 addresses (RFC 4941 privacy
+// extensions) and deprecated addresses are published. They are left out by
+// default, as they rotate away within hours while clients cache the records.
+// The flags are known on Linux and Windows only, elsewhere every address is
+// published.
+func WithTemporaryAddrs(include bool) ServerOption {
+	return func(o *serverOpts) {
+		o.temporaryAddrs = include
+	}
+}
+
+// WithLinkLocalOnly restricts the published addresses to link-local ones,
+// 169.254.0.0/16 and fe80::/10, so routable addresses are never exposed, e.g.
+// while provisioning a device over a direct connection. Registration fails if
+// no interface has such an address.
+func WithLinkLocalOnly(enable bool) ServerOption {
+	return func(o *serverOpts) {
+		o.linkLocalOnly = enable
+	}
+}
+
+// WithServerLoopbackMode makes the server join the multicast groups on the
+// loopback interface only and publish its loopback addresses, so resolvers in
+// other processes on the same host find the service without any external
+// network, e.g. in CI and tests. See WithLoopbackMode. Interfaces selected
+// explicitly take precedence.
+func WithServerLoopbackMode(enable bool) ServerOption {
+	return func(o *serverOpts) {
+		o.loopbackMode = enable
+	}
+}
+
+// WithServerConnEvents makes the server deliver the changes of its sockets and
+// multicast memberships to ch, e.g. groups joined on new interfaces, read and
+// send errors, so daemons can log and alert on network problems. Events are
+// dropped while ch is full. Read errors of sockets shared through
+// WithServerTransport are not reported.
+func WithServerConnEvents(ch chan<- ConnEvent) ServerOption {
+	return func(o *serverOpts) {
+		o.connEvents = ch
+	}
+}
+
+func applyServerOpts(options []ServerOption) serverOpts {
+	conf := serverOpts{
+		monitorInterval: defaultMonitorInterval,
+		announcements:   multicastRepetitions,
+		ipTraffic:       IPv4AndIPv6,
+	}
+	for _, o := range options {
+		if o != nil {
+			o(&conf)
+		}
+	}
+	if conf.vrf != "" {
+		conf.ifaceFilter = vrfFilter(conf.vrf, conf.ifaceFilter)
+	}
+	if conf.announcements < minAnnouncements {
+		conf.announcements = minAnnouncements
+	} else if conf.announcements > maxAnnouncements {
+		conf.announcements = maxAnnouncements
+	}
+	return conf
+}
+
+// Register a service by given arguments. This call will take the system's hostname
+// and lookup IP by that hostname. The service gets sockets of its own; use a
+// Responder to publish several services through shared ones.
+func Register(instance, service, domain string, port int, text []string, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
+	conf := applyServerOpts(opts)
+	if domain == "" {
+		domain = "local."
+	}
+	entry := NewServiceEntry(instance, service, domain)
+	entry.Port = port
+
+	if err := validateEntry(entry); err != nil {
+		return nil, err
 	}
 
 	var err error
+	if entry.Text, err = splitTXT(text); err != nil {
+		return nil, err
+	}
+	if conf.hostName != "" {
+		if err := validateHostName(conf.hostName); err != nil {
+			return nil, err
+		}
+		entry.HostName = conf.hostName
+	}
 	if entry.HostName == "" {
 		entry.HostName, err = os.Hostname()
 		if err != nil {
 			return nil, fmt.Errorf("could not determine host")
 		}
 	}
-
-	if !strings.HasSuffix(trimDot(entry.HostName), entry.Domain) {
-		entry.HostName = fmt.Sprintf("%s.%s.", trimDot(entry.HostName), trimDot(entry.Domain))
+	entry.HostName = qualifyHostName(entry.HostName, entry.Domain)
+	ifaceHostNames := make(map[string]string, len(conf.ifaceHostNames))
+	for iface, host := range conf.ifaceHostNames {
+		if err := validateHostName(host); err != nil {
+			return nil, err
+		}
+		ifaceHostNames[iface] = qualifyHostName(host, entry.Domain)
+	}
+	allowed, err := parseAllowedAddrs(conf.allowedAddrs)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := parsePeers(conf.peers)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+	// Servers of a responder follow the interfaces its monitor picks up.
+	followResponder := len(ifaces) == 0 && conf.responder != nil
+	if len(ifaces) == 0 && conf.transport != nil {
+		ifaces = conf.transport.interfaces()
+	}
+	if len(ifaces) == 0 && conf.loopbackMode {
+		if ifaces = loopbackInterfaces(); len(ifaces) == 0 {
+			return nil, fmt.Errorf("no loopback interface is up")
+		}
+		if conf.ipTraffic == IPv4AndIPv6 && !loopbackMulticast6(ifaces) {
+			conf.ipTraffic = IPv4
+		}
+	}
+	autoIfaces := len(ifaces) == 0
+	if autoIfaces {
+		ifaces = listMulticastInterfaces(conf.ifaceFilter)
 	}
 
 	for _, iface := range ifaces {
-		v4, v6 := addrsForInterface(&iface)
-		entry.AddrIPv4 = append(entry.AddrIPv4, v4...)
-		entry.AddrIPv6 = append(entry.AddrIPv6, v6...)
+		v4, v6 := addrsForInterface(&iface, conf.temporaryAddrs, conf.linkLocalOnly)
+		if conf.ipTraffic&IPv4 > 0 {
+			entry.AddrIPv4 = append(entry.AddrIPv4, filterIPs(v4, allowed)...)
+		}
+		if conf.ipTraffic&IPv6 > 0 {
+			entry.AddrIPv6 = append(entry.AddrIPv6, filterIPs(v6, allowed)...)
+		}
 	}
 
 	if entry.AddrIPv4 == nil && entry.AddrIPv6 == nil {
+		if conf.linkLocalOnly {
+			return nil, fmt.Errorf("could not determine link-local host IP addresses")
+		}
 		return nil, fmt.Errorf("could not determine host IP addresses")
 	}
+	if conf.native {
+		return registerNative(entry, conf)
+	}
 
-	s, err := newServer(ifaces)
+	s, err := newServer(ifaces, conf)
 	if err != nil {
 		return nil, err
 	}
 
+	s.autoIfaces = autoIfaces || followResponder
+	s.allowedAddrs = allowed
+	s.ifaceHostNames = ifaceHostNames
+	s.peers = peers
 	s.service = entry
+	s.setAliases(conf.aliases)
+	s.loadNames()
 	go s.mainloop()
 	go s.probe()
+	go s.monitorInterfaces()
+	go s.refresh()
+	if s.health != nil {
+		go s.health.run(s.shouldShutdown, s.interfaces, s.rejoinGroups)
+	}
 
 	return s, nil
 }
 
 // RegisterProxy registers a service proxy. This call will skip the hostname/IP lookup and
 // will use the provided values.
-func RegisterProxy(instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface) (*Server, error) {
+func RegisterProxy(instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
+	proxy := ProxyHost{Name: host}
+	for _, ip := range ips {
+		ipAddr := net.ParseIP(ip)
+		if ipAddr == nil {
+			return nil, fmt.Errorf("failed to parse given IP: %v", ip)
+		}
+		proxy.Addrs = append(proxy.Addrs, ProxyAddr{IP: ipAddr})
+	}
+	return RegisterProxyHosts(instance, service, domain, port, host, []ProxyHost{proxy}, text, ifaces, opts...)
+}
+
+// ProxyHost is a host a proxy registration publishes address records for.
+type ProxyHost struct {
+	Name  string      // Host name, the domain is appended if missing
+	Addrs []ProxyAddr // Addresses of the host
+}
+
+// ProxyAddr is an address published for a ProxyHost.
+type ProxyAddr struct {
+	IP  net.IP
+	TTL uint32 // TTL of the address record, the record TTL of the server if zero
+}
+
+// RegisterProxyHosts registers a service on behalf of other devices. The SRV
+// record points to target, and address records are published for every given
+// host, each address with its own TTL. This lets gateways advertise services of
+// devices which do not speak mDNS themselves.
+func RegisterProxyHosts(instance, service, domain string, port int, target string, hosts []ProxyHost, text []string, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
+	conf := applyServerOpts(opts)
+	if domain == "" {
+		domain = "local."
+	}
 	entry := NewServiceEntry(instance, service, domain)
 	entry.Port = port
-	entry.Text = text
-	entry.HostName = host
+	entry.HostName = target
 
-	if entry.Instance == "" {
-		return nil, fmt.Errorf("missing service instance name")
+	if err := validateEntry(entry); err != nil {
+		return nil, err
 	}
-	if entry.Service == "" {
-		return nil, fmt.Errorf("missing service name")
+	var err error
+	if entry.Text, err = splitTXT(text); err != nil {
+		return nil, err
 	}
 	if entry.HostName == "" {
 		return nil, fmt.Errorf("missing host name")
 	}
-	if entry.Domain == "" {
-		entry.Domain = "local"
+	if entry.Domain == "" {
+		entry.Domain = "local"
+	}
+	entry.HostName = qualifyHostName(entry.HostName, entry.Domain)
+
+	var proxyHosts []ProxyHost
+	for _, host := range hosts {
+		if host.Name == "" {
+			return nil, fmt.Errorf("missing host name")
+		}
+		proxy := ProxyHost{Name: qualifyHostName(host.Name, entry.Domain)}
+		for _, addr := range host.Addrs {
+			if addr.IP.To4() == nil && addr.IP.To16() == nil {
+				return nil, fmt.Errorf("the IP is neither IPv4 nor IPv6: %#v", addr.IP)
+			}
+			proxy.Addrs = append(proxy.Addrs, addr)
+			if proxy.Name != entry.HostName {
+				continue
+			}
+			if ipv4 := addr.IP.To4(); ipv4 != nil {
+				entry.AddrIPv4 = append(entry.AddrIPv4, addr.IP)
+			} else {
+				entry.AddrIPv6 = append(entry.AddrIPv6, addr.IP)
+			}
+		}
+		proxyHosts = append(proxyHosts, proxy)
+	}
+	if len(conf.ifaceHostNames) > 0 {
+		// The SRV record points to the given target on every interface.
+		return nil, fmt.Errorf("interface host names are not supported by proxy registrations")
+	}
+	allowed, err := parseAllowedAddrs(conf.allowedAddrs)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := parsePeers(conf.peers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers of a responder follow the interfaces its monitor picks up.
+	followResponder := len(ifaces) == 0 && conf.responder != nil
+	if len(ifaces) == 0 && conf.transport != nil {
+		ifaces = conf.transport.interfaces()
+	}
+	if len(ifaces) == 0 && conf.loopbackMode {
+		if ifaces = loopbackInterfaces(); len(ifaces) == 0 {
+			return nil, fmt.Errorf("no loopback interface is up")
+		}
+		if conf.ipTraffic == IPv4AndIPv6 && !loopbackMulticast6(ifaces) {
+			conf.ipTraffic = IPv4
+		}
+	}
+	autoIfaces := len(ifaces) == 0
+	if autoIfaces {
+		ifaces = listMulticastInterfaces(conf.ifaceFilter)
+	}
+
+	s, err := newServer(ifaces, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	s.autoIfaces = autoIfaces || followResponder
+	s.allowedAddrs = allowed
+	s.peers = peers
+	s.service = entry
+	s.proxyHosts = proxyHosts
+	s.setAliases(conf.aliases)
+	s.loadNames()
+	go s.mainloop()
+	go s.probe()
+	go s.monitorInterfaces()
+	go s.refresh()
+	if s.health != nil {
+		go s.health.run(s.shouldShutdown, s.interfaces, s.rejoinGroups)
+	}
+
+	return s, nil
+}
+
+// qualifyHostName appends the domain to host unless it already ends with it.
+func qualifyHostName(host, domain string) string {
+	if !strings.HasSuffix(trimDot(host), trimDot(domain)) {
+		return fmt.Sprintf("%s.%s.", trimDot(host), trimDot(domain))
+	}
+	return dns.Fqdn(host)
+}
+
+// validateHostName checks that host is a valid DNS host name: dot-separated
+// labels of at most 63 letters, digits and hyphens, not starting or ending with
+// a hyphen.
+func validateHostName(host string) error {
+	name := trimDot(host)
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid host name %q", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid host name %q", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid host name %q: invalid character %q", host, c)
+			}
+		}
+	}
+	return nil
+}
+
+// validateEntry checks that the entry holds everything needed to register it.
+func validateEntry(entry *ServiceEntry) error {
+	if entry.Instance == "" {
+		return fmt.Errorf("missing service instance name")
+	}
+	if entry.Service == "" {
+		return fmt.Errorf("missing service name")
+	}
+	if entry.Port == 0 {
+		return fmt.Errorf("missing port")
+	}
+	// From RFC6763
+	// 4.1.1.  Instance Names
+	//
+	//    The <Instance> portion of the Service Instance Name is a user-
+	//    friendly name consisting of arbitrary Net-Unicode text [RFC5198]. It
+	//    MUST NOT contain ASCII control characters (byte values 0x00-0x1F and
+	//    0x7F) [RFC20] [...] This portion of the name is limited to 63
+	//    octets.
+	if len(entry.Instance) > 63 {
+		return fmt.Errorf("instance name %q exceeds 63 bytes", entry.Instance)
+	}
+	for _, c := range []byte(entry.Instance) {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("instance name %q contains control character %#x", entry.Instance, c)
+		}
+	}
+	if err := validateServiceType(entry.Service); err != nil {
+		return err
+	}
+	for _, subtype := range entry.Subtypes {
+		label := strings.SplitN(subtype, "._sub.", 2)[0]
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid subtype %q", label)
+		}
+	}
+	if entry.Domain != "" {
+		if err := validateHostName(entry.Domain); err != nil {
+			return fmt.Errorf("invalid domain %q", entry.Domain)
+		}
+	}
+	return nil
+}
+
+// validateServiceType checks a service type like "_http._tcp" against
+// RFC6763 section 7: an underscore followed by 1-15 letters, digits and
+// hyphens, and "_tcp" or "_udp" as protocol.
+func validateServiceType(service string) error {
+	labels := strings.Split(trimDot(service), ".")
+	if len(labels) != 2 {
+		return fmt.Errorf("invalid service type %q: expected \"_name._tcp\" or \"_name._udp\"", service)
+	}
+	name, proto := labels[0], strings.ToLower(labels[1])
+	if proto != "_tcp" && proto != "_udp" {
+		return fmt.Errorf("invalid service type %q: protocol must be _tcp or _udp", service)
+	}
+	if !strings.HasPrefix(name, "_") || len(name) < 2 || len(name) > 16 {
+		return fmt.Errorf("invalid service type %q: name must be an underscore followed by 1-15 characters", service)
+	}
+	name = name[1:]
+	hasLetter := false
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			hasLetter = true
+		case c >= '0' && c <= '9' || c == '-':
+		default:
+			return fmt.Errorf("invalid service type %q: invalid character %q", service, c)
+		}
+	}
+	if !hasLetter || name[0] == '-' || name[len(name)-1] == '-' || strings.Contains(name, "--") {
+		return fmt.Errorf("invalid service type %q: name must contain a letter and no leading, trailing or double hyphens", service)
+	}
+	return nil
+}
+
+const (
+	qClassCacheFlush uint16 = 1 << 15
+)
+
+// Server structure encapsulates both IPv4/IPv6 UDP connections
+type Server struct {
+	// mu guards the fields of service which may change at runtime. Records
+	// are composed with the read lock held, so every packet is consistent.
+	mu       sync.RWMutex
+	service  *ServiceEntry
+	ipv4conn *ipv4.PacketConn
+	ipv6conn *ipv6.PacketConn
+
+	// ifaces is replaced, never modified in place, when interfaces are added
+	// at runtime; use interfaces to read it.
+	ifacesMu   sync.Mutex
+	ifaces     []net.Interface
+	autoIfaces bool // Whether interfaces appearing at runtime are used as well
+
+	shouldShutdown chan struct{}
+	shutdownLock   sync.Mutex
+	shutdownEnd    sync.WaitGroup
+	isShutdown     bool
+	ttl            uint32 // TTL of the PTR records
+	hostTTL        uint32 // TTL of the SRV, TXT and address records
+
+	nameStore NameStore
+	nameKey   string
+	conflicts int
+
+	state     atomicState
+	probeLock sync.Mutex
+	conflict  chan string
+	// Signaled when a simultaneous probe for our names wins the tiebreak
+	tiebreakLost chan struct{}
+	onRename     func(oldInstance, newInstance string)
+	onHostRename func(oldHost, newHost string)
+	// Times of the conflicts detected while probing within the last
+	// conflictWindow, guarded by probeLock
+	recentConflicts []time.Time
+	// When conflicts for our names were last defended, by lower-case name
+	defenseMu sync.Mutex
+	defended  map[string]time.Time
+
+	monitorInterval time.Duration
+	announcements   int
+
+	onError func(error)
+	onEvent func(ServerEvent)
+	rogue   *rogueDetector
+
+	// Hosts published by proxy registrations, replacing the service's addresses
+	proxyHosts []ProxyHost
+	// Additional records published along with the service
+	extraRecords []dns.RR
+	// Fully qualified alias names of the host name
+	aliases []string
+	// Answers questions for records of other hosts, if any
+	delegate questionDelegate
+	// Whether the cache-flush bit is cleared on unique records
+	noCacheFlush bool
+	// Sockets the connections belong to, closed on shutdown if owned
+	transport     *Transport
+	ownsTransport bool
+	// Decides whether questions are answered, if set
+	queryHook     func(src net.Addr, q dns.Question) Action
+	queryInfoHook func(src net.Addr, q dns.Question, unicast bool) Action
+	// Networks the published addresses are restricted to, if any
+	allowedAddrs []*net.IPNet
+	// Fully qualified host names replacing the host name on some interfaces,
+	// by interface name
+	ifaceHostNames map[string]string
+	// CPU and operating system published in an HINFO record, if set
+	hostCPU, hostOS string
+	// Addresses announcements are also sent to by unicast
+	peers []*net.UDPAddr
+	// Deadline for all sends in Unix nanoseconds, zero if none
+	writeLimit atomic.Int64
+	// Failed sends in a row, and packet sizes learned from packets rejected as
+	// too large, by interface index
+	sendMu       sync.Mutex
+	sendFailures map[int]int
+	packetLimits map[int]int
+	// Whether the records are announced again before their TTL expires
+	autoRefresh bool
+	// Address families the server uses
+	ipTraffic IPType
+	// Whether packets from other links are dropped
+	checkHopLimit bool
+	// Whether temporary and deprecated IPv6 addresses are published
+	temporaryAddrs bool
+	// Whether only link-local addresses are published
+	linkLocalOnly bool
+	// Receives the changes of the sockets and memberships, if set
+	connEvents connEvents
+	// Restricts the interfaces picked automatically, if set
+	ifaceFilter func(net.Interface) bool
+	// Receives a copy of the datagrams sent and received, if set
+	tap func(CapturedPacket)
+	// Sends the group joins again periodically, if set
+	health *groupHealth
+	// Synthesizes answers to questions, if set
+	recordHandler func(q dns.Question) []dns.RR
+	// Responder the service is registered with, if any
+	responder *Responder
+
+	multicasts *multicastTracker
+	stats      serverStats
+
+	// Sequence number of the EDNS0 Owner option in sleep proxy registrations
+	sleepProxySeq atomic.Uint32
+	// DNS Push servers publishing the service, guarded by mu
+	pushServers map[*PushServer]struct{}
+	// Registration with the DNS-SD API of the system, if used instead of our
+	// own sockets
+	native *nativeService
+}
+
+// Constructs server structure
+// A server without a shared transport gets one of its own, which is closed on
+// shutdown.
+func newServer(ifaces []net.Interface, opts serverOpts) (*Server, error) {
+	t, owned := opts.transport, false
+	if t == nil {
+		if opts.vrf != "" {
+			if err := checkVRF(opts.vrf); err != nil {
+				return nil, err
+			}
+			if len(ifaces) == 0 {
+				return nil, fmt.Errorf("no multicast interface enslaved to VRF %s", opts.vrf)
+			}
+		}
+		co := applyConnOpts(nil)
+		co.vrf = opts.vrf
+		co.events = opts.connEvents
+		var err error
+		if t, err = newTransport(ifaces, opts.ipTraffic, co); err != nil {
+			return nil, err
+		}
+		owned = true
+		if opts.trafficClass != 0 {
+			setTrafficClass(t.ipv4conn, t.ipv6conn, opts.trafficClass)
+		}
+		if opts.hopLimit != 0 {
+			setHopLimit(t.ipv4conn, t.ipv6conn, opts.hopLimit)
+		}
+	}
+	ipv4conn, ipv6conn := t.ipv4conn, t.ipv6conn
+	if opts.ipTraffic&IPv4 == 0 {
+		ipv4conn = nil
+	}
+	if opts.ipTraffic&IPv6 == 0 {
+		ipv6conn = nil
+	}
+	if ipv4conn == nil && ipv6conn == nil && !t.virtual() {
+		if owned {
+			t.Close()
+		}
+		return nil, fmt.Errorf("transport has no socket for the selected IP traffic")
+	}
+
+	s := &Server{
+		ipv4conn:       ipv4conn,
+		ipv6conn:       ipv6conn,
+		transport:      t,
+		ownsTransport:  owned,
+		ifaces:         ifaces,
+		ttl:            defaultTTL,
+		hostTTL:        hostRecordTTL,
+		shouldShutdown: make(chan struct{}),
+		nameStore:      opts.nameStore,
+		conflict:       make(chan string, 1),
+		tiebreakLost:   make(chan struct{}, 1),
+		defended:       make(map[string]time.Time),
+		onRename:       opts.onRename,
+		onHostRename:   opts.onHostRename,
+
+		monitorInterval: opts.monitorInterval,
+		announcements:   opts.announcements,
+		onError:         opts.onError,
+		onEvent:         opts.onEvent,
+		extraRecords:    opts.extraRecords,
+		delegate:        opts.delegate,
+		noCacheFlush:    opts.noCacheFlush,
+		queryHook:       opts.queryHook,
+		queryInfoHook:   opts.queryInfoHook,
+		recordHandler:   opts.recordHandler,
+		hostCPU:         opts.hostCPU,
+		hostOS:          opts.hostOS,
+		autoRefresh:     opts.autoRefresh,
+		ipTraffic:       opts.ipTraffic,
+		checkHopLimit:   opts.checkHopLimit,
+		temporaryAddrs:  opts.temporaryAddrs,
+		linkLocalOnly:   opts.linkLocalOnly,
+		connEvents:      opts.connEvents,
+		ifaceFilter:     opts.ifaceFilter,
+		tap:             opts.tap,
+		multicasts:      newMulticastTracker(),
+		responder:       opts.responder,
+	}
+	// A shared transport keeps the groups joined while any user holds them.
+	// The holds of an own transport are the server's.
+	if !owned {
+		t.hold(ifaces)
+	}
+	s.setTTLs(opts)
+	if opts.rejoinInterval > 0 && owned {
+		s.health = newGroupHealth(opts.rejoinInterval)
+	}
+	if opts.maxServiceTypes > 0 {
+		s.rogue = newRogueDetector(opts.maxServiceTypes)
+	}
+	return s, nil
+}
+
+// loadNames replaces the requested names of the service by the ones stored in
+// the name store, if any, and records the names in use.
+func (s *Server) loadNames() {
+	if s.nameStore == nil {
+		return
+	}
+	s.nameKey = s.service.ServiceInstanceName()
+	rec, ok, err := s.nameStore.Load(s.nameKey)
+	if err != nil {
+		log.Printf("[WARN] zeroconf: failed to load stored names: %v", err)
+		return
+	}
+	if ok {
+		if rec.Instance != "" {
+			s.service.setInstance(rec.Instance)
+		}
+		if rec.HostName != "" {
+			s.service.HostName = rec.HostName
+		}
+		s.conflicts = rec.Conflicts
+	}
+	s.saveNames()
+}
+
+// saveNames records the names currently claimed by the service in the name store.
+func (s *Server) saveNames() {
+	if s.nameStore == nil {
+		return
+	}
+	s.mu.RLock()
+	rec := NameRecord{
+		Instance:  s.service.Instance,
+		HostName:  s.service.HostName,
+		Conflicts: s.conflicts,
+	}
+	s.mu.RUnlock()
+	if err := s.nameStore.Save(s.nameKey, rec); err != nil {
+		log.Printf("[WARN] zeroconf: failed to store names: %v", err)
+	}
+}
+
+// setAliases qualifies the given aliases with the domain of the service.
+func (s *Server) setAliases(aliases []string) {
+	for _, alias := range aliases {
+		s.aliases = append(s.aliases, qualifyHostName(alias, s.service.Domain))
+	}
+}
+
+// reportError passes err to the error handler, if any.
+func (s *Server) reportError(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// Start listeners and waits for the shutdown signal from exit channel
+func (s *Server) mainloop() {
+	go runRecovering("server receiver", s.recvTransport)
+}
+
+// Shutdown closes all udp connections and unregisters the service
+func (s *Server) Shutdown() {
+	s.shutdown()
+}
+
+// Membership returns the interfaces the mDNS multicast groups were joined on,
+// and those on which joining failed, e.g. to warn that a VPN interface never
+// joined. With a shared transport it covers all users of the transport. It is
+// empty with the native backend, which manages its own sockets.
+func (s *Server) Membership() Membership {
+	if s.native != nil {
+		return Membership{}
+	}
+	return s.transport.Membership()
+}
+
+// Stats returns a snapshot of the server's traffic counters.
+func (s *Server) Stats() ServerStats {
+	return s.stats.snapshot()
+}
+
+// Instance returns the instance name currently claimed by the service. It
+// differs from the registered one if the service was renamed due to a conflict.
+func (s *Server) Instance() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.service.Instance
+}
+
+// HostName returns the host name currently claimed by the service.
+func (s *Server) HostName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.service.HostName
+}
+
+// SetText atomically replaces the TXT record and announces the change with the
+// cache-flush bit set, repeated like the initial announcements. Strings longer
+// than 255 bytes are split; text exceeding the maximum TXT record size is
+// rejected and reported to the error handler.
+func (s *Server) SetText(text []string) {
+	text, err := splitTXT(text)
+	if err != nil {
+		s.reportError(err)
+		return
+	}
+	s.mu.Lock()
+	s.service.Text = text
+	s.mu.Unlock()
+	if s.native != nil {
+		if err := s.nativeRegister(); err != nil {
+			s.reportError(err)
+		}
+		return
+	}
+	go s.reannounce(func(int) []dns.RR { return s.textRecords() })
+}
+
+// SetPort changes the port of the service and announces the updated SRV
+// record with the cache-flush bit set, repeated like the initial announcements.
+func (s *Server) SetPort(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	s.mu.Lock()
+	s.service.Port = port
+	s.mu.Unlock()
+	if s.native != nil {
+		return s.nativeRegister()
+	}
+	go s.reannounce(s.srvRecords)
+	return nil
+}
+
+// SetSubtypes replaces the subtypes of the service at runtime, e.g.
+// "_universal". Goodbye packets are sent for the PTR records of the removed
+// subtypes only, while the rest of the registration stays live, and the added
+// subtypes are announced.
+func (s *Server) SetSubtypes(subtypes ...string) error {
+	for _, subtype := range subtypes {
+		if label := trimDot(subtype); label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid subtype %q", subtype)
+		}
+	}
+	s.mu.Lock()
+	old := s.service.Subtypes
+	var names []string
+	for _, subtype := range subtypes {
+		names = append(names, fmt.Sprintf("%s._sub.%s", trimDot(subtype), s.service.ServiceName()))
+	}
+	s.service.Subtypes = names
+	removed, added := missingNames(old, names), missingNames(names, old)
+	s.mu.Unlock()
+	if s.native != nil {
+		return s.nativeRegister()
+	}
+
+	if len(removed) > 0 && s.state.load() == stateRunning {
+		s.recordsChanged()
+		for _, intf := range s.interfaces() {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			s.mu.RLock()
+			resp.Answer = s.subtypeRecords(removed, 0)
+			s.mu.RUnlock()
+			s.stats.goodbyesSent.Add(1)
+			if err := s.multicastResponse(resp, intf.Index); err != nil {
+				log.Println("[ERR] zeroconf: failed to send goodbye:", err.Error())
+			}
+		}
 	}
-	if entry.Port == 0 {
-		return nil, fmt.Errorf("missing port")
+	if len(added) > 0 {
+		go s.reannounce(func(int) []dns.RR { return s.subtypeRecords(added, s.ttl) })
 	}
+	return nil
+}
 
-	if !strings.HasSuffix(trimDot(entry.HostName), entry.Domain) {
-		entry.HostName = fmt.Sprintf("%s.%s.", trimDot(entry.HostName), trimDot(entry.Domain))
+// subtypeRecords returns the PTR records of the given subtype names pointing to
+// the service instance.
+func (s *Server) subtypeRecords(subtypes []string, ttl uint32) []dns.RR {
+	var records []dns.RR
+	for _, subtype := range subtypes {
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   subtype,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ptr: s.service.ServiceInstanceName(),
+		})
 	}
+	return records
+}
 
-	for _, ip := range ips {
-		ipAddr := net.ParseIP(ip)
-		if ipAddr == nil {
-			return nil, fmt.Errorf("failed to parse given IP: %v", ip)
-		} else if ipv4 := ipAddr.To4(); ipv4 != nil {
-			entry.AddrIPv4 = append(entry.AddrIPv4, ipAddr)
-		} else if ipv6 := ipAddr.To16(); ipv6 != nil {
-			entry.AddrIPv6 = append(entry.AddrIPv6, ipAddr)
-		} else {
-			return nil, fmt.Errorf("the IP is neither IPv4 nor IPv6: %#v", ipAddr)
+// missingNames returns the names of a which are not in b.
+func missingNames(a, b []string) []string {
+	var missing []string
+	for _, name := range a {
+		found := false
+		for _, other := range b {
+			if strings.EqualFold(name, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, name)
 		}
 	}
+	return missing
+}
 
-	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+// Rename changes the instance name of the service at runtime. Goodbye packets
+// are sent for the records of the old instance, then the new name is probed and
+// announced. If the new name is taken, it is changed like on any conflict. A
+// paused service stays paused; the new name is probed once it is resumed.
+func (s *Server) Rename(instance string) error {
+	if instance == "" {
+		return fmt.Errorf("missing service instance name")
+	}
+	if s.native != nil {
+		s.mu.Lock()
+		s.service.setInstance(instance)
+		s.mu.Unlock()
+		s.saveNames()
+		return s.nativeRegister()
+	}
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+
+	if state := s.state.load(); state == stateRunning || state == stateAnnouncing {
+		resp := new(dns.Msg)
+		resp.MsgHdr.Response = true
+		s.mu.RLock()
+		resp.Answer = s.instanceRecords(0)
+		s.mu.RUnlock()
+		s.stats.goodbyesSent.Add(uint64(len(s.interfaces())))
+		if err := s.multicastResponse(resp, 0); err != nil {
+			return err
+		}
 	}
 
-	s, err := newServer(ifaces)
-	if err != nil {
-		return nil, err
-	}
+	s.mu.Lock()
+	s.service.setInstance(instance)
+	s.mu.Unlock()
+	s.saveNames()
 
-	s.service = entry
-	go s.mainloop()
+	if s.state.load() == statePaused {
+		return nil
+	}
+	s.state.store(stateProbing)
 	go s.probe()
-
-	return s, nil
+	return nil
 }
 
-const (
-	qClassCacheFlush uint16 = 1 << 15
-)
-
-// Server structure encapsulates both IPv4/IPv6 UDP connections
-type Server struct {
-	service  *ServiceEntry
-	ipv4conn *ipv4.PacketConn
-	ipv6conn *ipv6.PacketConn
-	ifaces   []net.Interface
+// Pause withdraws the service from the network without closing the sockets:
+// goodbye packets are sent for its records and queries are no longer answered
+// until Resume is called.
+func (s *Server) Pause() error {
+	if s.native != nil {
+		return errNativeBackend
+	}
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
 
-	shouldShutdown chan struct{}
-	shutdownLock   sync.Mutex
-	shutdownEnd    sync.WaitGroup
-	isShutdown     bool
-	ttl            uint32
+	if s.state.load() == statePaused {
+		return nil
+	}
+	err := s.unregister()
+	s.state.store(statePaused)
+	s.recordsChanged()
+	return err
 }
 
-// Constructs server structure
-func newServer(ifaces []net.Interface) (*Server, error) {
-	ipv4conn, err4 := joinUdp4Multicast(ifaces)
-	if err4 != nil {
-		log.Printf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
+// Resume publishes a paused service again. Its names are probed first, since
+// another host may have claimed them meanwhile, then its records are announced.
+// Resuming a service which is not paused does nothing.
+func (s *Server) Resume() {
+	if !s.state.compareAndSwap(statePaused, stateProbing) {
+		return
 	}
-	ipv6conn, err6 := joinUdp6Multicast(ifaces)
-	if err6 != nil {
-		log.Printf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
+	go s.probe()
+}
+
+// ForceAnnounce multicasts all records of the service once on all interfaces,
+// e.g. to speed up discovery after a network glitch. Records multicast during
+// the last second are left out, as RFC6762 section 6 forbids sending them more
+// often. It fails if the service is not published, i.e. while probing or
+// paused.
+func (s *Server) ForceAnnounce() error {
+	if s.native != nil {
+		return errNativeBackend
 	}
-	if err4 != nil && err6 != nil {
-		// No supported interface left.
-		return nil, fmt.Errorf("no supported interface")
+	if state := s.state.load(); state != stateRunning && state != stateAnnouncing {
+		return fmt.Errorf("service is not published")
 	}
-
-	s := &Server{
-		ipv4conn:       ipv4conn,
-		ipv6conn:       ipv6conn,
-		ifaces:         ifaces,
-		ttl:            3200,
-		shouldShutdown: make(chan struct{}),
+	var err error
+	for _, intf := range s.interfaces() {
+		resp := new(dns.Msg)
+		resp.MsgHdr.Response = true
+		resp.Compress = true
+		s.mu.RLock()
+		s.composeLookupAnswers(resp, s.ttl, intf.Index)
+		s.mu.RUnlock()
+		resp.Answer = s.multicasts.withoutRecent(resp.Answer, intf.Index, minMulticastInterval)
+		if len(resp.Answer) == 0 {
+			continue
+		}
+		if e := s.multicastResponse(resp, intf.Index); e != nil {
+			err = e
+		}
 	}
-
-	return s, nil
+	return err
 }
 
-// Start listeners and waits for the shutdown signal from exit channel
-func (s *Server) mainloop() {
-	if s.ipv4conn != nil {
-		go s.recv4(s.ipv4conn)
+// SetTextMap is like SetText, taking the TXT record as key/value pairs. The
+// strings are sorted by key.
+func (s *Server) SetTextMap(kv map[string]string) {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
 	}
-	if s.ipv6conn != nil {
-		go s.recv6(s.ipv6conn)
+	sort.Strings(keys)
+	text := make([]string, 0, len(keys))
+	for _, k := range keys {
+		text = append(text, k+"="+kv[k])
 	}
+	s.SetText(text)
 }
 
-// Shutdown closes all udp connections and unregisters the service
-func (s *Server) Shutdown() {
-	s.shutdown()
+// TTL sets the TTL for DNS replies. It applies to all records; use WithPTRTTL
+// and WithRecordTTL to configure them separately.
+func (s *Server) TTL(ttl uint32) {
+	s.ttl = ttl
+	s.hostTTL = ttl
 }
 
-// SetText updates and announces the TXT records
-func (s *Server) SetText(text []string) {
-	s.service.Text = text
-	s.announceText()
+// uniqueClass returns the class of our unique records: IN, with the cache-flush
+// bit set unless disabled. Shared records, i.e. PTR records, always use the
+// plain IN class.
+func (s *Server) uniqueClass() uint16 {
+	if s.noCacheFlush {
+		return dns.ClassINET
+	}
+	return dns.ClassINET | qClassCacheFlush
 }
 
-// TTL sets the TTL for DNS replies
-func (s *Server) TTL(ttl uint32) {
-	s.ttl = ttl
+// setTTLs applies the TTLs configured by the options.
+func (s *Server) setTTLs(opts serverOpts) {
+	if opts.ptrTTL > 0 {
+		s.ttl = opts.ptrTTL
+	}
+	if opts.recordTTL > 0 {
+		s.hostTTL = opts.recordTTL
+	}
+}
+
+// recordTTL returns the TTL of the records owned by the service instance and
+// the host name: zero for goodbyes, i.e. if ttl is zero, the configured record
+// TTL otherwise.
+func (s *Server) recordTTL(ttl uint32) uint32 {
+	if ttl == 0 {
+		return 0
+	}
+	return s.hostTTL
 }
 
 // Shutdown server will close currently open connections & channel
@@ -214,97 +1429,123 @@ func (s *Server) shutdown() error {
 	if s.isShutdown {
 		return errors.New("server is already shutdown")
 	}
+	s.notify(ServerEvent{Type: EventShuttingDown})
+	if s.native != nil {
+		err := s.native.close()
+		close(s.shouldShutdown)
+		s.isShutdown = true
+		return err
+	}
 
 	err := s.unregister()
+	for _, p := range s.publishers() {
+		p.Withdraw(s)
+	}
 
 	close(s.shouldShutdown)
 
-	if s.ipv4conn != nil {
-		s.ipv4conn.Close()
-	}
-	if s.ipv6conn != nil {
-		s.ipv6conn.Close()
+	// Shared sockets are closed by their owner; the server only lets go of
+	// the groups it held on them.
+	if s.ownsTransport {
+		s.transport.Close()
+	} else {
+		for _, iface := range s.interfaces() {
+			s.leaveGroups(&iface)
+		}
 	}
 
 	// Wait for connection and routines to be closed
 	s.shutdownEnd.Wait()
 	s.isShutdown = true
+	if s.responder != nil {
+		s.responder.remove(s)
+	}
 
 	return err
 }
 
-// recv is a long running routine to receive packets from an interface
-func (s *Server) recv4(c *ipv4.PacketConn) {
-	if c == nil {
-		return
-	}
-	buf := make([]byte, 65536)
+// recvTransport receives the packets of the shared transport.
+func (s *Server) recvTransport() {
+	packets, unsubscribe := s.transport.subscribe()
+	defer unsubscribe()
 	s.shutdownEnd.Add(1)
 	defer s.shutdownEnd.Done()
 	for {
 		select {
 		case <-s.shouldShutdown:
 			return
-		default:
-			var ifIndex int
-			n, cm, from, err := c.ReadFrom(buf)
-			if err != nil {
-				continue
+		case p, ok := <-packets:
+			if !ok {
+				return
 			}
-			if cm != nil {
-				ifIndex = cm.IfIndex
+			capturePacket(s.tap, false, p.info.ifIndex, p.from, p.info.dstAddr(), p.data)
+			if s.health != nil {
+				s.health.seen(p.info.ifIndex, p.from)
 			}
-			_ = s.parsePacket(buf[:n], ifIndex, from)
-		}
-	}
-}
-
-// recv is a long running routine to receive packets from an interface
-func (s *Server) recv6(c *ipv6.PacketConn) {
-	if c == nil {
-		return
-	}
-	buf := make([]byte, 65536)
-	s.shutdownEnd.Add(1)
-	defer s.shutdownEnd.Done()
-	for {
-		select {
-		case <-s.shouldShutdown:
-			return
-		default:
-			var ifIndex int
-			n, cm, from, err := c.ReadFrom(buf)
-			if err != nil {
+			// Legacy resolvers may send multicast queries with a low TTL.
+			if s.checkHopLimit && !isOnLink(p.info.ttl) && !isLegacyQuery(p.from) {
+				s.stats.offLinkDrops.Add(1)
 				continue
 			}
-			if cm != nil {
-				ifIndex = cm.IfIndex
-			}
-			_ = s.parsePacket(buf[:n], ifIndex, from)
+			_ = s.parsePacket(p.data, p.info, p.from)
 		}
 	}
 }
 
 // parsePacket is used to parse an incoming packet
-func (s *Server) parsePacket(packet []byte, ifIndex int, from net.Addr) error {
+func (s *Server) parsePacket(packet []byte, info packetInfo, from net.Addr) error {
 	var msg dns.Msg
 	if err := msg.Unpack(packet); err != nil {
 		// log.Printf("[ERR] zeroconf: Failed to unpack packet: %v", err)
 		return err
 	}
-	return s.handleQuery(&msg, ifIndex, from)
+	if msg.Response {
+		s.handleResponse(&msg, from)
+		if s.delegate != nil {
+			s.delegate.observe(&msg, from)
+		}
+		return nil
+	}
+	ifIndex := info.ifIndex
+	if ifIndex == 0 {
+		// No control message, e.g. on Windows: guess from the source.
+		ifIndex = s.interfaceFor(from)
+	}
+	if ifIndex != 0 && !s.servesInterface(ifIndex) {
+		// Do not answer on segments the service is not registered on.
+		return nil
+	}
+	return s.handleQuery(&msg, ifIndex, from, info.unicast())
 }
 
-// handleQuery is used to handle an incoming query
-func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
-	// Ignore questions with authoritative section for now
-	if len(query.Ns) > 0 {
-		return nil
+// handleQuery is used to handle an incoming query. unicast tells whether it
+// was addressed to us rather than to the multicast group.
+func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr, unicast bool) error {
+	// Probes carry the records they intend to claim in the authority
+	// section. Once our names are claimed, probes for them are answered to
+	// defend them, while probing ourselves the tie is broken.
+	isProbe := len(query.Ns) > 0
+	if isProbe {
+		switch s.state.load() {
+		case stateRunning, stateAnnouncing:
+		case stateProbing:
+			s.tiebreak(query)
+			return nil
+		default:
+			return nil
+		}
 	}
 
 	// Handle each question
 	var err error
+	s.stats.questionsReceived.Add(uint64(len(query.Question)))
 	for _, q := range query.Question {
+		if s.queryHook != nil && s.queryHook(from, q) == ActionIgnore {
+			continue
+		}
+		if s.queryInfoHook != nil && s.queryInfoHook(from, q, unicast) == ActionIgnore {
+			continue
+		}
 		resp := dns.Msg{}
 		resp.SetReply(query)
 		resp.Compress = true
@@ -313,22 +1554,55 @@ func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
 		resp.Question = nil // RFC6762 section 6 "responses MUST NOT contain any questions"
 		resp.Answer = []dns.RR{}
 		resp.Extra = []dns.RR{}
-		if err = s.handleQuestion(q, &resp, query, ifIndex); err != nil {
+		s.mu.RLock()
+		err = s.handleQuestion(q, &resp, query, ifIndex)
+		s.mu.RUnlock()
+		if err != nil {
 			// log.Printf("[ERR] zeroconf: failed to handle question %v: %v", q, err)
 			continue
 		}
+		resp.Answer = append(resp.Answer, s.handlerAnswers(q)...)
 		// Check if there is an answer
 		if len(resp.Answer) == 0 {
 			continue
 		}
 
-		if isUnicastQuestion(q) {
+		if isLegacyQuery(from) {
+			// Answer one-shot resolvers directly, like a unicast DNS server
+			legacyResponse(&resp, q)
+			s.stats.unicastResponses.Add(1)
+			if e := s.unicastResponse(&resp, ifIndex, from); e != nil {
+				err = e
+			}
+		} else if isUnicastQuestion(q) && s.multicasts.recentlyMulticast(resp.Answer, ifIndex) {
+			// From RFC6762
+			//    [...] if the responder has not multicast that record recently
+			//    (within one quarter of its TTL), then the responder SHOULD
+			//    instead multicast the response so as to keep all the peer
+			//    caches up to date
 			// Send unicast
+			s.stats.unicastResponses.Add(1)
 			if e := s.unicastResponse(&resp, ifIndex, from); e != nil {
 				err = e
 			}
 		} else {
+			// From RFC6762
+			//    A Multicast DNS responder MUST NOT multicast a record on a
+			//    given interface until at least one second has elapsed since
+			//    the last time that record was multicast on that particular
+			//    interface. [...] The one exception is that a Multicast DNS
+			//    responder MUST respond quickly (within 250 ms) to probe
+			//    queries
+			interval := minMulticastInterval
+			if isProbe {
+				interval = probeInterval
+			}
+			resp.Answer = s.multicasts.withoutRecent(resp.Answer, ifIndex, interval)
+			if len(resp.Answer) == 0 {
+				continue
+			}
 			// Send mulicast
+			s.stats.multicastResponses.Add(1)
 			if e := s.multicastResponse(&resp, ifIndex); e != nil {
 				err = e
 			}
@@ -355,7 +1629,7 @@ func isKnownAnswer(resp *dns.Msg, query *dns.Msg) bool {
 			continue
 		}
 		ptr := known.(*dns.PTR)
-		if ptr.Ptr == answer.Ptr && hdr.Ttl >= answer.Hdr.Ttl/2 {
+		if strings.EqualFold(ptr.Ptr, answer.Ptr) && hdr.Ttl >= answer.Hdr.Ttl/2 {
 			// log.Printf("skipping known answer: %v", ptr)
 			return true
 		}
@@ -364,39 +1638,98 @@ func isKnownAnswer(resp *dns.Msg, query *dns.Msg) bool {
 	return false
 }
 
+// removeKnownAnswers drops the PTR records listed in the known-answer section
+// of query with at least half their TTL remaining.
+func removeKnownAnswers(answers []dns.RR, query *dns.Msg) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range answers {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok || !isKnownPTR(ptr, query) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// isKnownPTR reports whether ptr is in the known-answer section of query.
+func isKnownPTR(ptr *dns.PTR, query *dns.Msg) bool {
+	for _, known := range query.Answer {
+		k, ok := known.(*dns.PTR)
+		if ok && strings.EqualFold(k.Hdr.Name, ptr.Hdr.Name) && strings.EqualFold(k.Ptr, ptr.Ptr) && k.Hdr.Ttl >= ptr.Hdr.Ttl/2 {
+			return true
+		}
+	}
+	return false
+}
+
 // handleQuestion is used to handle an incoming question
 func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, query *dns.Msg, ifIndex int) error {
 	if s.service == nil {
 		return nil
 	}
+	// Our records are not ours until probing succeeded, and not published
+	// while paused.
+	if state := s.state.load(); state == stateProbing || state == stateConflict || state == statePaused {
+		return nil
+	}
 
-	switch q.Name {
-	case s.service.ServiceTypeName():
+	if strings.EqualFold(q.Name, s.service.ServiceTypeName()) {
+		// Service type enumeration lists the types of our service and of
+		// the services we publish on behalf of other hosts.
+		if q.Qtype != dns.TypePTR && q.Qtype != dns.TypeANY {
+			return nil
+		}
 		s.serviceTypeName(resp, s.ttl)
-		if isKnownAnswer(resp, query) {
-			resp.Answer = nil
+		if s.delegate != nil {
+			s.delegate.answer(q, resp)
 		}
+		resp.Answer = removeKnownAnswers(resp.Answer, query)
+		return nil
+	}
 
-	case s.service.ServiceName():
+	switch {
+	case strings.EqualFold(q.Name, s.service.ServiceName()):
 		s.composeBrowsingAnswers(resp, ifIndex)
 		if isKnownAnswer(resp, query) {
 			resp.Answer = nil
 		}
 
-	case s.service.ServiceInstanceName():
-		s.composeLookupAnswers(resp, s.ttl, ifIndex, false)
+	case strings.EqualFold(q.Name, s.service.ServiceInstanceName()):
+		s.composeLookupAnswers(resp, s.ttl, ifIndex)
+		resp.Extra = append(resp.Extra, s.instanceNSEC(s.ttl))
+		resp.Extra = append(resp.Extra, s.hostNSEC(s.hostName(ifIndex), resp.Answer, s.ttl))
+
+	case strings.EqualFold(q.Name, s.hostName(ifIndex)):
+		s.composeHostAnswers(resp, q.Name, q.Qtype, ifIndex)
+
 	default:
+		if s.isAlias(q.Name) {
+			s.composeAliasAnswers(resp, q.Name, ifIndex)
+			break
+		}
+		if s.isProxyHost(q.Name) {
+			s.composeHostAnswers(resp, q.Name, q.Qtype, ifIndex)
+			break
+		}
+		if s.composeExtraAnswers(resp, q) {
+			break
+		}
 		// handle matching subtype query
 		for _, subtype := range s.service.Subtypes {
-			subtype = fmt.Sprintf("%s._sub.%s", subtype, s.service.ServiceName())
-			if q.Name == subtype {
-				s.composeBrowsingAnswers(resp, ifIndex)
+			if strings.EqualFold(q.Name, subtype) {
+				// The subtype PTR, not the one of the service type,
+				// answers the question.
+				resp.Answer = append(resp.Answer, s.subtypeRecords([]string{subtype}, s.ttl)...)
+				s.composeBrowsingExtras(resp, ifIndex)
 				if isKnownAnswer(resp, query) {
 					resp.Answer = nil
 				}
 				break
 			}
 		}
+		if len(resp.Answer) == 0 && s.delegate != nil {
+			s.delegate.answer(q, resp)
+		}
 	}
 
 	return nil
@@ -413,13 +1746,18 @@ func (s *Server) composeBrowsingAnswers(resp *dns.Msg, ifIndex int) {
 		Ptr: s.service.ServiceInstanceName(),
 	}
 	resp.Answer = append(resp.Answer, ptr)
+	s.composeBrowsingExtras(resp, ifIndex)
+}
 
+// composeBrowsingExtras appends the records a browser resolves the instance
+// with to the additional section of an answer to a browsing question.
+func (s *Server) composeBrowsingExtras(resp *dns.Msg, ifIndex int) {
 	txt := &dns.TXT{
 		Hdr: dns.RR_Header{
 			Name:   s.service.ServiceInstanceName(),
 			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
+			Class:  s.uniqueClass(),
+			Ttl:    s.hostTTL,
 		},
 		Txt: s.service.Text,
 	}
@@ -427,80 +1765,261 @@ func (s *Server) composeBrowsingAnswers(resp *dns.Msg, ifIndex int) {
 		Hdr: dns.RR_Header{
 			Name:   s.service.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
+			Class:  s.uniqueClass(),
+			Ttl:    s.hostTTL,
+		},
+		Priority: 0,
+		Weight:   0,
+		Port:     uint16(s.service.Port),
+		Target:   s.hostName(ifIndex),
+	}
+	resp.Extra = append(resp.Extra, srv, txt)
+
+	resp.Extra = s.appendAddrs(resp.Extra, s.ttl, ifIndex)
+	resp.Extra = s.appendExtraRecords(resp.Extra, s.ttl)
+}
+
+func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int) {
+	// From RFC6762
+	//    The most significant bit of the rrclass for a record in the Answer
+	//    Section of a response message is the Multicast DNS cache-flush bit
+	//    and is discussed in more detail below in Section 10.2, "Announcements
+	//    to Flush Outdated Cache Entries".
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   s.service.ServiceName(),
+			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
+			Ttl:    ttl,
+		},
+		Ptr: s.service.ServiceInstanceName(),
+	}
+	srv := &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   s.service.ServiceInstanceName(),
+			Rrtype: dns.TypeSRV,
+			Class:  s.uniqueClass(),
+			Ttl:    s.recordTTL(ttl),
 		},
 		Priority: 0,
 		Weight:   0,
 		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
+		Target:   s.hostName(ifIndex),
+	}
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   s.service.ServiceInstanceName(),
+			Rrtype: dns.TypeTXT,
+			Class:  s.uniqueClass(),
+			Ttl:    s.recordTTL(ttl),
+		},
+		Txt: s.service.Text,
+	}
+	dnssd := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   s.service.ServiceTypeName(),
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ptr: s.service.ServiceName(),
+	}
+	resp.Answer = append(resp.Answer, srv, txt, ptr, dnssd)
+
+	resp.Answer = append(resp.Answer, s.subtypeRecords(s.service.Subtypes, ttl)...)
+
+	resp.Answer = s.appendAddrs(resp.Answer, ttl, ifIndex)
+	resp.Answer = s.appendHostInfo(resp.Answer, ttl, ifIndex)
+	resp.Answer = s.appendAliases(resp.Answer, ttl)
+	resp.Extra = s.appendExtraRecords(resp.Extra, ttl)
+}
+
+// composeHostAnswers answers a question for one of our host names with the
+// address and HINFO records of the asked type, or an NSEC record if there are
+// none. Address records of the other type are added as additional records.
+func (s *Server) composeHostAnswers(resp *dns.Msg, name string, qtype uint16, ifIndex int) {
+	var addrs []dns.RR
+	for _, rr := range s.appendHostInfo(s.appendAddrs(nil, s.ttl, ifIndex), s.ttl, ifIndex) {
+		if strings.EqualFold(rr.Header().Name, name) {
+			addrs = append(addrs, rr)
+		}
+	}
+	for _, rr := range addrs {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			resp.Answer = append(resp.Answer, rr)
+		} else if rr.Header().Rrtype != dns.TypeHINFO {
+			resp.Extra = append(resp.Extra, rr)
+		}
+	}
+	nsec := s.hostNSEC(name, addrs, s.ttl)
+	if len(resp.Answer) == 0 {
+		resp.Answer = append(resp.Answer, nsec)
+	} else {
+		resp.Extra = append(resp.Extra, nsec)
+	}
+}
+
+// instanceNSEC returns the NSEC record asserting that the service instance
+// name owns SRV and TXT records only.
+func (s *Server) instanceNSEC(ttl uint32) *dns.NSEC {
+	return s.newNSEC(s.service.ServiceInstanceName(), []uint16{dns.TypeTXT, dns.TypeSRV}, s.recordTTL(ttl))
+}
+
+// handlerAnswers returns the records synthesized by the record handler for q,
+// with missing TTLs and classes filled in.
+func (s *Server) handlerAnswers(q dns.Question) []dns.RR {
+	if s.recordHandler == nil {
+		return nil
+	}
+	if state := s.state.load(); state != stateRunning && state != stateAnnouncing {
+		return nil
+	}
+	var records []dns.RR
+	for _, rr := range s.recordHandler(q) {
+		if rr == nil {
+			continue
+		}
+		if hdr := rr.Header(); hdr.Ttl == 0 || hdr.Class == 0 {
+			rr = dns.Copy(rr)
+			hdr = rr.Header()
+			if hdr.Ttl == 0 {
+				hdr.Ttl = s.ttl
+			}
+			if hdr.Class == 0 {
+				hdr.Class = dns.ClassINET
+			}
+		}
+		records = append(records, rr)
+	}
+	return records
+}
+
+// appendExtraRecords appends the additional records of the service. A zero ttl
+// turns them into goodbye records.
+func (s *Server) appendExtraRecords(list []dns.RR, ttl uint32) []dns.RR {
+	for _, rr := range s.extraRecords {
+		// Responses adjust the headers of their records, which must not
+		// change the records given.
+		rr = dns.Copy(rr)
+		if ttl == 0 || rr.Header().Ttl == 0 {
+			rr.Header().Ttl = ttl
+		}
+		list = append(list, rr)
+	}
+	return list
+}
+
+// composeExtraAnswers answers a question for one of the additional records and
+// reports whether there was any.
+func (s *Server) composeExtraAnswers(resp *dns.Msg, q dns.Question) bool {
+	for _, rr := range s.appendExtraRecords(nil, s.ttl) {
+		hdr := rr.Header()
+		if strings.EqualFold(hdr.Name, q.Name) && (q.Qtype == dns.TypeANY || q.Qtype == hdr.Rrtype) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return len(resp.Answer) > 0
+}
+
+// appendAliases appends the CNAME records of the host name aliases.
+func (s *Server) appendAliases(list []dns.RR, ttl uint32) []dns.RR {
+	ttl = s.recordTTL(ttl)
+	for _, alias := range s.aliases {
+		list = append(list, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   alias,
+				Rrtype: dns.TypeCNAME,
+				Class:  s.uniqueClass(),
+				Ttl:    ttl,
+			},
+			Target: s.service.HostName,
+		})
+	}
+	return list
+}
+
+// composeAliasAnswers answers a question for an alias with its CNAME record
+// and the address records of the host name.
+func (s *Server) composeAliasAnswers(resp *dns.Msg, alias string, ifIndex int) {
+	for _, rr := range s.appendAliases(nil, s.ttl) {
+		if strings.EqualFold(rr.Header().Name, alias) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	resp.Extra = s.appendAddrs(resp.Extra, s.ttl, ifIndex)
+}
+
+// isAlias reports whether name is one of the aliases of the host name.
+func (s *Server) isAlias(name string) bool {
+	for _, alias := range s.aliases {
+		if strings.EqualFold(alias, name) {
+			return true
+		}
 	}
-	resp.Extra = append(resp.Extra, srv, txt)
+	return false
+}
 
-	resp.Extra = s.appendAddrs(resp.Extra, s.ttl, ifIndex, false)
+// isProxyHost reports whether name is one of the hosts published by a proxy
+// registration.
+func (s *Server) isProxyHost(name string) bool {
+	return s.proxyHostIndex(name) >= 0
 }
 
-func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int, flushCache bool) {
-	// From RFC6762
-	//    The most significant bit of the rrclass for a record in the Answer
-	//    Section of a response message is the Multicast DNS cache-flush bit
-	//    and is discussed in more detail below in Section 10.2, "Announcements
-	//    to Flush Outdated Cache Entries".
-	ptr := &dns.PTR{
-		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceName(),
-			Rrtype: dns.TypePTR,
-			Class:  dns.ClassINET,
-			Ttl:    ttl,
-		},
-		Ptr: s.service.ServiceInstanceName(),
+// proxyHostIndex returns the index of the proxied host named name, or -1.
+func (s *Server) proxyHostIndex(name string) int {
+	for i, host := range s.proxyHosts {
+		if strings.EqualFold(host.Name, name) {
+			return i
+		}
 	}
-	srv := &dns.SRV{
-		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
-			Rrtype: dns.TypeSRV,
-			Class:  dns.ClassINET | qClassCacheFlush,
-			Ttl:    ttl,
-		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
+	return -1
+}
+
+// hostNSEC returns the NSEC record asserting which address record types exist
+// for the host name, given the records sent along.
+func (s *Server) hostNSEC(name string, records []dns.RR, ttl uint32) *dns.NSEC {
+	ttl = s.recordTTL(ttl)
+	var types []uint16
+	var hasA, hasHINFO, hasAAAA bool
+	for _, rr := range records {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeA:
+			hasA = true
+		case dns.TypeHINFO:
+			hasHINFO = true
+		case dns.TypeAAAA:
+			hasAAAA = true
+		}
 	}
-	txt := &dns.TXT{
-		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
-			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET | qClassCacheFlush,
-			Ttl:    ttl,
-		},
-		Txt: s.service.Text,
+	if hasA {
+		types = append(types, dns.TypeA)
 	}
-	dnssd := &dns.PTR{
+	if hasHINFO {
+		types = append(types, dns.TypeHINFO)
+	}
+	if hasAAAA {
+		types = append(types, dns.TypeAAAA)
+	}
+	return s.newNSEC(name, types, ttl)
+}
+
+// newNSEC builds an mDNS negative response record (RFC6762 section 6.1): an
+// NSEC record whose next domain name is its own name, listing the existing
+// record types.
+func (s *Server) newNSEC(name string, types []uint16, ttl uint32) *dns.NSEC {
+	return &dns.NSEC{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceTypeName(),
-			Rrtype: dns.TypePTR,
-			Class:  dns.ClassINET,
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  s.uniqueClass(),
 			Ttl:    ttl,
 		},
-		Ptr: s.service.ServiceName(),
+		NextDomain: name,
+		TypeBitMap: types,
 	}
-	resp.Answer = append(resp.Answer, srv, txt, ptr, dnssd)
-
-	for _, subtype := range s.service.Subtypes {
-		resp.Answer = append(resp.Answer,
-			&dns.PTR{
-				Hdr: dns.RR_Header{
-					Name:   subtype,
-					Rrtype: dns.TypePTR,
-					Class:  dns.ClassINET,
-					Ttl:    ttl,
-				},
-				Ptr: s.service.ServiceInstanceName(),
-			})
-	}
-
-	resp.Answer = s.appendAddrs(resp.Answer, ttl, ifIndex, flushCache)
 }
 
 func (s *Server) serviceTypeName(resp *dns.Msg, ttl uint32) {
@@ -524,125 +2043,258 @@ func (s *Server) serviceTypeName(resp *dns.Msg, ttl uint32) {
 	resp.Answer = append(resp.Answer, dnssd)
 }
 
-// Perform probing & announcement
-//TODO: implement a proper probing & conflict resolution
-func (s *Server) probe() {
-	q := new(dns.Msg)
-	q.SetQuestion(s.service.ServiceInstanceName(), dns.TypePTR)
-	q.RecursionDesired = false
+// instanceRecords returns the records owned by or pointing to the service
+// instance: its PTR, SRV and TXT records as well as the subtype PTR records.
+func (s *Server) instanceRecords(ttl uint32) []dns.RR {
+	resp := new(dns.Msg)
+	s.composeLookupAnswers(resp, ttl, 0)
+	var records []dns.RR
+	for _, rr := range resp.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeHINFO, dns.TypeCNAME:
+			continue
+		}
+		if rr.Header().Name == s.service.ServiceTypeName() {
+			continue
+		}
+		records = append(records, rr)
+	}
+	return records
+}
 
+// srvRecords returns the SRV record of the service with cache flush enabled,
+// along with the address records of its target on the interface.
+func (s *Server) srvRecords(ifIndex int) []dns.RR {
 	srv := &dns.SRV{
 		Hdr: dns.RR_Header{
 			Name:   s.service.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
-			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
+			Class:  s.uniqueClass(),
+			Ttl:    s.hostTTL,
 		},
 		Priority: 0,
 		Weight:   0,
 		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
+		Target:   s.hostName(ifIndex),
 	}
+	return s.appendAddrs([]dns.RR{srv}, s.ttl, ifIndex)
+}
+
+// addrRecords returns the address records of the host name on the interface
+// with cache flush enabled.
+func (s *Server) addrRecords(ifIndex int) []dns.RR {
+	return s.appendAddrs(nil, s.ttl, ifIndex)
+}
+
+// textRecords returns the TXT record of the service with cache flush enabled.
+func (s *Server) textRecords() []dns.RR {
 	txt := &dns.TXT{
 		Hdr: dns.RR_Header{
 			Name:   s.service.ServiceInstanceName(),
 			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
+			Class:  s.uniqueClass(),
+			Ttl:    s.hostTTL,
 		},
 		Txt: s.service.Text,
 	}
-	q.Ns = []dns.RR{srv, txt}
-
-	randomizer := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return []dns.RR{txt}
+}
 
-	for i := 0; i < multicastRepetitions; i++ {
-		if err := s.multicastResponse(q, 0); err != nil {
-			log.Println("[ERR] zeroconf: failed to send probe:", err.Error())
-		}
-		time.Sleep(time.Duration(randomizer.Intn(250)) * time.Millisecond)
+// unregister sends goodbye packets, i.e. all records with a TTL of zero, on all
+// interfaces. The goodbyes are repeated once to make up for packet loss, and
+// sending is bounded by goodbyeTimeout so a stuck interface cannot block the
+// shutdown. Records still published by other services of the same responder
+// are left out.
+func (s *Server) unregister() error {
+	// Never say goodbye for names we did not claim, this would flush the
+	// records of their owner from the caches. Paused services said goodbye
+	// already.
+	if state := s.state.load(); state == stateProbing || state == stateConflict || state == statePaused {
+		return nil
 	}
 
-	// From RFC6762
-	//    The Multicast DNS responder MUST send at least two unsolicited
-	//    responses, one second apart. To provide increased robustness against
-	//    packet loss, a responder MAY send up to eight unsolicited responses,
-	//    provided that the interval between unsolicited responses increases by
-	//    at least a factor of two with every response sent.
-	timeout := 1 * time.Second
-	for i := 0; i < multicastRepetitions; i++ {
-		for _, intf := range s.ifaces {
+	shared := s.sharedRecords()
+
+	s.setWriteDeadline(time.Now().Add(goodbyeTimeout))
+	defer s.setWriteDeadline(time.Time{})
+
+	var err error
+	for i := 0; i < goodbyeRepetitions; i++ {
+		if i > 0 {
+			time.Sleep(goodbyeInterval)
+		}
+		for _, intf := range s.interfaces() {
+			if e := s.goodbye(intf.Index, shared); e != nil {
+				err = e
+			}
+		}
+		if len(s.peers) > 0 {
 			resp := new(dns.Msg)
 			resp.MsgHdr.Response = true
-			// TODO: make response authoritative if we are the publisher
-			resp.Compress = true
-			resp.Answer = []dns.RR{}
-			resp.Extra = []dns.RR{}
-			s.composeLookupAnswers(resp, s.ttl, intf.Index, true)
-			if err := s.multicastResponse(resp, intf.Index); err != nil {
-				log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
-			}
+			s.mu.RLock()
+			s.composeLookupAnswers(resp, 0, 0)
+			s.mu.RUnlock()
+			resp.Answer = shared.without(resp.Answer)
+			s.announceToPeers(resp)
 		}
-		time.Sleep(timeout)
-		timeout *= 2
 	}
+	return err
 }
 
-// announceText sends a Text announcement with cache flush enabled
-func (s *Server) announceText() {
+// goodbye multicasts the records of the service with a zero TTL on the
+// interface with the given index, except the ones shared with other services.
+func (s *Server) goodbye(ifIndex int, shared sharedRecords) error {
 	resp := new(dns.Msg)
 	resp.MsgHdr.Response = true
+	resp.Answer = []dns.RR{}
+	resp.Extra = []dns.RR{}
+	s.mu.RLock()
+	s.composeLookupAnswers(resp, 0, ifIndex)
+	s.mu.RUnlock()
+	resp.Answer = shared.without(resp.Answer)
+	s.stats.goodbyesSent.Add(1)
+	return s.multicastResponse(resp, ifIndex)
+}
 
-	txt := &dns.TXT{
-		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
-			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET | qClassCacheFlush,
-			Ttl:    s.ttl,
-		},
-		Txt: s.service.Text,
+// sharedRecords names the records of a service which other services of the
+// same responder publish as well, so no goodbye is sent for them.
+type sharedRecords struct {
+	host        string // Host name whose address, HINFO, NSEC and alias records are shared, if any
+	serviceType string // Service type whose enumeration PTR is shared, if any
+}
+
+// sharedRecords returns the records of the service shared with other services
+// of its responder.
+func (s *Server) sharedRecords() sharedRecords {
+	var shared sharedRecords
+	if s.responder == nil {
+		return shared
 	}
+	s.mu.RLock()
+	host, serviceType := s.service.HostName, s.service.ServiceName()
+	s.mu.RUnlock()
+	sharedHost, sharedType := s.responder.shares(s, host, serviceType)
+	if sharedHost {
+		shared.host = host
+	}
+	if sharedType {
+		shared.serviceType = serviceType
+	}
+	return shared
+}
 
-	resp.Answer = []dns.RR{txt}
-	s.multicastResponse(resp, 0)
+// without returns the records except the shared ones.
+func (sh sharedRecords) without(records []dns.RR) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		hdr := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.A, *dns.AAAA, *dns.HINFO, *dns.NSEC:
+			if sh.host != "" && strings.EqualFold(hdr.Name, sh.host) {
+				continue
+			}
+		case *dns.CNAME:
+			if sh.host != "" && strings.EqualFold(rr.Target, sh.host) {
+				continue
+			}
+		case *dns.PTR:
+			// Only the service type enumeration points to the service type.
+			if sh.serviceType != "" && strings.EqualFold(rr.Ptr, sh.serviceType) {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
 }
 
-func (s *Server) unregister() error {
-	resp := new(dns.Msg)
-	resp.MsgHdr.Response = true
-	resp.Answer = []dns.RR{}
-	resp.Extra = []dns.RR{}
-	s.composeLookupAnswers(resp, 0, 0, true)
-	return s.multicastResponse(resp, 0)
+// setWriteDeadline sets a deadline for all sends until it is reset with the
+// zero time, in addition to the deadline of each send.
+func (s *Server) setWriteDeadline(t time.Time) {
+	if t.IsZero() {
+		s.writeLimit.Store(0)
+		return
+	}
+	s.writeLimit.Store(t.UnixNano())
+}
+
+// sendDeadline returns the write deadline of a send starting now.
+func (s *Server) sendDeadline() time.Time {
+	deadline := time.Now().Add(sendTimeout)
+	if limit := s.writeLimit.Load(); limit != 0 && limit < deadline.UnixNano() {
+		return time.Unix(0, limit)
+	}
+	return deadline
+}
+
+// sent records the result of a send on the interface with the given index,
+// zero if unknown. Failures are counted, and reported to the error handler
+// once they persist for sendFailureLimit sends in a row.
+func (s *Server) sent(ifIndex int, err error) {
+	s.sendMu.Lock()
+	if err == nil {
+		delete(s.sendFailures, ifIndex)
+		s.sendMu.Unlock()
+		return
+	}
+	if s.sendFailures == nil {
+		s.sendFailures = make(map[int]int)
+	}
+	s.sendFailures[ifIndex]++
+	failures := s.sendFailures[ifIndex]
+	s.sendMu.Unlock()
+
+	s.stats.sendErrors.Add(1)
+	s.connEvents.failed(false, interfaceByIndex(ifIndex), err)
+	if failures == sendFailureLimit {
+		s.reportError(fmt.Errorf("sending on interface %d failed %d times in a row: %v", ifIndex, failures, err))
+	}
 }
 
-func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache bool) []dns.RR {
+// appendAddrs appends the address records of the host name. Unless ifIndex is
+// zero, only the addresses assigned to that interface are included.
+func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int) []dns.RR {
+	if len(s.proxyHosts) > 0 {
+		list = s.appendProxyAddrs(list, ttl)
+		if i := s.proxyHostIndex(s.service.HostName); i >= 0 && len(s.proxyHosts[i].Addrs) > 0 {
+			return list
+		}
+		// A target given without addresses falls back to the addresses of
+		// the interface, as RegisterProxy without IPs always did.
+	}
 	v4 := s.service.AddrIPv4
 	v6 := s.service.AddrIPv6
-	if len(v4) == 0 && len(v6) == 0 {
-		iface, _ := net.InterfaceByIndex(ifIndex)
-		if iface != nil {
-			a4, a6 := addrsForInterface(iface)
-			v4 = append(v4, a4...)
-			v6 = append(v6, a6...)
+	if ifIndex != 0 {
+		if iface, _ := net.InterfaceByIndex(ifIndex); iface != nil {
+			a4, a6 := addrsForInterface(iface, s.temporaryAddrs, s.linkLocalOnly)
+			a4, a6 = filterIPs(a4, s.allowedAddrs), filterIPs(a6, s.allowedAddrs)
+			if s.ipTraffic&IPv4 == 0 {
+				a4 = nil
+			}
+			if s.ipTraffic&IPv6 == 0 {
+				a6 = nil
+			}
+			if len(v4) == 0 && len(v6) == 0 {
+				v4, v6 = a4, a6
+			} else {
+				// Only publish the addresses assigned to the interface, so
+				// clients never learn addresses unreachable from their
+				// segment.
+				v4, v6 = commonIPs(v4, a4), commonIPs(v6, a6)
+			}
 		}
 	}
-	if ttl > 0 {
-		// RFC6762 Section 10 says A/AAAA records SHOULD
-		// use TTL of 120s, to account for network interface
-		// and IP address changes.
-		ttl = 120
-	}
-	var cacheFlushBit uint16
-	if flushCache {
-		cacheFlushBit = qClassCacheFlush
-	}
+	// RFC6762 Section 10 says A/AAAA records SHOULD
+	// use TTL of 120s, to account for network interface
+	// and IP address changes.
+	ttl = s.recordTTL(ttl)
+	host := s.hostName(ifIndex)
 	for _, ipv4 := range v4 {
 		a := &dns.A{
 			Hdr: dns.RR_Header{
-				Name:   s.service.HostName,
+				Name:   host,
 				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET | cacheFlushBit,
+				Class:  s.uniqueClass(),
 				Ttl:    ttl,
 			},
 			A: ipv4,
@@ -652,9 +2304,9 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 	for _, ipv6 := range v6 {
 		aaaa := &dns.AAAA{
 			Hdr: dns.RR_Header{
-				Name:   s.service.HostName,
+				Name:   host,
 				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET | cacheFlushBit,
+				Class:  s.uniqueClass(),
 				Ttl:    ttl,
 			},
 			AAAA: ipv6,
@@ -664,125 +2316,405 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 	return list
 }
 
-func addrsForInterface(iface *net.Interface) ([]net.IP, []net.IP) {
+// appendHostInfo appends the HINFO record of the host name published on the
+// interface, if set. Proxy registrations publish other hosts and have none.
+func (s *Server) appendHostInfo(list []dns.RR, ttl uint32, ifIndex int) []dns.RR {
+	if s.hostCPU == "" && s.hostOS == "" || len(s.proxyHosts) > 0 {
+		return list
+	}
+	hinfo := &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   s.hostName(ifIndex),
+			Rrtype: dns.TypeHINFO,
+			Class:  s.uniqueClass(),
+			Ttl:    s.recordTTL(ttl),
+		},
+		Cpu: s.hostCPU,
+		Os:  s.hostOS,
+	}
+	return append(list, hinfo)
+}
+
+// hostName returns the host name published on the interface with the given
+// index, which is the host name of the service unless WithInterfaceHostName
+// replaced it there.
+func (s *Server) hostName(ifIndex int) string {
+	if ifIndex != 0 && len(s.ifaceHostNames) > 0 {
+		for _, iface := range s.interfaces() {
+			if iface.Index != ifIndex {
+				continue
+			}
+			if host, ok := s.ifaceHostNames[iface.Name]; ok {
+				return host
+			}
+			break
+		}
+	}
+	return s.service.HostName
+}
+
+// isHostName reports whether name is one of the host names we publish.
+func (s *Server) isHostName(name string) bool {
+	if strings.EqualFold(name, s.service.HostName) {
+		return true
+	}
+	for _, host := range s.ifaceHostNames {
+		if strings.EqualFold(name, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendProxyAddrs appends the address records of all proxied hosts, each with
+// its own TTL unless ttl is zero.
+func (s *Server) appendProxyAddrs(list []dns.RR, ttl uint32) []dns.RR {
+	class := s.uniqueClass()
+	for _, host := range s.proxyHosts {
+		for _, addr := range host.Addrs {
+			addrTTL := uint32(0)
+			if ttl > 0 {
+				addrTTL = addr.TTL
+				if addrTTL == 0 {
+					addrTTL = s.hostTTL
+				}
+			}
+			hdr := dns.RR_Header{Name: host.Name, Class: class, Ttl: addrTTL}
+			if ipv4 := addr.IP.To4(); ipv4 != nil {
+				hdr.Rrtype = dns.TypeA
+				list = append(list, &dns.A{Hdr: hdr, A: addr.IP})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				list = append(list, &dns.AAAA{Hdr: hdr, AAAA: addr.IP})
+			}
+		}
+	}
+	return list
+}
+
+// commonIPs returns the addresses of a which are also in b.
+func commonIPs(a, b []net.IP) []net.IP {
+	var common []net.IP
+	for _, ip := range a {
+		if containsIP(b, ip) {
+			common = append(common, ip)
+		}
+	}
+	return common
+}
+
+// parseAllowedAddrs parses the entries given to WithAllowedAddrs. Single
+// addresses become host prefixes.
+func parseAllowedAddrs(addrs []string) ([]*net.IPNet, error) {
+	var allowed []*net.IPNet
+	for _, addr := range addrs {
+		if _, ipnet, err := net.ParseCIDR(addr); err == nil {
+			allowed = append(allowed, ipnet)
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid allowed address %q", addr)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		allowed = append(allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return allowed, nil
+}
+
+// parsePeers resolves the addresses of unicast peers, defaulting to port 5353.
+func parsePeers(addrs []string) ([]*net.UDPAddr, error) {
+	var peers []*net.UDPAddr
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			peers = append(peers, &net.UDPAddr{IP: ip, Port: 5353})
+			continue
+		}
+		peer, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil || peer.IP == nil {
+			return nil, fmt.Errorf("invalid peer address %q", addr)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// filterIPs returns the addresses contained in any of the allowed networks, or
+// all of them if there are no restrictions.
+func filterIPs(ips []net.IP, allowed []*net.IPNet) []net.IP {
+	if len(allowed) == 0 {
+		return ips
+	}
+	var kept []net.IP
+	for _, ip := range ips {
+		for _, ipnet := range allowed {
+			if ipnet.Contains(ip) {
+				kept = append(kept, ip)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// addrsForInterface returns the IPv4 and IPv6 addresses of iface to publish.
+// Temporary and deprecated IPv6 addresses are left out unless temporary is set,
+// and only link-local addresses are returned if linkLocalOnly is set.
+func addrsForInterface(iface *net.Interface, temporary, linkLocalOnly bool) ([]net.IP, []net.IP) {
 	var v4, v6, v6local []net.IP
+	var transient map[string]bool
+	if !temporary {
+		transient = transientAddrs(iface.Index)
+	}
 	addrs, _ := iface.Addrs()
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+		// Loopback addresses are only reachable through the loopback
+		// interface itself.
+		if ipnet, ok := address.(*net.IPNet); ok && (!ipnet.IP.IsLoopback() || iface.Flags&net.FlagLoopback != 0) {
 			if ipnet.IP.To4() != nil {
-				v4 = append(v4, ipnet.IP)
-			} else {
+				if !linkLocalOnly || ipnet.IP.IsLinkLocalUnicast() {
+					v4 = append(v4, ipnet.IP)
+				}
+			} else if !transient[ipnet.IP.String()] {
 				switch ip := ipnet.IP.To16(); ip != nil {
 				case ip.IsGlobalUnicast():
 					v6 = append(v6, ipnet.IP)
-				case ip.IsLinkLocalUnicast():
+				case ip.IsLinkLocalUnicast(), ip.IsLoopback():
 					v6local = append(v6local, ipnet.IP)
 				}
 			}
 		}
 	}
-	if len(v6) == 0 {
+	if len(v6) == 0 || linkLocalOnly {
 		v6 = v6local
 	}
 	return v4, v6
 }
 
 // unicastResponse is used to send a unicast response packet
+// Responses exceeding the packet size of the interface are split into several
+// packets, except for legacy resolvers which get a truncated response with the
+// TC bit set and retry over TCP.
 func (s *Server) unicastResponse(resp *dns.Msg, ifIndex int, from net.Addr) error {
+	if isLegacyQuery(from) {
+		resp.Truncate(dns.MinMsgSize)
+		return s.unicastPacket(resp, ifIndex, from)
+	}
+	for _, part := range splitMessage(resp, s.packetSize(ifIndex)) {
+		if err := s.unicastPacket(part, ifIndex, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// announceToPeers sends an unsolicited response to the unicast peers.
+func (s *Server) announceToPeers(resp *dns.Msg) {
+	for _, peer := range s.peers {
+		if !s.transport.virtual() && (peer.IP.To4() != nil && s.ipv4conn == nil || peer.IP.To4() == nil && s.ipv6conn == nil) {
+			continue
+		}
+		for _, part := range splitMessage(resp, unicastPacketSize) {
+			if err := s.unicastPacket(part, 0, peer); err != nil {
+				log.Printf("[ERR] zeroconf: failed to send announcement to %v: %v", peer, err)
+				break
+			}
+		}
+	}
+}
+
+// unicastPacket sends a single message to the given address, split into
+// smaller packets if the interface rejects it as too large.
+func (s *Server) unicastPacket(resp *dns.Msg, ifIndex int, from net.Addr) error {
 	buf, err := resp.Pack()
 	if err != nil {
 		return err
 	}
 	addr := from.(*net.UDPAddr)
-	if addr.IP.To4() != nil {
-		if ifIndex != 0 {
-			var wcm ipv4.ControlMessage
-			wcm.IfIndex = ifIndex
-			_, err = s.ipv4conn.WriteTo(buf, &wcm, addr)
-		} else {
-			_, err = s.ipv4conn.WriteTo(buf, nil, addr)
+	err = s.unicastBuf(buf, ifIndex, addr)
+	if isMsgTooBig(err) {
+		err = resplit(resp, len(buf), func(size int) int {
+			return s.shrinkPacketSize(ifIndex, size)
+		}, func(b []byte) error {
+			return s.unicastBuf(b, ifIndex, addr)
+		})
+		if err != nil {
+			s.sent(ifIndex, err)
 		}
-		return err
+	}
+	return err
+}
+
+// unicastBuf sends a packed message to the given address. A packet rejected as
+// too large is not recorded as failed, unicastPacket sends it again.
+func (s *Server) unicastBuf(buf []byte, ifIndex int, addr *net.UDPAddr) error {
+	var err error
+	if s.transport.virtual() {
+		err = s.transport.send(buf, addr)
+	} else if addr.IP.To4() != nil {
+		err = writeWithDeadline(s.ipv4conn, s.sendDeadline(), func() error {
+			var wcm *ipv4.ControlMessage
+			if ifIndex != 0 {
+				wcm = &ipv4.ControlMessage{IfIndex: ifIndex}
+			}
+			_, err := s.ipv4conn.WriteTo(buf, wcm, addr)
+			return err
+		})
 	} else {
-		if ifIndex != 0 {
-			var wcm ipv6.ControlMessage
-			wcm.IfIndex = ifIndex
-			_, err = s.ipv6conn.WriteTo(buf, &wcm, addr)
-		} else {
-			_, err = s.ipv6conn.WriteTo(buf, nil, addr)
-		}
+		err = writeWithDeadline(s.ipv6conn, s.sendDeadline(), func() error {
+			var wcm *ipv6.ControlMessage
+			if ifIndex != 0 {
+				wcm = &ipv6.ControlMessage{IfIndex: ifIndex}
+			}
+			_, err := s.ipv6conn.WriteTo(buf, wcm, addr)
+			return err
+		})
+	}
+	if isMsgTooBig(err) {
 		return err
 	}
+	s.sent(ifIndex, err)
+	if err == nil {
+		capturePacket(s.tap, true, ifIndex, s.localAddr(), addr, buf)
+	}
+	return err
+}
+
+// localAddr returns the address packets are sent from if known, i.e. on a
+// virtual link, otherwise nil.
+func (s *Server) localAddr() *net.UDPAddr {
+	if s.transport.virtual() {
+		return s.transport.localAddr()
+	}
+	return nil
 }
 
-// multicastResponse us used to send a multicast response packet
+// multicastResponse us used to send a multicast response packet, split into
+// several packets if it exceeds the packet size of the interfaces
 func (s *Server) multicastResponse(msg *dns.Msg, ifIndex int) error {
-	buf, err := msg.Pack()
-	if err != nil {
-		return err
+	if msg.Response {
+		s.multicasts.mark(msg.Answer, ifIndex)
 	}
-	if s.ipv4conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv4#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv4.ControlMessage
-		if ifIndex != 0 {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = ifIndex
-			default:
-				iface, _ := net.InterfaceByIndex(ifIndex)
-				if err := s.ipv4conn.SetMulticastInterface(iface); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface: %v", err)
+	for _, part := range splitMessage(msg, s.packetSize(ifIndex)) {
+		buf, err := part.Pack()
+		if err != nil {
+			return err
+		}
+		for _, o := range s.multicastPacket(buf, ifIndex, IPv4AndIPv6) {
+			// Send again in smaller packets where the MTU is smaller.
+			err := resplit(part, len(buf), func(size int) int {
+				return s.shrinkPacketSize(o.ifIndex, size)
+			}, func(b []byte) error {
+				if tooBig := s.multicastPacket(b, o.ifIndex, o.family); len(tooBig) > 0 {
+					return tooBig[0].err
 				}
+				return nil
+			})
+			if err != nil {
+				s.sent(o.ifIndex, err)
+			}
+		}
+	}
+	return nil
+}
+
+// oversized is a packet rejected as too large by an interface.
+type oversized struct {
+	ifIndex int
+	family  IPType
+	err     error
+}
+
+// multicastPacket sends a packed message to the multicast groups of the given
+// address families. It returns the interfaces which rejected the packet as too
+// large for their MTU, for which the send outcome is not recorded.
+func (s *Server) multicastPacket(buf []byte, ifIndex int, families IPType) (tooBig []oversized) {
+	if s.transport.virtual() {
+		s.sent(virtualIface.Index, s.transport.send(buf, s.transport.groupAddr()))
+		capturePacket(s.tap, true, virtualIface.Index, s.localAddr(), s.transport.groupAddr(), buf)
+		return nil
+	}
+	sent := func(ifIndex int, family IPType, err error) {
+		if isMsgTooBig(err) {
+			tooBig = append(tooBig, oversized{ifIndex: ifIndex, family: family, err: err})
+			return
+		}
+		s.sent(ifIndex, err)
+	}
+	if s.ipv4conn != nil && families&IPv4 > 0 {
+		if ifIndex != 0 {
+			err := writeMulticast4(s.ipv4conn, interfaceByIndex(ifIndex), buf, s.sendDeadline())
+			sent(ifIndex, IPv4, err)
+			if err == nil {
+				capturePacket(s.tap, true, ifIndex, nil, ipv4Addr, buf)
 			}
-			s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
 		} else {
-			for _, intf := range s.ifaces {
-				switch runtime.GOOS {
-				case "darwin", "ios", "linux":
-					wcm.IfIndex = intf.Index
-				default:
-					if err := s.ipv4conn.SetMulticastInterface(&intf); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface: %v", err)
-					}
+			ifaces := s.interfaces()
+			errs := writeMulticastAll4(s.ipv4conn, ifaces, buf, s.sendDeadline())
+			for i, err := range errs {
+				sent(ifaces[i].Index, IPv4, err)
+				if err == nil {
+					capturePacket(s.tap, true, ifaces[i].Index, nil, ipv4Addr, buf)
 				}
-				s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
 			}
 		}
 	}
 
-	if s.ipv6conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv6#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv6.ControlMessage
+	if s.ipv6conn != nil && families&IPv6 > 0 {
 		if ifIndex != 0 {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = ifIndex
-			default:
-				iface, _ := net.InterfaceByIndex(ifIndex)
-				if err := s.ipv6conn.SetMulticastInterface(iface); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface: %v", err)
-				}
+			err := writeMulticast6(s.ipv6conn, interfaceByIndex(ifIndex), buf, s.sendDeadline())
+			sent(ifIndex, IPv6, err)
+			if err == nil {
+				capturePacket(s.tap, true, ifIndex, nil, ipv6Addr, buf)
 			}
-			s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
 		} else {
-			for _, intf := range s.ifaces {
-				switch runtime.GOOS {
-				case "darwin", "ios", "linux":
-					wcm.IfIndex = intf.Index
-				default:
-					if err := s.ipv6conn.SetMulticastInterface(&intf); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface: %v", err)
-					}
+			ifaces := s.interfaces()
+			errs := writeMulticastAll6(s.ipv6conn, ifaces, buf, s.sendDeadline())
+			for i, err := range errs {
+				sent(ifaces[i].Index, IPv6, err)
+				if err == nil {
+					capturePacket(s.tap, true, ifaces[i].Index, nil, ipv6Addr, buf)
 				}
-				s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
 			}
 		}
 	}
-	return nil
+	return tooBig
+}
+
+// isLegacyQuery reports whether a query was sent by a legacy, one-shot
+// resolver, i.e. from a source port other than 5353.
+func isLegacyQuery(from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	return ok && addr.Port != 5353
+}
+
+// legacyResponse turns resp into a conventional unicast DNS response.
+func legacyResponse(resp *dns.Msg, q dns.Question) {
+	// From RFC6762
+	// 6.7.  Legacy Unicast Responses
+	//
+	//    [...] it MUST be sent as a conventional unicast response as would be
+	//    generated by a conventional Unicast DNS server; for example, it MUST
+	//    repeat the query ID and the question given in the query message. In
+	//    addition, the cache-flush bit described in Section 10.2 MUST NOT be set
+	//    in legacy unicast responses. [...] the TTL given in a legacy unicast
+	//    response SHOULD NOT be greater than ten seconds.
+	resp.Question = []dns.Question{q}
+	for _, list := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for i, rr := range list {
+			// Records may be shared with other responses.
+			rr = dns.Copy(rr)
+			list[i] = rr
+			hdr := rr.Header()
+			hdr.Class &^= qClassCacheFlush
+			if hdr.Ttl > legacyUnicastTTL {
+				hdr.Ttl = legacyUnicastTTL
+			}
+		}
+	}
 }
 
 func isUnicastQuestion(q dns.Question) bool {
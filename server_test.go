@@ -0,0 +1,76 @@
+package zeroconf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestValidateServiceType(t *testing.T) {
+	tests := []struct {
+		service string
+		valid   bool
+	}{
+		{"_http._tcp", true},
+		{"_http._tcp.", true},
+		{"_ipp._TCP", true},
+		{"_my-service._udp", true},
+		{"_abcdefghijklmno._tcp", true},
+		{"_abcdefghijklmnop._tcp", false},
+		{"http._tcp", false},
+		{"_._tcp", false},
+		{"_http._sctp", false},
+		{"_http", false},
+		{"_a.b._tcp", false},
+		{"_http_x._tcp", false},
+		{"_123._tcp", false},
+	}
+	for _, tt := range tests {
+		if err := validateServiceType(tt.service); (err == nil) != tt.valid {
+			t.Errorf("validateServiceType(%q) = %v, want valid %v", tt.service, err, tt.valid)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	link := NewVirtualLink()
+	s, events := registerVirtual(t, link, "192.0.2.1", "Printer", "printer", 631)
+	waitEvent(t, events, EventAnnounced)
+
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	// A probe queued before the pause, e.g. by the interface monitor, and a
+	// rename must not publish the service again.
+	s.probe()
+	if err := s.Rename("Scanner"); err != nil {
+		t.Fatal(err)
+	}
+	if state := s.state.load(); state != statePaused {
+		t.Fatalf("state %d after pausing, want paused", state)
+	}
+
+	s.Resume()
+	s.Resume()
+	e := waitEvent(t, events, EventAnnounced)
+	if e.Instance != "Scanner" {
+		t.Errorf("announced instance %q, want %q", e.Instance, "Scanner")
+	}
+}
+
+func TestCommonIPs(t *testing.T) {
+	ips := func(addrs ...string) []net.IP {
+		var list []net.IP
+		for _, addr := range addrs {
+			list = append(list, net.ParseIP(addr))
+		}
+		return list
+	}
+	published := ips("192.0.2.1", "198.51.100.1")
+	if got := commonIPs(published, ips("198.51.100.1", "203.0.113.1")); !reflect.DeepEqual(got, ips("198.51.100.1")) {
+		t.Errorf("commonIPs = %v, want [198.51.100.1]", got)
+	}
+	if got := commonIPs(published, ips("203.0.113.1")); len(got) != 0 {
+		t.Errorf("commonIPs = %v, want none", got)
+	}
+}
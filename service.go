@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 // ServiceRecord contains the basic description of a service, which contains instance name, service type & domain
@@ -65,6 +69,16 @@ func NewServiceRecord(instance, service string, domain string) *ServiceRecord {
 	return s
 }
 
+// setInstance changes the instance name and updates the cached service
+// instance name accordingly.
+func (s *ServiceRecord) setInstance(instance string) {
+	s.Instance = instance
+	s.serviceInstanceName = ""
+	if instance != "" {
+		s.serviceInstanceName = fmt.Sprintf("%s.%s", trimDot(s.Instance), s.ServiceName())
+	}
+}
+
 // lookupParams contains configurable properties to create a service discovery request
 type lookupParams struct {
 	ServiceRecord
@@ -73,14 +87,24 @@ type lookupParams struct {
 	isBrowsing  bool
 	stopProbing chan struct{}
 	once        sync.Once
+
+	answerWindow time.Duration
+	updates      bool
+	lastQuery    atomic.Int64 // Unix time in nanoseconds the last question was sent
 }
 
+// defaultAnswerWindow is the time after a question during which answers are
+// attributed to it.
+const defaultAnswerWindow = time.Second
+
 // newLookupParams constructs a lookupParams.
 func newLookupParams(instance, service, domain string, isBrowsing bool, entries chan<- *ServiceEntry) *lookupParams {
 	p := &lookupParams{
 		ServiceRecord: *NewServiceRecord(instance, service, domain),
 		Entries:       entries,
 		isBrowsing:    isBrowsing,
+		answerWindow:  defaultAnswerWindow,
+		updates:       true,
 	}
 	if !isBrowsing {
 		p.stopProbing = make(chan struct{})
@@ -88,6 +112,20 @@ func newLookupParams(instance, service, domain string, isBrowsing bool, entries
 	return p
 }
 
+// apply applies the given query options.
+func (l *lookupParams) apply(opts []QueryOption) {
+	for _, o := range opts {
+		if o != nil {
+			o(l)
+		}
+	}
+}
+
+// lastQueryTime returns the time the last question was sent.
+func (l *lookupParams) lastQueryTime() time.Time {
+	return time.Unix(0, l.lastQuery.Load())
+}
+
 // Notify subscriber that no more entries will arrive. Mostly caused
 // by an expired context.
 func (l *lookupParams) done() {
@@ -110,6 +148,47 @@ type ServiceEntry struct {
 	AddrIPv4 []net.IP `json:"-"`        // Host machine IPv4 address
 	AddrIPv6 []net.IP `json:"-"`        // Host machine IPv6 address
 	SrcAddr  net.IP   `json:"-"`
+	Unicast  bool     `json:"-"` // Set if the answer was received by unicast rather than multicast
+	Records  []dns.RR `json:"-"` // Raw records the entry was built from, see WithRawRecords
+	Updated  bool     `json:"-"` // Set on entries delivered again after a change, see WithUpdates
+
+	// When each address was last received, by its string form
+	addrSeen map[string]time.Time
+	// Whether address records of the family had the cache-flush bit set
+	flushIPv4, flushIPv6 bool
+}
+
+// cacheFlushGrace is the age below which cached records survive a cache-flush
+// record of the same name, type and class, as they may belong to the same
+// burst of responses (RFC 6762 section 10.2).
+const cacheFlushGrace = time.Second
+
+// noteAddr records that ip was received, in an address record with the
+// cache-flush bit set if flush is set.
+func (s *ServiceEntry) noteAddr(ip net.IP, flush bool) {
+	if s.addrSeen == nil {
+		s.addrSeen = make(map[string]time.Time)
+	}
+	s.addrSeen[ip.String()] = time.Now()
+	if flush && ip.To4() != nil {
+		s.flushIPv4 = true
+	} else if flush {
+		s.flushIPv6 = true
+	}
+}
+
+// flushAddrs returns the cached addresses which survive a cache-flush record:
+// those received again in fresh, and those received within cacheFlushGrace.
+func (s *ServiceEntry) flushAddrs(cached, fresh []net.IP) []net.IP {
+	var kept []net.IP
+	for _, ip := range cached {
+		if containsIP(fresh, ip) || time.Since(s.addrSeen[ip.String()]) < cacheFlushGrace {
+			kept = append(kept, ip)
+			continue
+		}
+		delete(s.addrSeen, ip.String())
+	}
+	return kept
 }
 
 // NewServiceEntry constructs a ServiceEntry.
@@ -118,3 +197,71 @@ func NewServiceEntry(instance, service string, domain string) *ServiceEntry {
 		ServiceRecord: *NewServiceRecord(instance, service, domain),
 	}
 }
+
+// clone returns a copy of the entry which does not share slices with it.
+func (s *ServiceEntry) clone() *ServiceEntry {
+	c := *s
+	c.Subtypes = append([]string(nil), s.Subtypes...)
+	c.Text = append([]string(nil), s.Text...)
+	c.AddrIPv4 = append([]net.IP(nil), s.AddrIPv4...)
+	c.AddrIPv6 = append([]net.IP(nil), s.AddrIPv6...)
+	c.Records = append([]dns.RR(nil), s.Records...)
+	c.Updated = false
+	c.addrSeen = make(map[string]time.Time, len(s.addrSeen))
+	for ip, t := range s.addrSeen {
+		c.addrSeen[ip] = t
+	}
+	return &c
+}
+
+// merge updates the entry with the data present in e, which was built from a
+// later message, and reports whether anything changed. Address records with the
+// cache-flush bit set replace the cached addresses of their family, except
+// those received within the last second.
+func (s *ServiceEntry) merge(e *ServiceEntry) bool {
+	changed := false
+	if e.HostName != "" && e.HostName != s.HostName {
+		s.HostName = e.HostName
+		changed = true
+	}
+	if e.Port != 0 && e.Port != s.Port {
+		s.Port = e.Port
+		changed = true
+	}
+	if e.Text != nil && !equalStrings(e.Text, s.Text) {
+		s.Text = e.Text
+		changed = true
+	}
+	if e.flushIPv4 {
+		kept := s.flushAddrs(s.AddrIPv4, e.AddrIPv4)
+		changed = changed || len(kept) != len(s.AddrIPv4)
+		s.AddrIPv4 = kept
+	}
+	if e.flushIPv6 {
+		kept := s.flushAddrs(s.AddrIPv6, e.AddrIPv6)
+		changed = changed || len(kept) != len(s.AddrIPv6)
+		s.AddrIPv6 = kept
+	}
+	for _, ip := range e.AddrIPv4 {
+		if !containsIP(s.AddrIPv4, ip) {
+			s.AddrIPv4 = append(s.AddrIPv4, ip)
+			changed = true
+		}
+	}
+	for _, ip := range e.AddrIPv6 {
+		if !containsIP(s.AddrIPv6, ip) {
+			s.AddrIPv6 = append(s.AddrIPv6, ip)
+			changed = true
+		}
+	}
+	for ip, t := range e.addrSeen {
+		if s.addrSeen == nil {
+			s.addrSeen = make(map[string]time.Time)
+		}
+		s.addrSeen[ip] = t
+	}
+	if e.TTL != 0 {
+		s.TTL = e.TTL
+	}
+	return changed
+}
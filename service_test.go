@@ -0,0 +1,68 @@
+package zeroconf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// cachedEntry returns an entry with the given IPv4 addresses, received at seen.
+func cachedEntry(seen time.Time, addrs ...string) *ServiceEntry {
+	e := NewServiceEntry("Printer", "_ipp._tcp", "local.")
+	e.Port = 631
+	e.addrSeen = make(map[string]time.Time)
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr).To4()
+		e.AddrIPv4 = append(e.AddrIPv4, ip)
+		e.addrSeen[ip.String()] = seen
+	}
+	return e
+}
+
+func TestServiceEntryMerge(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * cacheFlushGrace)
+	tests := []struct {
+		name    string
+		cached  *ServiceEntry
+		fresh   *ServiceEntry
+		flush   bool
+		want    []string
+		changed bool
+	}{
+		{"same address", cachedEntry(old, "192.0.2.1"), cachedEntry(now, "192.0.2.1"), false, []string{"192.0.2.1"}, false},
+		{"address added", cachedEntry(old, "192.0.2.1"), cachedEntry(now, "192.0.2.2"), false, []string{"192.0.2.1", "192.0.2.2"}, true},
+		{"cache flush", cachedEntry(old, "192.0.2.1", "192.0.2.2"), cachedEntry(now, "192.0.2.2"), true, []string{"192.0.2.2"}, true},
+		{"cache flush replacing", cachedEntry(old, "192.0.2.1"), cachedEntry(now, "192.0.2.2"), true, []string{"192.0.2.2"}, true},
+		{"cache flush within grace", cachedEntry(now, "192.0.2.1"), cachedEntry(now, "192.0.2.2"), true, []string{"192.0.2.1", "192.0.2.2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fresh.flushIPv4 = tt.flush
+			changed := tt.cached.merge(tt.fresh)
+			var got []string
+			for _, ip := range tt.cached.AddrIPv4 {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) || changed != tt.changed {
+				t.Errorf("merge = %v with addresses %v, want %v with %v", changed, got, tt.changed, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceEntryMergeService(t *testing.T) {
+	e := cachedEntry(time.Now(), "192.0.2.1")
+	e.Text = []string{"txtvers=1"}
+
+	fresh := NewServiceEntry("Printer", "_ipp._tcp", "local.")
+	if e.merge(fresh) {
+		t.Error("merging an entry without data reported a change")
+	}
+	fresh.Port = 632
+	fresh.Text = []string{"txtvers=2"}
+	if !e.merge(fresh) || e.Port != 632 || !reflect.DeepEqual(e.Text, fresh.Text) {
+		t.Errorf("merged port %d and text %q, want 632 and %q", e.Port, e.Text, fresh.Text)
+	}
+}
@@ -0,0 +1,211 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Service type advertised by Bonjour Sleep Proxies
+	sleepProxyService = "_sleep-proxy._udp"
+	// Time spent browsing for sleep proxies
+	sleepProxyBrowseTimeout = 2 * time.Second
+	// Number of registration attempts per proxy and the time to wait for
+	// a reply to each of them
+	sleepProxyAttempts = 3
+	sleepProxyTimeout  = 1 * time.Second
+	// EDNS0 Owner option code (draft-cheshire-edns0-owner-option)
+	edns0Owner = 4
+)
+
+// SleepProxy is a Bonjour Sleep Proxy found on the network.
+type SleepProxy struct {
+	Instance string       // Service instance name of the proxy
+	Metric   uint64       // Lower is better, derived from the instance name
+	Addr     *net.UDPAddr // Address registrations are sent to
+}
+
+// RegisterSleepProxy registers the records of the service with the best Bonjour
+// Sleep Proxy on the network, so it keeps answering for them while the host is
+// asleep and wakes it up with a magic packet when a client connects. It should
+// be called right before the host goes to sleep. The registration expires after
+// lease; the lease granted by the proxy is returned along with the proxy used.
+//
+// The hardware address of the interface the proxy is reached through is sent
+// as owner of the records, so the proxy knows which host to wake up.
+func (s *Server) RegisterSleepProxy(ctx context.Context, lease time.Duration) (*SleepProxy, time.Duration, error) {
+	proxies, err := s.findSleepProxies(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(proxies) == 0 {
+		return nil, 0, fmt.Errorf("zeroconf: no sleep proxy found")
+	}
+	for _, proxy := range proxies {
+		granted, e := s.registerWithSleepProxy(ctx, proxy, lease)
+		if e == nil {
+			return proxy, granted, nil
+		}
+		err = e
+	}
+	return nil, 0, err
+}
+
+// findSleepProxies browses for sleep proxies and returns them by increasing
+// metric.
+func (s *Server) findSleepProxies(ctx context.Context) ([]*SleepProxy, error) {
+	resolver, err := NewResolver(SelectIfaces(s.interfaces()))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sleepProxyBrowseTimeout)
+	defer cancel()
+
+	entries := make(chan *ServiceEntry)
+	if err := resolver.Browse(ctx, sleepProxyService, s.service.Domain, nil, entries); err != nil {
+		return nil, err
+	}
+	var proxies []*SleepProxy
+	for e := range entries {
+		var ip net.IP
+		if len(e.AddrIPv4) > 0 {
+			ip = e.AddrIPv4[0]
+		} else if len(e.AddrIPv6) > 0 {
+			ip = e.AddrIPv6[0]
+		} else {
+			continue
+		}
+		proxies = append(proxies, &SleepProxy{
+			Instance: e.Instance,
+			Metric:   sleepProxyMetric(e.Instance),
+			Addr:     &net.UDPAddr{IP: ip, Port: e.Port},
+		})
+	}
+	sort.SliceStable(proxies, func(i, j int) bool {
+		return proxies[i].Metric < proxies[j].Metric
+	})
+	return proxies, nil
+}
+
+// sleepProxyMetric parses the metric of a sleep proxy from its instance name,
+// e.g. "10-34-10-70.1 Living Room". The four numbers describe the proxy type,
+// portability, marginal and total power consumption; proxies with lower values
+// are preferred. Unparsable names get the highest metric.
+func sleepProxyMetric(instance string) uint64 {
+	fields := strings.SplitN(instance, " ", 2)
+	parts := strings.Split(strings.SplitN(fields[0], ".", 2)[0], "-")
+	if len(parts) != 4 {
+		return ^uint64(0)
+	}
+	var metric uint64
+	for _, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return ^uint64(0)
+		}
+		metric = metric<<8 | n
+	}
+	return metric
+}
+
+// registerWithSleepProxy sends our records to proxy in a DNS Update and waits
+// for its reply.
+func (s *Server) registerWithSleepProxy(ctx context.Context, proxy *SleepProxy, lease time.Duration) (time.Duration, error) {
+	iface := s.sleepProxyInterface(proxy.Addr.IP)
+	if iface == nil {
+		return 0, fmt.Errorf("zeroconf: no interface with a hardware address to reach %s", proxy.Addr)
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(s.service.Domain)
+	resp := new(dns.Msg)
+	s.mu.RLock()
+	s.composeLookupAnswers(resp, s.ttl, iface.Index)
+	s.mu.RUnlock()
+	m.Ns = resp.Answer
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(1440)
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_UL{Code: dns.EDNS0UL, Lease: uint32(lease / time.Second)},
+		&dns.EDNS0_LOCAL{
+			Code: edns0Owner,
+			// Version, sequence number and primary MAC address
+			Data: append([]byte{0, byte(s.sleepProxySeq.Add(1))}, iface.HardwareAddr...),
+		})
+	m.Extra = append(m.Extra, opt)
+	buf, err := m.Pack()
+	if err != nil {
+		return 0, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", proxy.Addr.String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	reply := make([]byte, 65536)
+	for i := 0; i < sleepProxyAttempts; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			return 0, err
+		}
+		conn.SetReadDeadline(time.Now().Add(sleepProxyTimeout))
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				break
+			}
+			var r dns.Msg
+			if err := r.Unpack(reply[:n]); err != nil || r.Id != m.Id || !r.Response {
+				continue
+			}
+			if r.Rcode != dns.RcodeSuccess {
+				return 0, fmt.Errorf("zeroconf: sleep proxy %s refused registration: %s", proxy.Instance, dns.RcodeToString[r.Rcode])
+			}
+			granted := lease
+			if o := r.IsEdns0(); o != nil {
+				for _, opt := range o.Option {
+					if ul, ok := opt.(*dns.EDNS0_UL); ok {
+						granted = time.Duration(ul.Lease) * time.Second
+					}
+				}
+			}
+			return granted, nil
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+	}
+	return 0, fmt.Errorf("zeroconf: no reply from sleep proxy %s", proxy.Instance)
+}
+
+// sleepProxyInterface returns the interface to register with a proxy at ip: the
+// one on the same subnet if any, else the first one with an Ethernet address.
+func (s *Server) sleepProxyInterface(ip net.IP) *net.Interface {
+	var fallback *net.Interface
+	for _, iface := range s.interfaces() {
+		if len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		iface := iface
+		if fallback == nil {
+			fallback = &iface
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(ip) {
+				return &iface
+			}
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,22 @@
+package zeroconf
+
+import "testing"
+
+func TestSleepProxyMetric(t *testing.T) {
+	tests := []struct {
+		instance string
+		want     uint64
+	}{
+		{"10-34-10-70 Living Room", 10<<24 | 34<<16 | 10<<8 | 70},
+		{"10-34-10-70.1 Living Room", 10<<24 | 34<<16 | 10<<8 | 70},
+		{"0-0-0-0", 0},
+		{"10-34-10 Living Room", ^uint64(0)},
+		{"10-34-10-300 Living Room", ^uint64(0)},
+		{"Living Room", ^uint64(0)},
+	}
+	for _, tt := range tests {
+		if got := sleepProxyMetric(tt.instance); got != tt.want {
+			t.Errorf("sleepProxyMetric(%q) = %d, want %d", tt.instance, got, tt.want)
+		}
+	}
+}
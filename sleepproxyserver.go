@@ -0,0 +1,396 @@
+package zeroconf
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Metric advertised in the instance name of our sleep proxy: a software
+	// proxy on a mains-powered, non-portable machine.
+	sleepProxyType          = 40
+	sleepProxyPortability   = 10
+	sleepProxyMarginalPower = 10
+	sleepProxyTotalPower    = 70
+
+	// Lease granted if the client did not ask for one, and the longest lease
+	// granted at all
+	sleepProxyDefaultLease = 2 * time.Hour
+	sleepProxyMaxLease     = 2 * time.Hour
+	// Interval at which expired registrations are removed
+	sleepProxyExpiryInterval = 10 * time.Second
+	// Minimum time between two wake-up packets for the same host
+	sleepProxyWakeInterval = 10 * time.Second
+	// Time for which a name answered by a host on the link is considered
+	// owned by that host
+	sleepProxyLiveWindow = 2 * time.Minute
+)
+
+// SleepProxyServer acts as a Bonjour Sleep Proxy: it advertises the
+// _sleep-proxy._udp service, accepts registrations from hosts about to go to
+// sleep and answers questions for their records while they are asleep. When a
+// client resolves one of their services or addresses, which it does before
+// connecting, the host is woken up with a Wake-on-LAN magic packet.
+// Registrations end when their lease expires or when the host is seen
+// answering for its records itself again.
+type SleepProxyServer struct {
+	server *Server
+	conn   *net.UDPConn
+
+	mu      sync.Mutex
+	clients map[string]*sleepProxyClient // by hardware address
+	live    map[string]liveName          // names answered by awake hosts, by lower-case name
+	done    chan struct{}
+	stop    sync.Once
+}
+
+// liveName records the last host seen answering for a name.
+type liveName struct {
+	from net.IP
+	seen time.Time
+}
+
+// sleepProxyClient holds the records registered by a sleeping host.
+type sleepProxyClient struct {
+	mac      net.HardwareAddr
+	records  []dns.RR
+	expires  time.Time
+	lastWake time.Time
+}
+
+// NewSleepProxyServer starts a sleep proxy advertised under the given name on
+// the given interfaces, or on all multicast interfaces if none are given. The
+// options configure the registration of the _sleep-proxy._udp service.
+func NewSleepProxyServer(name string, ifaces []net.Interface, opts ...ServerOption) (*SleepProxyServer, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	p := &SleepProxyServer{
+		conn:    conn,
+		clients: make(map[string]*sleepProxyClient),
+		live:    make(map[string]liveName),
+		done:    make(chan struct{}),
+	}
+	instance := fmt.Sprintf("%d-%d-%d-%d %s", sleepProxyType, sleepProxyPortability, sleepProxyMarginalPower, sleepProxyTotalPower, name)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	opts = append(opts, func(o *serverOpts) { o.delegate = p })
+	p.server, err = Register(instance, sleepProxyService, "local.", port, nil, ifaces, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go p.serve()
+	go p.expire()
+	return p, nil
+}
+
+// Shutdown withdraws the sleep proxy service and stops answering for the
+// registered hosts. Calling it again does nothing.
+func (p *SleepProxyServer) Shutdown() {
+	p.stop.Do(func() {
+		close(p.done)
+		p.conn.Close()
+		p.server.Shutdown()
+	})
+}
+
+// serve handles registration requests.
+func (p *SleepProxyServer) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-p.done:
+				return
+			default:
+				continue
+			}
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf[:n]); err != nil || msg.Response || msg.Opcode != dns.OpcodeUpdate {
+			continue
+		}
+		reply := p.register(&msg, from)
+		out, err := reply.Pack()
+		if err != nil {
+			continue
+		}
+		if _, err := p.conn.WriteToUDP(out, from); err != nil {
+			log.Printf("[WARN] zeroconf: failed to reply to sleep proxy registration from %s: %v", from, err)
+		}
+	}
+}
+
+// register stores the records of a registration request received from the
+// given address and returns the reply. Only hosts on the link of one of our
+// interfaces may register, and only for names nobody else owns.
+func (p *SleepProxyServer) register(msg *dns.Msg, from *net.UDPAddr) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	if !p.onLink(from.IP) {
+		log.Printf("[WARN] zeroconf: refused sleep proxy registration from off-link host %s", from.IP)
+		reply.Rcode = dns.RcodeRefused
+		return reply
+	}
+
+	var (
+		mac   net.HardwareAddr
+		lease = sleepProxyDefaultLease
+	)
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			switch o := o.(type) {
+			case *dns.EDNS0_UL:
+				if o.Lease > 0 {
+					lease = time.Duration(o.Lease) * time.Second
+				}
+			case *dns.EDNS0_LOCAL:
+				// Version, sequence number and primary MAC address
+				if o.Code == edns0Owner && len(o.Data) >= 8 {
+					mac = net.HardwareAddr(append([]byte{}, o.Data[2:8]...))
+				}
+			}
+		}
+	}
+	if mac == nil {
+		// Without an owner there is nobody to wake up.
+		reply.Rcode = dns.RcodeRefused
+		return reply
+	}
+	if lease > sleepProxyMaxLease {
+		lease = sleepProxyMaxLease
+	}
+
+	var records []dns.RR
+	for _, rr := range msg.Ns {
+		hdr := rr.Header()
+		if hdr.Class&^qClassCacheFlush != dns.ClassINET || hdr.Ttl == 0 {
+			continue
+		}
+		records = append(records, rr)
+	}
+
+	// Checked before taking p.mu, which answer takes with the server locked.
+	for _, rr := range records {
+		if p.serverOwns(rr.Header().Name) {
+			log.Printf("[WARN] zeroconf: refused sleep proxy registration from %s: %s is our own name", mac, rr.Header().Name)
+			reply.Rcode = dns.RcodeYXDomain
+			return reply
+		}
+	}
+	p.mu.Lock()
+	if name := p.ownedName(records, mac, from.IP); name != "" {
+		p.mu.Unlock()
+		log.Printf("[WARN] zeroconf: refused sleep proxy registration from %s: %s is owned by another host", mac, name)
+		reply.Rcode = dns.RcodeYXDomain
+		return reply
+	}
+	if len(records) == 0 {
+		delete(p.clients, mac.String())
+	} else {
+		p.clients[mac.String()] = &sleepProxyClient{
+			mac:     mac,
+			records: records,
+			expires: time.Now().Add(lease),
+		}
+	}
+	p.mu.Unlock()
+	log.Printf("[INFO] zeroconf: sleep proxy registration from %s: %d records for %s", mac, len(records), lease)
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(1440)
+	opt.Option = append(opt.Option, &dns.EDNS0_UL{Code: dns.EDNS0UL, Lease: uint32(lease / time.Second)})
+	reply.Extra = append(reply.Extra, opt)
+	return reply
+}
+
+// onLink reports whether ip is link-local or on the subnet of an address of
+// one of the interfaces we serve.
+func (p *SleepProxyServer) onLink(ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, iface := range p.server.interfaces() {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ownedName returns the first name of records which is registered by another
+// client or was recently answered by a host on the link other than the
+// registrant at from, or "" if there is none. The caller must hold p.mu.
+func (p *SleepProxyServer) ownedName(records []dns.RR, mac net.HardwareAddr, from net.IP) string {
+	// The registrant answered for its names while it was awake, from any of
+	// the addresses it registers.
+	own := []net.IP{from}
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.A:
+			own = append(own, rr.A)
+		case *dns.AAAA:
+			own = append(own, rr.AAAA)
+		}
+	}
+	for _, rr := range records {
+		name := rr.Header().Name
+		for key, c := range p.clients {
+			if key != mac.String() && c.hasName(name) {
+				return name
+			}
+		}
+		if l, ok := p.live[strings.ToLower(name)]; ok && time.Since(l.seen) < sleepProxyLiveWindow && !containsIP(own, l.from) {
+			return name
+		}
+	}
+	return ""
+}
+
+// serverOwns reports whether name is published by the server advertising the
+// sleep proxy.
+func (p *SleepProxyServer) serverOwns(name string) bool {
+	s := p.server
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.isHostName(name) || strings.EqualFold(name, s.service.ServiceInstanceName())
+}
+
+// expire removes registrations whose lease ran out.
+func (p *SleepProxyServer) expire() {
+	ticker := time.NewTicker(sleepProxyExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			for key, c := range p.clients {
+				if now.After(c.expires) {
+					delete(p.clients, key)
+				}
+			}
+			for name, l := range p.live {
+				if now.Sub(l.seen) >= sleepProxyLiveWindow {
+					delete(p.live, name)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// answer implements questionDelegate.
+func (p *SleepProxyServer) answer(q dns.Question, resp *dns.Msg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.clients {
+		wake := false
+		for _, rr := range c.records {
+			hdr := rr.Header()
+			if !strings.EqualFold(hdr.Name, q.Name) || (q.Qtype != dns.TypeANY && q.Qtype != hdr.Rrtype) {
+				continue
+			}
+			// The stored record is shared by every answer; the server
+			// adjusts TTLs and headers of what it sends.
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+			switch hdr.Rrtype {
+			case dns.TypeSRV, dns.TypeA, dns.TypeAAAA:
+				wake = true
+			}
+		}
+		if wake && time.Since(c.lastWake) >= sleepProxyWakeInterval {
+			c.lastWake = time.Now()
+			go func(mac net.HardwareAddr) {
+				if err := WakeOnLAN(mac); err != nil {
+					log.Printf("[WARN] zeroconf: failed to wake %s: %v", mac, err)
+				}
+			}(c.mac)
+		}
+	}
+}
+
+// observe implements questionDelegate. A host answering for its registered
+// records itself is awake again, so its registration is dropped. The names of
+// unique records answered by other hosts are remembered as owned by them.
+func (p *SleepProxyServer) observe(msg *dns.Msg, from net.Addr) {
+	if isLocalAddr(from) {
+		return
+	}
+	udpAddr, _ := from.(*net.UDPAddr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if udpAddr != nil {
+		now := time.Now()
+		for _, rr := range msg.Answer {
+			hdr := rr.Header()
+			if hdr.Ttl > 0 && hdr.Class&qClassCacheFlush != 0 {
+				p.live[strings.ToLower(hdr.Name)] = liveName{from: udpAddr.IP, seen: now}
+			}
+		}
+	}
+	for key, c := range p.clients {
+		if c.owns(msg.Answer) {
+			delete(p.clients, key)
+		}
+	}
+}
+
+// owns reports whether any of records is a live unique record registered by
+// the client.
+func (c *sleepProxyClient) owns(records []dns.RR) bool {
+	for _, rr := range records {
+		hdr := rr.Header()
+		if hdr.Ttl == 0 || hdr.Class&qClassCacheFlush == 0 {
+			continue
+		}
+		for _, own := range c.records {
+			if own.Header().Rrtype == hdr.Rrtype && strings.EqualFold(own.Header().Name, hdr.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasName reports whether the client registered a record named name.
+func (c *sleepProxyClient) hasName(name string) bool {
+	for _, own := range c.records {
+		if strings.EqualFold(own.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// WakeOnLAN broadcasts a Wake-on-LAN magic packet for the host with the given
+// hardware address.
+func WakeOnLAN(mac net.HardwareAddr) error {
+	if len(mac) != 6 {
+		return fmt.Errorf("zeroconf: invalid hardware address %s", mac)
+	}
+	packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...)
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4bcast, Port: 9})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
@@ -0,0 +1,102 @@
+package zeroconf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestSleepProxy returns a sleep proxy advertised by a server on a virtual
+// link, which does not serve registrations on its socket.
+func newTestSleepProxy(t *testing.T) *SleepProxyServer {
+	t.Helper()
+	s, events := registerVirtual(t, NewVirtualLink(), "192.0.2.1", "Proxy", "proxy", 5353)
+	waitEvent(t, events, EventAnnounced)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &SleepProxyServer{
+		server:  s,
+		conn:    conn,
+		clients: make(map[string]*sleepProxyClient),
+		live:    make(map[string]liveName),
+		done:    make(chan struct{}),
+	}
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+// sleepProxyUpdate returns a registration of the TXT record of name, owned by
+// the host with the given hardware address, if any.
+func sleepProxyUpdate(name string, mac net.HardwareAddr) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate("local.")
+	m.Ns = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120}, Txt: []string{"txtvers=1"}}}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.Option = append(opt.Option, &dns.EDNS0_UL{Code: dns.EDNS0UL, Lease: 600})
+	if mac != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edns0Owner, Data: append([]byte{0, 1}, mac...)})
+	}
+	m.Extra = append(m.Extra, opt)
+	return m
+}
+
+func TestSleepProxyServerRegister(t *testing.T) {
+	p := newTestSleepProxy(t)
+	sleeper := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	other := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	onLink := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 5353}
+	offLink := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5353}
+
+	tests := []struct {
+		name  string
+		msg   *dns.Msg
+		from  *net.UDPAddr
+		rcode int
+	}{
+		{"off-link host", sleepProxyUpdate("sleeper.local.", sleeper), offLink, dns.RcodeRefused},
+		{"no owner", sleepProxyUpdate("sleeper.local.", nil), onLink, dns.RcodeRefused},
+		{"unowned name", sleepProxyUpdate("sleeper.local.", sleeper), onLink, dns.RcodeSuccess},
+		{"renewal", sleepProxyUpdate("sleeper.local.", sleeper), onLink, dns.RcodeSuccess},
+		{"name of another client", sleepProxyUpdate("sleeper.local.", other), onLink, dns.RcodeYXDomain},
+		{"name of the proxy", sleepProxyUpdate("proxy.local.", other), onLink, dns.RcodeYXDomain},
+	}
+	for _, tt := range tests {
+		if reply := p.register(tt.msg, tt.from); reply.Rcode != tt.rcode {
+			t.Errorf("%s: rcode %s, want %s", tt.name, dns.RcodeToString[reply.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+
+	resp := new(dns.Msg)
+	p.answer(dns.Question{Name: "sleeper.local.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, resp)
+	if len(resp.Answer) != 1 {
+		t.Errorf("%d answers for the registered name, want 1", len(resp.Answer))
+	}
+}
+
+func TestSleepProxyServerLiveName(t *testing.T) {
+	p := newTestSleepProxy(t)
+	awake := &dns.Msg{Answer: []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "awake.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET | qClassCacheFlush, Ttl: 120}, Txt: []string{"txtvers=1"}}}}
+	p.observe(awake, &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 5353})
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	if reply := p.register(sleepProxyUpdate("awake.local.", mac), &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 5353}); reply.Rcode != dns.RcodeYXDomain {
+		t.Errorf("registering a name answered by another host: rcode %s, want YXDOMAIN", dns.RcodeToString[reply.Rcode])
+	}
+	if reply := p.register(sleepProxyUpdate("awake.local.", mac), &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 5353}); reply.Rcode != dns.RcodeSuccess {
+		t.Errorf("registering a name answered by the registrant: rcode %s, want NOERROR", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestSleepProxyServerShutdownTwice(t *testing.T) {
+	p := newTestSleepProxy(t)
+	p.Shutdown()
+	p.Shutdown()
+	select {
+	case <-p.done:
+	default:
+		t.Error("sleep proxy not stopped")
+	}
+}
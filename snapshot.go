@@ -0,0 +1,145 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Inventory is a normalized list of the services advertised on the network at
+// a given point in time. Services, addresses and TXT strings are sorted, so two
+// inventories of the same network compare equal and serialize identically.
+type Inventory struct {
+	Taken    time.Time          `json:"taken"`
+	Services []InventoryService `json:"services"`
+}
+
+// InventoryService describes a single service instance in an Inventory.
+type InventoryService struct {
+	Name     string   `json:"name"` // Service instance name, e.g. "My Printer._ipp._tcp.local."
+	Instance string   `json:"instance"`
+	Service  string   `json:"type"`
+	Domain   string   `json:"domain"`
+	HostName string   `json:"hostname"`
+	Port     int      `json:"port"`
+	Text     []string `json:"text"`
+	Addrs    []string `json:"addrs"`
+}
+
+// InventoryChange holds both versions of a service whose advertisement changed.
+type InventoryChange struct {
+	Before InventoryService `json:"before"`
+	After  InventoryService `json:"after"`
+}
+
+// InventoryDiff lists the differences between two inventories.
+type InventoryDiff struct {
+	Added   []InventoryService `json:"added"`
+	Removed []InventoryService `json:"removed"`
+	Changed []InventoryChange  `json:"changed"`
+}
+
+// Empty reports whether the diff contains no differences.
+func (d *InventoryDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Snapshot browses the given service types for the duration d and returns the
+// normalized inventory of all instances found. The types are browsed
+// concurrently, each with its own resolver configured by opts.
+func Snapshot(ctx context.Context, types []string, d time.Duration, opts ...ClientOption) (*Inventory, error) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		services = make(map[string]InventoryService)
+	)
+	for _, t := range types {
+		resolver, err := NewResolver(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %v", t, err)
+		}
+		entries := make(chan *ServiceEntry)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				svc := inventoryService(e)
+				mu.Lock()
+				services[svc.Name] = svc
+				mu.Unlock()
+			}
+		}()
+		if err := resolver.Browse(ctx, t, "local.", nil, entries); err != nil {
+			cancel()
+			wg.Wait()
+			return nil, fmt.Errorf("snapshot %s: %v", t, err)
+		}
+	}
+	<-ctx.Done()
+	wg.Wait()
+
+	inv := &Inventory{Taken: time.Now().UTC()}
+	for _, svc := range services {
+		inv.Services = append(inv.Services, svc)
+	}
+	sort.Slice(inv.Services, func(i, j int) bool {
+		return inv.Services[i].Name < inv.Services[j].Name
+	})
+	return inv, nil
+}
+
+// inventoryService converts a ServiceEntry into its normalized form.
+func inventoryService(e *ServiceEntry) InventoryService {
+	svc := InventoryService{
+		Name:     e.ServiceInstanceName(),
+		Instance: e.Instance,
+		Service:  e.Service,
+		Domain:   e.Domain,
+		HostName: e.HostName,
+		Port:     e.Port,
+		Text:     append([]string{}, e.Text...),
+		Addrs:    []string{},
+	}
+	for _, ip := range e.AddrIPv4 {
+		svc.Addrs = append(svc.Addrs, ip.String())
+	}
+	for _, ip := range e.AddrIPv6 {
+		svc.Addrs = append(svc.Addrs, ip.String())
+	}
+	sort.Strings(svc.Text)
+	sort.Strings(svc.Addrs)
+	return svc
+}
+
+// CompareSnapshots returns the services added, removed and changed in b
+// compared to a.
+func CompareSnapshots(a, b *Inventory) InventoryDiff {
+	var diff InventoryDiff
+	before := make(map[string]InventoryService, len(a.Services))
+	for _, svc := range a.Services {
+		before[svc.Name] = svc
+	}
+	for _, svc := range b.Services {
+		old, ok := before[svc.Name]
+		if !ok {
+			diff.Added = append(diff.Added, svc)
+			continue
+		}
+		delete(before, svc.Name)
+		if !reflect.DeepEqual(old, svc) {
+			diff.Changed = append(diff.Changed, InventoryChange{Before: old, After: svc})
+		}
+	}
+	for _, svc := range a.Services {
+		if _, ok := before[svc.Name]; ok {
+			diff.Removed = append(diff.Removed, svc)
+		}
+	}
+	return diff
+}
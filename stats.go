@@ -0,0 +1,213 @@
+package zeroconf
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResolverStats is a snapshot of the counters collected by a Resolver. All
+// counters are cumulative since the Resolver was created.
+type ResolverStats struct {
+	PacketsReceivedIPv4 uint64 // Packets read from IPv4 sockets
+	PacketsReceivedIPv6 uint64 // Packets read from IPv6 sockets
+	UnpackFailures      uint64 // Packets that could not be decoded as DNS messages
+	AnswersMatched      uint64 // PTR/SRV/TXT records matching the running query
+	LateAnswers         uint64 // Matching records received after the query's answer window
+	EntriesEmitted      uint64 // Entries delivered to the subscriber
+	QueriesSent         uint64 // Query packets written, counted per interface
+	SendErrors          uint64 // Query packets which could not be written, e.g. timed out
+	ChannelDrops        uint64 // Decoded messages discarded before being processed, e.g. while the processing loop was behind
+	SocketRebinds       uint64 // Multicast sockets replaced after persistent read errors
+	OffLinkDrops        uint64 // Packets dropped since their TTL shows they came from another link
+	OffSubnetDrops      uint64 // Packets dropped since their source is not on a local subnet, see ValidationPolicy
+	RejectedRecords     uint64 // Records dropped since their names do not fit the query, see ValidationPolicy
+
+	Interfaces []InterfaceStats // Readiness of the joined interfaces
+}
+
+// InterfaceStats describes the readiness of an interface the multicast groups
+// were joined on. An interface which never receives anything usually means a
+// firewall lets outgoing mDNS queries pass but blocks incoming packets.
+type InterfaceStats struct {
+	Name               string
+	Index              int
+	Joined             time.Time
+	FirstPacketLatency time.Duration // Time from joining to the first packet received, zero if none yet
+	Silent             bool          // No packet was received within the readiness timeout
+	SendErrors         uint64        // Query packets which could not be written on the interface
+	LastSendError      error         // Error of the last query written on the interface, nil if it was sent
+}
+
+// defaultReadinessTimeout is the time after which an interface that did not
+// receive any packet is flagged as silent.
+const defaultReadinessTimeout = 10 * time.Second
+
+// ifaceStat holds the live readiness data of an interface.
+type ifaceStat struct {
+	iface       net.Interface
+	joined      time.Time
+	firstPacket atomic.Int64 // Unix time in nanoseconds of the first packet
+	warned      atomic.Bool
+	sendErrors  atomic.Uint64
+
+	mu          sync.Mutex
+	lastSendErr error
+}
+
+// silent reports whether no packet arrived within timeout after joining.
+func (i *ifaceStat) silent(timeout time.Duration) bool {
+	return i.firstPacket.Load() == 0 && time.Since(i.joined) > timeout
+}
+
+// clientStats holds the live counters behind ResolverStats.
+type clientStats struct {
+	packetsIPv4    atomic.Uint64
+	packetsIPv6    atomic.Uint64
+	unpackFailures atomic.Uint64
+	answersMatched atomic.Uint64
+	lateAnswers    atomic.Uint64
+	entriesEmitted atomic.Uint64
+	queriesSent    atomic.Uint64
+	sendErrors     atomic.Uint64
+	channelDrops   atomic.Uint64
+	socketRebinds  atomic.Uint64
+	offLinkDrops   atomic.Uint64
+	// Dropped by the validation policy
+	offSubnetDrops  atomic.Uint64
+	rejectedRecords atomic.Uint64
+
+	// Interfaces by index, set up once when the client is created.
+	ifaces           map[int]*ifaceStat
+	readinessTimeout time.Duration
+}
+
+// initInterfaces starts tracking the readiness of the given interfaces.
+func (s *clientStats) initInterfaces(ifaces []net.Interface, timeout time.Duration) {
+	now := time.Now()
+	s.readinessTimeout = timeout
+	s.ifaces = make(map[int]*ifaceStat, len(ifaces))
+	for _, iface := range ifaces {
+		s.ifaces[iface.Index] = &ifaceStat{iface: iface, joined: now}
+	}
+}
+
+// countSend records the outcome of writing a query on the interface with the
+// given index.
+func (s *clientStats) countSend(ifIndex int, err error) {
+	if err == nil {
+		s.queriesSent.Add(1)
+	} else {
+		s.sendErrors.Add(1)
+	}
+	if i, ok := s.ifaces[ifIndex]; ok {
+		if err != nil {
+			i.sendErrors.Add(1)
+		}
+		i.mu.Lock()
+		i.lastSendErr = err
+		i.mu.Unlock()
+	}
+}
+
+// countIfacePacket records the arrival of a packet on the interface with the
+// given index.
+func (s *clientStats) countIfacePacket(ifIndex int) {
+	if i, ok := s.ifaces[ifIndex]; ok && i.firstPacket.Load() == 0 {
+		i.firstPacket.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+func (s *clientStats) snapshot() ResolverStats {
+	return ResolverStats{
+		PacketsReceivedIPv4: s.packetsIPv4.Load(),
+		PacketsReceivedIPv6: s.packetsIPv6.Load(),
+		UnpackFailures:      s.unpackFailures.Load(),
+		AnswersMatched:      s.answersMatched.Load(),
+		LateAnswers:         s.lateAnswers.Load(),
+		EntriesEmitted:      s.entriesEmitted.Load(),
+		QueriesSent:         s.queriesSent.Load(),
+		SendErrors:          s.sendErrors.Load(),
+		ChannelDrops:        s.channelDrops.Load(),
+		SocketRebinds:       s.socketRebinds.Load(),
+		OffLinkDrops:        s.offLinkDrops.Load(),
+		OffSubnetDrops:      s.offSubnetDrops.Load(),
+		RejectedRecords:     s.rejectedRecords.Load(),
+		Interfaces:          s.interfaceStats(),
+	}
+}
+
+func (s *clientStats) interfaceStats() []InterfaceStats {
+	var stats []InterfaceStats
+	for _, i := range s.ifaces {
+		st := InterfaceStats{
+			Name:       i.iface.Name,
+			Index:      i.iface.Index,
+			Joined:     i.joined,
+			Silent:     i.silent(s.readinessTimeout),
+			SendErrors: i.sendErrors.Load(),
+		}
+		i.mu.Lock()
+		st.LastSendError = i.lastSendErr
+		i.mu.Unlock()
+		if first := i.firstPacket.Load(); first != 0 {
+			st.FirstPacketLatency = time.Unix(0, first).Sub(i.joined)
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(a, b int) bool {
+		return stats[a].Index < stats[b].Index
+	})
+	return stats
+}
+
+// countPacket increments the per family packet counter for a datagram
+// received from src.
+func (s *clientStats) countPacket(src net.Addr) {
+	if udpAddr, ok := src.(*net.UDPAddr); ok && udpAddr.IP.To4() == nil {
+		s.packetsIPv6.Add(1)
+		return
+	}
+	s.packetsIPv4.Add(1)
+}
+
+// ServerStats is a snapshot of the counters collected by a Server. All
+// counters are cumulative since the service was registered.
+type ServerStats struct {
+	QuestionsReceived  uint64 // Questions in queries received from other hosts
+	MulticastResponses uint64 // Responses to questions sent by multicast
+	UnicastResponses   uint64 // Responses to questions sent by unicast, including legacy ones
+	ProbesSent         uint64 // Probe queries sent
+	ConflictsDetected  uint64 // Name conflicts that led to a rename
+	GoodbyesSent       uint64 // Goodbye packets sent, counted per interface
+	SendErrors         uint64 // Packets which could not be sent, e.g. timed out
+	OffLinkDrops       uint64 // Packets dropped since their TTL shows they came from another link
+}
+
+// serverStats holds the live counters behind ServerStats.
+type serverStats struct {
+	questionsReceived  atomic.Uint64
+	multicastResponses atomic.Uint64
+	unicastResponses   atomic.Uint64
+	probesSent         atomic.Uint64
+	conflictsDetected  atomic.Uint64
+	goodbyesSent       atomic.Uint64
+	sendErrors         atomic.Uint64
+	offLinkDrops       atomic.Uint64
+}
+
+// snapshot returns the current values of the counters.
+func (s *serverStats) snapshot() ServerStats {
+	return ServerStats{
+		QuestionsReceived:  s.questionsReceived.Load(),
+		MulticastResponses: s.multicastResponses.Load(),
+		UnicastResponses:   s.unicastResponses.Load(),
+		ProbesSent:         s.probesSent.Load(),
+		ConflictsDetected:  s.conflictsDetected.Load(),
+		GoodbyesSent:       s.goodbyesSent.Load(),
+		SendErrors:         s.sendErrors.Load(),
+		OffLinkDrops:       s.offLinkDrops.Load(),
+	}
+}
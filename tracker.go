@@ -0,0 +1,84 @@
+package zeroconf
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordKey identifies a record sent on an interface. An interface index of
+// zero stands for all interfaces.
+type recordKey struct {
+	name    string
+	rrtype  uint16
+	ifIndex int
+}
+
+func newRecordKey(rr dns.RR, ifIndex int) recordKey {
+	hdr := rr.Header()
+	return recordKey{name: strings.ToLower(hdr.Name), rrtype: hdr.Rrtype, ifIndex: ifIndex}
+}
+
+// multicastTracker remembers when records were last multicast.
+type multicastTracker struct {
+	mu   sync.Mutex
+	last map[recordKey]time.Time
+}
+
+func newMulticastTracker() *multicastTracker {
+	return &multicastTracker{last: make(map[recordKey]time.Time)}
+}
+
+// mark records that the given records were multicast on the interface.
+func (t *multicastTracker) mark(records []dns.RR, ifIndex int) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, rr := range records {
+		t.last[newRecordKey(rr, ifIndex)] = now
+	}
+}
+
+// lastSent returns when rr was last multicast on the interface, either alone
+// or on all interfaces at once.
+func (t *multicastTracker) lastSent(rr dns.RR, ifIndex int) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last := t.last[newRecordKey(rr, 0)]
+	if ifIndex != 0 {
+		if l := t.last[newRecordKey(rr, ifIndex)]; l.After(last) {
+			last = l
+		}
+	}
+	return last
+}
+
+// minMulticastInterval is the minimum time between two multicasts of the same
+// record on an interface (RFC6762 section 6).
+const minMulticastInterval = 1 * time.Second
+
+// withoutRecent returns the records not multicast on the interface within the
+// last interval.
+func (t *multicastTracker) withoutRecent(records []dns.RR, ifIndex int, interval time.Duration) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		if time.Since(t.lastSent(rr, ifIndex)) >= interval {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// recentlyMulticast reports whether all records were multicast on the
+// interface within the last quarter of their TTL.
+func (t *multicastTracker) recentlyMulticast(records []dns.RR, ifIndex int) bool {
+	for _, rr := range records {
+		quarter := time.Duration(rr.Header().Ttl) * time.Second / 4
+		if time.Since(t.lastSent(rr, ifIndex)) > quarter {
+			return false
+		}
+	}
+	return true
+}
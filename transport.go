@@ -0,0 +1,318 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// transportBufferSize is the number of packets buffered per user of a
+// Transport. Packets arriving while the buffer is full are dropped for that
+// user.
+const transportBufferSize = 256
+
+// Transport is a set of mDNS multicast sockets shared by a Server and any
+// number of Resolvers in the same process, so port 5353 is bound and the
+// multicast groups are joined only once. Every received packet is handed to
+// all users. Pass it with WithServerTransport and WithTransport; users do not
+// close it, Close does once they are all shut down.
+type Transport struct {
+	ipv4conn *ipv4.PacketConn
+	ipv6conn *ipv6.PacketConn
+	ifaces   []net.Interface
+
+	mu         sync.Mutex
+	subs       map[chan *transportPacket]struct{}
+	closed     bool
+	membership Membership
+	// Number of users holding the groups joined on an interface, by index.
+	// The groups are left when the last one lets go.
+	holds map[int]int
+
+	// Link and address of a virtual transport, which has no sockets
+	link *VirtualLink
+	addr net.IP
+	// Packets a virtual transport received before it had any user, as a
+	// socket buffers them until they are read
+	backlog []*transportPacket
+	// Receives the read errors of the sockets, if set
+	events connEvents
+}
+
+// transportPacket is a packet received by a Transport.
+type transportPacket struct {
+	data []byte
+	info packetInfo
+	from net.Addr
+}
+
+// NewTransport joins the mDNS multicast groups on the given interfaces, or on
+// all multicast interfaces if none are given.
+func NewTransport(ifaces []net.Interface) (*Transport, error) {
+	return newTransport(ifaces, IPv4AndIPv6, applyConnOpts(nil))
+}
+
+// newTransport joins the multicast groups of the given IP traffic types only,
+// on sockets set up according to o. If a single type is requested, failing to
+// join it is an error.
+func newTransport(ifaces []net.Interface, traffic IPType, o connOpts) (*Transport, error) {
+	if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces(nil)
+	}
+	var (
+		ipv4conn   *ipv4.PacketConn
+		ipv6conn   *ipv6.PacketConn
+		err4, err6 error
+		membership Membership
+	)
+	if traffic&IPv4 > 0 {
+		if ipv4conn, err4 = newUdp4Multicast(ifaces, &membership, o); err4 != nil {
+			log.Printf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
+		}
+	}
+	if traffic&IPv6 > 0 {
+		if ipv6conn, err6 = newUdp6Multicast(ifaces, &membership, o); err6 != nil {
+			log.Printf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
+		}
+	}
+	switch {
+	case traffic == IPv4 && err4 != nil:
+		return nil, fmt.Errorf("no IPv4 interface joined: %v", err4)
+	case traffic == IPv6 && err6 != nil:
+		return nil, fmt.Errorf("no IPv6 interface joined: %v", err6)
+	case ipv4conn == nil && ipv6conn == nil:
+		// No supported interface left.
+		return nil, fmt.Errorf("no supported interface")
+	}
+	t := newTransportConns(ipv4conn, ipv6conn, ifaces, o.events)
+	t.membership = membership
+	// The transport holds the groups it joined itself, so they stay joined
+	// for its resolvers when the servers let go of them.
+	for _, iface := range ifaces {
+		if t.joinedOn(iface.Index) {
+			t.holds[iface.Index] = 1
+		}
+	}
+	return t, nil
+}
+
+// newTransportConns starts receiving on the given connections, either of which
+// may be nil, reporting read errors to events.
+func newTransportConns(ipv4conn *ipv4.PacketConn, ipv6conn *ipv6.PacketConn, ifaces []net.Interface, events connEvents) *Transport {
+	t := &Transport{
+		ipv4conn: ipv4conn,
+		ipv6conn: ipv6conn,
+		ifaces:   ifaces,
+		subs:     make(map[chan *transportPacket]struct{}),
+		holds:    make(map[int]int),
+		events:   events,
+	}
+	if ipv4conn != nil {
+		readFrom := packetReader(ipv4conn)
+		go runRecovering("IPv4 transport receiver", func() { t.recv(readFrom, false) })
+	}
+	if ipv6conn != nil {
+		readFrom := packetReader(ipv6conn)
+		go runRecovering("IPv6 transport receiver", func() { t.recv(readFrom, true) })
+	}
+	return t
+}
+
+// Close closes the sockets and ends the subscriptions of all users.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	for ch := range t.subs {
+		close(ch)
+		delete(t.subs, ch)
+	}
+	t.mu.Unlock()
+
+	if t.link != nil {
+		t.link.detach(t)
+	}
+	if t.ipv4conn != nil {
+		t.ipv4conn.Close()
+	}
+	if t.ipv6conn != nil {
+		t.ipv6conn.Close()
+	}
+	return nil
+}
+
+// Membership returns the interfaces the multicast groups were joined on, and
+// those on which joining failed. It is empty for sockets handed over by file
+// descriptor.
+func (t *Transport) Membership() Membership {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.membership
+}
+
+// interfaces returns the interfaces the transport was created for, and those
+// its responder took into use since.
+func (t *Transport) interfaces() []net.Interface {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ifaces
+}
+
+// joinedOn reports whether the group of any family is joined on the interface
+// with the given index. The caller must hold t.mu.
+func (t *Transport) joinedOn(index int) bool {
+	return hasInterface(t.membership.IPv4Joined, index) || hasInterface(t.membership.IPv6Joined, index)
+}
+
+// hold takes a hold on the groups already joined on the interfaces, e.g. when
+// the transport was created for them, so they stay joined until released.
+func (t *Transport) hold(ifaces []net.Interface) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, iface := range ifaces {
+		if t.joinedOn(iface.Index) {
+			t.holds[iface.Index]++
+		}
+	}
+}
+
+// join takes a hold on the groups on iface, joining them on the sockets unless
+// another user did already, and reports whether any is joined. Outcomes of
+// joining are reported to events.
+func (t *Transport) join(iface *net.Interface, events connEvents) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.joinedOn(iface.Index) && !t.joinSockets(iface, events, t.membership.record) {
+		return false
+	}
+	t.holds[iface.Index]++
+	if !hasInterface(t.ifaces, iface.Index) {
+		ifaces := make([]net.Interface, 0, len(t.ifaces)+1)
+		t.ifaces = append(append(ifaces, t.ifaces...), *iface)
+	}
+	return true
+}
+
+// leave releases a hold on the groups on iface, leaving them on the sockets
+// once no user holds them any more.
+func (t *Transport) leave(iface *net.Interface, events connEvents) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.holds[iface.Index] > 1 {
+		t.holds[iface.Index]--
+		return
+	}
+	delete(t.holds, iface.Index)
+	t.leaveSockets(iface, events)
+}
+
+// rejoin leaves and joins again the groups on iface, so that a fresh
+// membership report is sent, without changing the holds on them.
+func (t *Transport) rejoin(iface *net.Interface, events connEvents) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.leaveSockets(iface, events)
+	if !t.joinSockets(iface, events, t.membership.rejoined) {
+		return fmt.Errorf("no multicast group joined")
+	}
+	return nil
+}
+
+// joinSockets joins the groups on iface, recording the outcomes with record,
+// and reports whether any was joined. The caller must hold t.mu.
+func (t *Transport) joinSockets(iface *net.Interface, events connEvents, record func(bool, net.Interface, error)) bool {
+	joined := false
+	if t.ipv4conn != nil && interfaceSupportsIPv4(iface) {
+		err := t.ipv4conn.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4})
+		joined = joined || err == nil
+		record(false, *iface, err)
+		events.joined(false, *iface, err)
+	}
+	if t.ipv6conn != nil && interfaceSupportsIPv6(iface) {
+		err := t.ipv6conn.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6})
+		joined = joined || err == nil
+		record(true, *iface, err)
+		events.joined(true, *iface, err)
+	}
+	return joined
+}
+
+// leaveSockets leaves the groups on iface. The caller must hold t.mu.
+func (t *Transport) leaveSockets(iface *net.Interface, events connEvents) {
+	if t.ipv4conn != nil && t.ipv4conn.LeaveGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4}) == nil {
+		events.emit(ConnEvent{Type: ConnGroupLeft, Interface: *iface})
+	}
+	if t.ipv6conn != nil && t.ipv6conn.LeaveGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6}) == nil {
+		events.emit(ConnEvent{Type: ConnGroupLeft, Interface: *iface, IPv6: true})
+	}
+	t.membership.remove(iface.Index)
+}
+
+// subscribe returns a channel receiving all packets, and the function ending
+// the subscription.
+func (t *Transport) subscribe() (<-chan *transportPacket, func()) {
+	ch := make(chan *transportPacket, transportBufferSize)
+	t.mu.Lock()
+	if t.closed {
+		close(ch)
+	} else {
+		t.subs[ch] = struct{}{}
+		for _, p := range t.backlog {
+			ch <- p
+		}
+		t.backlog = nil
+	}
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.subs[ch]; ok {
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// recv reads packets until the socket is closed and hands them to all users.
+// ipv6 tells the family of the socket.
+func (t *Transport) recv(readFrom func([]byte) (int, packetInfo, net.Addr, error), ipv6 bool) {
+	buf := make([]byte, 65536)
+	for {
+		n, info, from, err := readFrom(buf)
+		if err != nil {
+			t.mu.Lock()
+			closed := t.closed
+			t.mu.Unlock()
+			if closed {
+				return
+			}
+			t.events.failed(ipv6, nil, err)
+			continue
+		}
+		t.dispatch(&transportPacket{data: append([]byte(nil), buf[:n]...), info: info, from: from})
+	}
+}
+
+// dispatch hands a received packet to all users. It is dropped for users whose
+// buffer is full.
+func (t *Transport) dispatch(p *transportPacket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.subs) == 0 && t.link != nil && len(t.backlog) < transportBufferSize {
+		t.backlog = append(t.backlog, p)
+		return
+	}
+	for ch := range t.subs {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package zeroconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Maximum length of a single TXT string (RFC6763 section 6.1)
+	txtMaxStringSize = 255
+	// Maximum total size of a TXT record, whether built with TXTRecord or
+	// passed to a registration, leaving room for the other records within
+	// the maximum mDNS packet size of 9000 bytes (RFC6762 section 17)
+	txtMaxSize = 8900
+	// Total size up to which a TXT record is known to work well
+	// (RFC6763 section 6.2)
+	TXTRecommendedSize = 400
+)
+
+// TXTRecord builds the strings of a DNS-SD TXT record from key/value pairs, as
+// passed to Register and Server.SetText. Keys are matched case-insensitively
+// and keep the order they were first set in.
+//
+//	txt := zeroconf.NewTXTRecord()
+//	txt.Set("txtvers", "1")
+//	txt.SetFlag("color")
+//	server, err := zeroconf.Register("Printer", "_ipp._tcp", "", 631, txt.Strings(), nil)
+type TXTRecord struct {
+	entries []txtEntry
+}
+
+type txtEntry struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// NewTXTRecord returns an empty TXT record builder.
+func NewTXTRecord() *TXTRecord {
+	return &TXTRecord{}
+}
+
+// Set sets key to value, replacing any previous value. The value may hold
+// arbitrary bytes, including an empty string which is different from a boolean
+// attribute.
+func (t *TXTRecord) Set(key, value string) error {
+	return t.set(txtEntry{key: key, value: value, hasValue: true})
+}
+
+// SetFlag sets key as a boolean attribute, i.e. a key without value which is
+// true when present (RFC6763 section 6.4).
+func (t *TXTRecord) SetFlag(key string) error {
+	return t.set(txtEntry{key: key})
+}
+
+// Delete removes key.
+func (t *TXTRecord) Delete(key string) {
+	if i := t.index(key); i >= 0 {
+		t.entries = append(t.entries[:i], t.entries[i+1:]...)
+	}
+}
+
+// Size returns the size of the record on the wire. RFC6763 recommends keeping
+// it below TXTRecommendedSize bytes.
+func (t *TXTRecord) Size() int {
+	size := 0
+	for _, e := range t.entries {
+		size += 1 + len(e.String())
+	}
+	return size
+}
+
+// Strings returns the strings of the record.
+func (t *TXTRecord) Strings() []string {
+	text := make([]string, 0, len(t.entries))
+	for _, e := range t.entries {
+		text = append(text, e.String())
+	}
+	return text
+}
+
+func (t *TXTRecord) set(e txtEntry) error {
+	if err := validateTXTKey(e.key); err != nil {
+		return err
+	}
+	if len(e.String()) > txtMaxStringSize {
+		return fmt.Errorf("txt: %q exceeds %d bytes", e.key, txtMaxStringSize)
+	}
+	size := t.Size() + 1 + len(e.String())
+	i := t.index(e.key)
+	if i >= 0 {
+		size -= 1 + len(t.entries[i].String())
+	}
+	if size > txtMaxSize {
+		return fmt.Errorf("txt: record would exceed %d bytes", txtMaxSize)
+	}
+	if i >= 0 {
+		t.entries[i] = e
+	} else {
+		t.entries = append(t.entries, e)
+	}
+	return nil
+}
+
+func (t *TXTRecord) index(key string) int {
+	for i, e := range t.entries {
+		if strings.EqualFold(e.key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// String returns the TXT string of the entry: "key=value" or "key".
+func (e txtEntry) String() string {
+	if !e.hasValue {
+		return e.key
+	}
+	return e.key + "=" + e.value
+}
+
+// splitTXT checks the strings of a TXT record: a string longer than the 255
+// bytes a TXT character-string can hold is rejected, since splitting it would
+// cut a key=value pair in two, as is text whose total size exceeds txtMaxSize
+// bytes.
+func splitTXT(text []string) ([]string, error) {
+	size := 0
+	for _, t := range text {
+		if len(t) > txtMaxStringSize {
+			return nil, fmt.Errorf("txt: string of %d bytes exceeds %d bytes", len(t), txtMaxStringSize)
+		}
+		size += 1 + len(t)
+	}
+	if size > txtMaxSize {
+		return nil, fmt.Errorf("txt: %d bytes exceed the maximum of %d", size, txtMaxSize)
+	}
+	return append([]string(nil), text...), nil
+}
+
+// validateTXTKey checks a key against RFC6763 section 6.4: at least one
+// printable US-ASCII character, excluding '='.
+func validateTXTKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("txt: empty key")
+	}
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c < 0x20 || c > 0x7e || c == '=' {
+			return fmt.Errorf("txt: invalid character %q in key %q", c, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package zeroconf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTXTRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(r *TXTRecord) error
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "pairs and flags",
+			build: func(r *TXTRecord) error {
+				r.Set("txtvers", "1")
+				r.SetFlag("color")
+				return r.Set("note", "")
+			},
+			want: []string{"txtvers=1", "color", "note="},
+		},
+		{
+			name: "keys replaced case-insensitively in place",
+			build: func(r *TXTRecord) error {
+				r.Set("a", "1")
+				r.Set("b", "2")
+				return r.Set("A", "3")
+			},
+			want: []string{"A=3", "b=2"},
+		},
+		{
+			name: "delete",
+			build: func(r *TXTRecord) error {
+				r.Set("a", "1")
+				r.Set("b", "2")
+				r.Delete("A")
+				return nil
+			},
+			want: []string{"b=2"},
+		},
+		{
+			name:    "empty key",
+			build:   func(r *TXTRecord) error { return r.Set("", "x") },
+			want:    []string{},
+			wantErr: true,
+		},
+		{
+			name:    "key with equals sign",
+			build:   func(r *TXTRecord) error { return r.SetFlag("a=b") },
+			want:    []string{},
+			wantErr: true,
+		},
+		{
+			name:    "string over 255 bytes",
+			build:   func(r *TXTRecord) error { return r.Set("k", strings.Repeat("x", 254)) },
+			want:    []string{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTXTRecord()
+			if err := tt.build(r); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got := r.Strings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			size := 0
+			for _, s := range tt.want {
+				size += 1 + len(s)
+			}
+			if r.Size() != size {
+				t.Errorf("got size %d, want %d", r.Size(), size)
+			}
+		})
+	}
+}
+
+func TestSplitTXT(t *testing.T) {
+	long := strings.Repeat("x", 255)
+	tests := []struct {
+		name    string
+		text    []string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"pairs", []string{"a=1", "b"}, []string{"a=1", "b"}, false},
+		{"string of 255 bytes", []string{long}, []string{long}, false},
+		{"string over 255 bytes", []string{"k=" + long}, nil, true},
+		{"total over limit", strings.Split(strings.Repeat(long+",", 35), ",")[:35], nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitTXT(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -11,3 +11,54 @@ func parseSubtypes(service string) (string, []string) {
 func trimDot(s string) string {
 	return strings.Trim(s, ".")
 }
+
+// hasSuffixFold reports whether the DNS name s ends with suffix, ignoring case
+// as DNS names compare case-insensitively.
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// instanceLabel returns the instance part of the service instance name, whose
+// service name suffix may differ in case.
+func instanceLabel(name, service string) string {
+	if hasSuffixFold(name, service) {
+		name = name[:len(name)-len(service)]
+	}
+	return trimDot(name)
+}
+
+// isInstanceOf reports whether name is a service instance name of service: a
+// single label, in which dots are escaped, followed by the service name. Names
+// of other service types ending alike, e.g. x._a_ipp._tcp.local. for
+// _ipp._tcp.local., do not qualify.
+func isInstanceOf(name, service string) bool {
+	if !hasSuffixFold(name, "."+service) {
+		return false
+	}
+	label := name[:len(name)-len(service)-1]
+	if label == "" {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		switch label[i] {
+		case '\\':
+			i++
+		case '.':
+			return false
+		}
+	}
+	return true
+}
+
+// equalStrings reports whether a and b hold the same strings in the same order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
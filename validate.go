@@ -0,0 +1,128 @@
+package zeroconf
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ValidationPolicy selects the checks a resolver applies to received packets
+// and records before they are used to build entries, so responses forwarded
+// from other links or forged by hosts elsewhere do not reach the subscriber.
+// Packets and records which fail a check are dropped and counted in
+// ResolverStats. The zero value applies no check.
+type ValidationPolicy struct {
+	// Drop packets whose source address is neither link-local nor on the
+	// subnet of an interface of this host (RFC 6762 section 11).
+	OnLinkSource bool
+	// Drop multicast packets whose IP TTL or hop limit is not 255, as
+	// WithHopLimitCheck does.
+	HopLimit bool
+	// Drop records outside the domain queried, PTR records of the service
+	// type pointing to names of other service types, and SRV records whose
+	// target lies outside the domain.
+	MatchQuestion bool
+}
+
+// StrictValidation applies every check of ValidationPolicy.
+var StrictValidation = ValidationPolicy{OnLinkSource: true, HopLimit: true, MatchQuestion: true}
+
+// localNetsRefresh is the age after which the subnets of the interfaces are
+// read again, to follow address changes.
+const localNetsRefresh = 10 * time.Second
+
+// localNets caches the subnets of the interfaces of this host.
+type localNets struct {
+	mu      sync.Mutex
+	nets    []*net.IPNet
+	updated time.Time
+}
+
+// contains reports whether ip is link-local or on one of the subnets.
+func (l *localNets) contains(ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.updated) > localNetsRefresh {
+		l.nets = l.nets[:0]
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok {
+					l.nets = append(l.nets, ipnet)
+				}
+			}
+		}
+		l.updated = time.Now()
+	}
+	for _, ipnet := range l.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptSource applies the source checks of the policy to a packet received
+// from src, counting the packets dropped.
+func (c *client) acceptSource(src net.Addr) bool {
+	if !c.validation.OnLinkSource {
+		return true
+	}
+	udpAddr, ok := src.(*net.UDPAddr)
+	if !ok || c.localNets.contains(udpAddr.IP) {
+		return true
+	}
+	c.stats.offSubnetDrops.Add(1)
+	return false
+}
+
+// validRecords returns the records of sections which fit the query of params,
+// counting the records dropped.
+func (c *client) validRecords(sections []dns.RR, params *lookupParams) []dns.RR {
+	if !c.validation.MatchQuestion {
+		return sections
+	}
+	domain := "." + trimDot(params.Domain) + "."
+	if domain == ".." {
+		domain = ".local."
+	}
+	service := params.ServiceName()
+	if service == params.ServiceTypeName() {
+		// Service type enumeration points to service types, not instances.
+		service = ""
+	}
+	var valid []dns.RR
+	for _, rr := range sections {
+		if !saneRecord(rr, service, domain) {
+			c.stats.rejectedRecords.Add(1)
+			continue
+		}
+		valid = append(valid, rr)
+	}
+	return valid
+}
+
+// saneRecord reports whether the names of rr fit a query for the instances of
+// service, if not empty, in domain.
+func saneRecord(rr dns.RR, service, domain string) bool {
+	if _, ok := rr.(*dns.OPT); ok {
+		return true
+	}
+	if !hasSuffixFold(rr.Header().Name, domain) {
+		return false
+	}
+	switch rr := rr.(type) {
+	case *dns.PTR:
+		if service != "" && hasSuffixFold(rr.Hdr.Name, service) {
+			// Instances of the service type, also when browsed by subtype
+			return hasSuffixFold(rr.Ptr, "."+service)
+		}
+	case *dns.SRV:
+		return hasSuffixFold(rr.Target, domain)
+	}
+	return true
+}
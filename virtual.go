@@ -0,0 +1,134 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// virtualIface is the interface of the transports attached to a VirtualLink.
+// Its index is not used by any system interface, so lookups of its addresses
+// find none.
+var virtualIface = net.Interface{
+	Index: 1 << 20,
+	MTU:   defaultMTU,
+	Name:  "virtual0",
+	Flags: net.FlagUp | net.FlagMulticast,
+}
+
+// VirtualLink is an in-process network link, e.g. for integration tests which
+// exercise probing, announcements and browsing without real sockets or a
+// multicast-capable network. Transports attached with NewTransport act as
+// hosts on the link: packets sent to the mDNS group are delivered to all of
+// them, the sender included as with multicast loopback, and packets sent to an
+// address only to the transport having it. Delivery is synchronous, so a packet
+// is queued at its receivers once the send returns. Like a socket, a transport
+// keeps the packets arriving before it has a user, up to a bound.
+type VirtualLink struct {
+	mu         sync.Mutex
+	transports []*Transport
+}
+
+// NewVirtualLink creates an empty link.
+func NewVirtualLink() *VirtualLink {
+	return &VirtualLink{}
+}
+
+// NewTransport attaches a host with the given IPv4 or IPv6 address to the
+// link. Pass the transport to WithTransport to browse through it, and to
+// WithServerTransport to register services on it. Since the virtual interface
+// has no addresses known to the system, services are registered with
+// RegisterProxy or RegisterProxyHosts, publishing addr explicitly.
+func (l *VirtualLink) NewTransport(addr string) (*Transport, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	t := &Transport{
+		ifaces: []net.Interface{virtualIface},
+		subs:   make(map[chan *transportPacket]struct{}),
+		holds:  make(map[int]int),
+		link:   l,
+		addr:   ip,
+	}
+	t.membership.record(ip.To4() == nil, virtualIface, nil)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, other := range l.transports {
+		if other.addr.Equal(ip) {
+			return nil, fmt.Errorf("address %s is in use on the link", ip)
+		}
+	}
+	l.transports = append(l.transports, t)
+	return t, nil
+}
+
+// detach removes t from the link.
+func (l *VirtualLink) detach(t *Transport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, other := range l.transports {
+		if other == t {
+			l.transports = append(l.transports[:i:i], l.transports[i+1:]...)
+			return
+		}
+	}
+}
+
+// Inject delivers a datagram as if a host outside of the link sent it from
+// src to dst, e.g. to replay captured traffic.
+func (l *VirtualLink) Inject(src, dst *net.UDPAddr, data []byte) {
+	l.deliver(src, data, dst)
+}
+
+// deliver hands a packet sent from src to the transports dst reaches. Packets
+// to the mDNS group only reach the hosts of the same address family.
+func (l *VirtualLink) deliver(src *net.UDPAddr, b []byte, dst *net.UDPAddr) {
+	info := packetInfo{ifIndex: virtualIface.Index, ttl: onLinkTTL, dst: dst.IP}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, t := range l.transports {
+		if dst.IP.IsMulticast() {
+			if (t.addr.To4() == nil) != (dst.IP.To4() == nil) {
+				continue
+			}
+		} else if !t.addr.Equal(dst.IP) {
+			continue
+		}
+		t.dispatch(&transportPacket{data: append([]byte(nil), b...), info: info, from: src})
+	}
+}
+
+// virtual reports whether t is attached to a VirtualLink rather than using
+// sockets.
+func (t *Transport) virtual() bool {
+	return t != nil && t.link != nil
+}
+
+// localAddr returns the address of a virtual transport on the mDNS port.
+func (t *Transport) localAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: t.addr, Port: ipv4Addr.Port}
+}
+
+// groupAddr returns the mDNS group address of the family of a virtual
+// transport.
+func (t *Transport) groupAddr() *net.UDPAddr {
+	if t.addr.To4() != nil {
+		return ipv4Addr
+	}
+	return ipv6Addr
+}
+
+// send delivers a packet on the link of a virtual transport.
+func (t *Transport) send(b []byte, dst *net.UDPAddr) error {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return net.ErrClosed
+	}
+	t.link.deliver(t.localAddr(), b, dst)
+	return nil
+}
@@ -0,0 +1,112 @@
+package zeroconf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// registerVirtual registers a service on a new host of the link and returns it
+// with the channel receiving its lifecycle events.
+func registerVirtual(t *testing.T, link *VirtualLink, addr, instance, host string, port int) (*Server, <-chan ServerEvent) {
+	t.Helper()
+	tr, err := link.NewTransport(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	events := make(chan ServerEvent, 16)
+	s, err := RegisterProxy(instance, "_test._tcp", "local.", port, host, []string{addr}, []string{"txtvers=1"}, nil,
+		WithServerTransport(tr), WithAnnouncements(1), WithInterfaceMonitor(0),
+		WithEventHandler(func(e ServerEvent) { events <- e }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s, events
+}
+
+// waitEvent returns the first event of the given type, failing after a
+// timeout.
+func waitEvent(t *testing.T, events <-chan ServerEvent, typ ServerEventType) ServerEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+func TestVirtualLinkProbeAndAnnounce(t *testing.T) {
+	link := NewVirtualLink()
+	_, events := registerVirtual(t, link, "192.0.2.1", "Printer", "printer", 631)
+
+	waitEvent(t, events, EventProbing)
+	e := waitEvent(t, events, EventAnnounced)
+	if e.Instance != "Printer" {
+		t.Errorf("announced instance %q, want %q", e.Instance, "Printer")
+	}
+}
+
+func TestVirtualLinkConflictRename(t *testing.T) {
+	link := NewVirtualLink()
+	first, events := registerVirtual(t, link, "192.0.2.1", "Printer", "printer", 631)
+	waitEvent(t, events, EventAnnounced)
+
+	second, events := registerVirtual(t, link, "192.0.2.2", "Printer", "printer", 632)
+	waitEvent(t, events, EventRenamed)
+	waitEvent(t, events, EventAnnounced)
+
+	if got := first.Instance(); got != "Printer" {
+		t.Errorf("first instance %q, want %q", got, "Printer")
+	}
+	if got := second.Instance(); got != "Printer (2)" {
+		t.Errorf("second instance %q, want %q", got, "Printer (2)")
+	}
+	if got := second.HostName(); got != "printer-2.local." {
+		t.Errorf("second host name %q, want %q", got, "printer-2.local.")
+	}
+}
+
+func TestVirtualLinkBrowse(t *testing.T) {
+	link := NewVirtualLink()
+	_, events := registerVirtual(t, link, "192.0.2.1", "Printer", "printer", 631)
+	waitEvent(t, events, EventAnnounced)
+
+	tr, err := link.NewTransport("192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	r, err := NewResolver(WithTransport(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry)
+	if err := r.Browse(ctx, "_test._tcp", "local.", nil, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-entries:
+		if e.Instance != "Printer" || e.Port != 631 || e.HostName != "printer.local." {
+			t.Errorf("browsed %q on %s:%d, want %q on printer.local.:631", e.Instance, e.HostName, e.Port, "Printer")
+		}
+		if len(e.AddrIPv4) != 1 || e.AddrIPv4[0].String() != "192.0.2.1" {
+			t.Errorf("browsed addresses %v, want [192.0.2.1]", e.AddrIPv4)
+		}
+		if len(e.Text) != 1 || e.Text[0] != "txtvers=1" {
+			t.Errorf("browsed text %q, want [txtvers=1]", e.Text)
+		}
+	case <-ctx.Done():
+		t.Fatal("service not found")
+	}
+}
@@ -0,0 +1,30 @@
+package zeroconf
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// bindToDevice binds the socket to the VRF master device with the given name,
+// so it sends and receives on the interfaces enslaved to it.
+func bindToDevice(c syscall.RawConn, vrf string) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, vrf)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// vrfMember returns a function reporting whether an interface is enslaved to
+// the VRF master device with the given name.
+func vrfMember(vrf string) func(net.Interface) bool {
+	return func(iface net.Interface) bool {
+		master, err := os.Readlink(filepath.Join("/sys/class/net", iface.Name, "master"))
+		return err == nil && filepath.Base(master) == vrf
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindToDevice fails: VRF devices exist on Linux only.
+func bindToDevice(c syscall.RawConn, vrf string) error {
+	return fmt.Errorf("VRF devices are only supported on Linux")
+}
+
+// vrfMember returns a function reporting no interface as enslaved to vrf.
+func vrfMember(vrf string) func(net.Interface) bool {
+	return func(net.Interface) bool { return false }
+}
@@ -0,0 +1,175 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Default TTL of the records registered in a unicast zone
+	wideAreaTTL = 3600
+	// Default time to wait for the reply to an update
+	wideAreaTimeout = 5 * time.Second
+	// Validity of the TSIG signature of an update, and the size its MAC adds
+	// at most once signed
+	wideAreaFudge   = 300
+	wideAreaMACSize = 64
+)
+
+// WideAreaConfig describes a unicast DNS zone a service is registered in for
+// wide-area DNS-SD (RFC6763 section 11), using dynamic updates (RFC2136).
+type WideAreaConfig struct {
+	Server string // Primary server of the zone, "host:port" or "host" for port 53
+	Zone   string // Zone the service is registered in, e.g. "example.com."
+	// Host name the SRV record points to and whose address records are
+	// registered as well. Defaults to the first label of the mDNS host name
+	// within the zone.
+	HostName string
+	TTL      uint32        // TTL of the records, 3600 seconds if zero
+	Timeout  time.Duration // Time to wait for the reply, 5 seconds if zero
+
+	// TSIG key signing the updates (RFC8945), if any. The secret is base64
+	// encoded; the algorithm defaults to HMAC-SHA256.
+	TSIGName      string
+	TSIGSecret    string
+	TSIGAlgorithm string
+}
+
+// RegisterWideArea registers the PTR, SRV and TXT records of the service, along
+// with the address records of its host, in a unicast DNS zone, so clients
+// browsing that domain find it outside the local link. It complements the
+// mDNS announcements, which go on as usual. Records of the instance and host
+// left from a previous registration are replaced; the caller should call it
+// again after the service changed.
+func (s *Server) RegisterWideArea(ctx context.Context, conf WideAreaConfig) error {
+	conf = conf.withDefaults()
+	s.mu.RLock()
+	records, host := s.wideAreaRecords(conf)
+	s.mu.RUnlock()
+	instance := records[0].(*dns.PTR).Ptr
+
+	m := new(dns.Msg)
+	m.SetUpdate(conf.Zone)
+	// Replace the records of the instance and of the host, but only add our
+	// PTR records since other services are listed at the same names.
+	m.RemoveRRset([]dns.RR{
+		&dns.ANY{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeAAAA}},
+	})
+	m.Insert(records)
+	return exchangeUpdate(ctx, m, conf)
+}
+
+// UnregisterWideArea removes the records registered with RegisterWideArea from
+// the zone.
+func (s *Server) UnregisterWideArea(ctx context.Context, conf WideAreaConfig) error {
+	conf = conf.withDefaults()
+	s.mu.RLock()
+	records, host := s.wideAreaRecords(conf)
+	s.mu.RUnlock()
+	instance := records[0].(*dns.PTR).Ptr
+
+	var ptrs []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypePTR {
+			ptrs = append(ptrs, rr)
+		}
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(conf.Zone)
+	m.Remove(ptrs)
+	m.RemoveRRset([]dns.RR{
+		&dns.ANY{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeAAAA}},
+	})
+	return exchangeUpdate(ctx, m, conf)
+}
+
+// withDefaults returns the configuration with the zone qualified and the
+// defaults applied.
+func (c WideAreaConfig) withDefaults() WideAreaConfig {
+	c.Zone = dns.Fqdn(c.Zone)
+	if c.TTL == 0 {
+		c.TTL = wideAreaTTL
+	}
+	if c.Timeout == 0 {
+		c.Timeout = wideAreaTimeout
+	}
+	if c.TSIGAlgorithm == "" {
+		c.TSIGAlgorithm = dns.HmacSHA256
+	}
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		c.Server = net.JoinHostPort(c.Server, "53")
+	}
+	return c
+}
+
+// wideAreaRecords returns the records of the service within the zone, the
+// instance PTR record first, and the host name they point to.
+func (s *Server) wideAreaRecords(conf WideAreaConfig) ([]dns.RR, string) {
+	host := conf.HostName
+	if host == "" {
+		host = strings.SplitN(s.service.HostName, ".", 2)[0]
+	}
+	host = qualifyHostName(host, conf.Zone)
+
+	record := NewServiceRecord(s.service.Instance, s.service.Service, conf.Zone)
+	instance := record.ServiceInstanceName()
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: conf.TTL}
+	}
+	records := []dns.RR{
+		&dns.PTR{Hdr: hdr(record.ServiceName(), dns.TypePTR), Ptr: instance},
+		&dns.PTR{Hdr: hdr(record.ServiceTypeName(), dns.TypePTR), Ptr: record.ServiceName()},
+		&dns.SRV{Hdr: hdr(instance, dns.TypeSRV), Port: uint16(s.service.Port), Target: host},
+		&dns.TXT{Hdr: hdr(instance, dns.TypeTXT), Txt: s.service.Text},
+	}
+	for _, subtype := range s.service.Subtypes {
+		label := strings.SplitN(subtype, "._sub.", 2)[0]
+		name := fmt.Sprintf("%s._sub.%s", label, record.ServiceName())
+		records = append(records, &dns.PTR{Hdr: hdr(name, dns.TypePTR), Ptr: instance})
+	}
+	for _, ip := range s.service.AddrIPv4 {
+		records = append(records, &dns.A{Hdr: hdr(host, dns.TypeA), A: ip})
+	}
+	for _, ip := range s.service.AddrIPv6 {
+		if ip.IsLinkLocalUnicast() {
+			// Unreachable beyond the link.
+			continue
+		}
+		records = append(records, &dns.AAAA{Hdr: hdr(host, dns.TypeAAAA), AAAA: ip})
+	}
+	return records, host
+}
+
+// exchangeUpdate sends an update to the primary server of the zone, signed if a
+// TSIG key is configured, and checks the reply.
+func exchangeUpdate(ctx context.Context, m *dns.Msg, conf WideAreaConfig) error {
+	c := &dns.Client{Net: "udp", Timeout: conf.Timeout}
+	if conf.TSIGName != "" {
+		name := dns.Fqdn(conf.TSIGName)
+		c.TsigSecret = map[string]string{name: conf.TSIGSecret}
+		m.SetTsig(name, conf.TSIGAlgorithm, wideAreaFudge, time.Now().Unix())
+	}
+	// Servers accept larger messages over TCP only.
+	if m.Len()+wideAreaMACSize > dns.MinMsgSize {
+		c.Net = "tcp"
+	}
+	r, _, err := c.ExchangeContext(ctx, m, conf.Server)
+	if err != nil {
+		return fmt.Errorf("zeroconf: update of %s failed: %v", conf.Zone, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("zeroconf: update of %s refused: %s", conf.Zone, dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
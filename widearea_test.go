@@ -0,0 +1,92 @@
+package zeroconf
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// serveUpdates answers the DNS updates sent over UDP or TCP to the returned
+// address with rcode and hands them to updates.
+func serveUpdates(t *testing.T, rcode int, updates chan<- *dns.Msg) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		select {
+		case updates <- m:
+		default:
+		}
+		reply := new(dns.Msg)
+		reply.SetRcode(m, rcode)
+		w.WriteMsg(reply)
+	})
+	// Only queries and notifies are accepted by default.
+	accept := func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }
+	for _, srv := range []*dns.Server{{Listener: l, Handler: handler}, {PacketConn: pc, Handler: handler}} {
+		srv.MsgAcceptFunc = accept
+		go srv.ActivateAndServe()
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return l.Addr().String()
+}
+
+func TestRegisterWideArea(t *testing.T) {
+	s, events := registerVirtual(t, NewVirtualLink(), "192.0.2.1", "Printer", "printer", 631)
+	waitEvent(t, events, EventAnnounced)
+	updates := make(chan *dns.Msg, 1)
+	conf := WideAreaConfig{Server: serveUpdates(t, dns.RcodeSuccess, updates), Zone: "example.com"}
+
+	if err := s.RegisterWideArea(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+	m := <-updates
+	if m.Opcode != dns.OpcodeUpdate || len(m.Question) != 1 || m.Question[0].Name != "example.com." {
+		t.Fatalf("received %v, want an update of example.com.", m)
+	}
+	want := map[string]bool{
+		"_test._tcp.example.com.\tPTR":         false,
+		"Printer._test._tcp.example.com.\tSRV": false,
+		"Printer._test._tcp.example.com.\tTXT": false,
+		"printer.example.com.\tA":              false,
+	}
+	for _, rr := range m.Ns {
+		hdr := rr.Header()
+		if hdr.Class != dns.ClassINET {
+			// Deletion of the previous records
+			continue
+		}
+		key := hdr.Name + "\t" + dns.TypeToString[hdr.Rrtype]
+		if _, ok := want[key]; ok {
+			want[key] = true
+		}
+		if srv, ok := rr.(*dns.SRV); ok && (srv.Target != "printer.example.com." || srv.Port != 631) {
+			t.Errorf("registered SRV %v, want printer.example.com. port 631", srv)
+		}
+	}
+	for key, found := range want {
+		if !found {
+			t.Errorf("update lacks %s", key)
+		}
+	}
+}
+
+func TestRegisterWideAreaRefused(t *testing.T) {
+	s, events := registerVirtual(t, NewVirtualLink(), "192.0.2.1", "Printer", "printer", 631)
+	waitEvent(t, events, EventAnnounced)
+	updates := make(chan *dns.Msg, 1)
+	conf := WideAreaConfig{Server: serveUpdates(t, dns.RcodeRefused, updates), Zone: "example.com"}
+
+	if err := s.UnregisterWideArea(context.Background(), conf); err == nil {
+		t.Error("refused update succeeded")
+	}
+}